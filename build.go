@@ -3,14 +3,16 @@ package sti
 import (
 	"bufio"
 	"bytes"
+	"encoding/json"
+	"fmt"
 	"io"
-	"log"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"regexp"
 	"strings"
 	"text/template"
+	"time"
 
 	"github.com/fsouza/go-dockerclient"
 )
@@ -22,31 +24,179 @@ type BuildRequest struct {
 	Clean       bool
 	Environment map[string]string
 	Method      string
-	Writer      io.Writer
+	CopyMode    string
+	Writer      io.Writer `json:"-"`
+
+	// Build a local git repository from its working tree, including uncommitted
+	// changes, rather than copying the whole directory.
+	WorkingTree bool
+	// Leave files not tracked by git out of a working tree build.
+	ExcludeUntracked bool
+
+	// Truncate the history of a cloned git source to this many commits, if non-zero.
+	CloneDepth int
+	// Check out the submodules of a cloned git source, recursively.
+	Submodules bool
+	// Check out only these paths of a cloned git source, if any.
+	SparsePaths []string
+	// Branch, tag or commit of a cloned git source to build instead of its default
+	// branch, if any.
+	Ref string
+
+	// Directory within the source, relative to its root, to use as the application
+	// source instead of the whole source.
+	ContextDir string
+
+	// What to do when another build of the same tag is in progress: wait for it to
+	// finish, or fail.  Defaults to waiting.
+	TagLockPolicy string
+
+	// Receives the progress of the build, if set.  It is called from the goroutine
+	// performing the build, which it should not hold up.
+	Events func(BuildEvent) `json:"-"`
 }
 
-type BuildResult STIResult
+type BuildResult struct {
+	Success  bool
+	Messages []string
+	Metadata *BuildMetadata
+}
+
+// Policies for a build whose tag is locked by another build.
+const (
+	TagLockWait = "wait"
+	TagLockFail = "fail"
+)
 
 // Build processes a BuildRequest and returns a *BuildResult and an error.
 // An error represents a failure performing the build rather than a failure
 // of the build itself.  Callers should check the Success field of the result
 // to determine whether a build succeeded or not.
-func Build(req BuildRequest) (*BuildResult, error) {
-	method := req.Method
-	if method == "" {
-		req.Method = "build"
-	} else {
-		if !stringInSlice(method, []string{"run", "build"}) {
-			return nil, ErrInvalidBuildMethod
+//
+// Each build works in its own uniquely named directory within the request's
+// WorkingDir, so builds may share a WorkingDir.  Builds of the same tag, which
+// share incremental artifacts, are serialized according to the TagLockPolicy.
+func Build(req BuildRequest) (result *BuildResult, err error) {
+	start := time.Now()
+	defer func() {
+		req.Metrics.build(result, err, time.Since(start))
+	}()
+
+	if req.Method != "" && !stringInSlice(req.Method, defaultBuildMethods) {
+		return nil, ErrInvalidBuildMethod
+	}
+
+	if strings.HasPrefix(req.Ref, "-") {
+		return nil, ErrInvalidRef
+	}
+
+	if req.ContextDir != "" {
+		req.ContextDir = filepath.Clean(req.ContextDir)
+		if filepath.IsAbs(req.ContextDir) || req.ContextDir == ".." || strings.HasPrefix(req.ContextDir, "../") {
+			return nil, ErrInvalidContextDir
+		}
+		if req.ContextDir == "." {
+			req.ContextDir = ""
+		}
+		if req.ContextDir != "" && len(req.SparsePaths) > 0 && !withinPaths(req.ContextDir, req.SparsePaths) {
+			return nil, ErrContextDirNotSparse
 		}
 	}
 
+	if req.CopyMode == "" {
+		req.CopyMode = CopyModeCopy
+	} else if !stringInSlice(req.CopyMode, []string{CopyModeCopy, CopyModeLink, CopyModeReflink}) {
+		return nil, ErrInvalidCopyMode
+	}
+
+	if req.TagLockPolicy == "" {
+		req.TagLockPolicy = TagLockWait
+	} else if !stringInSlice(req.TagLockPolicy, []string{TagLockWait, TagLockFail}) {
+		return nil, ErrInvalidTagLockPolicy
+	}
+
 	h, err := newHandler(req.Request)
 	if err != nil {
 		return nil, err
 	}
+	defer h.release()
+	h.events = req.Events
+
+	h.trace = req.Tracer.newTrace()
+	span := h.trace.start("build", "sti.tag", req.Tag, "sti.source", req.Source,
+		"sti.builder_image", req.BaseImage, "sti.runtime_image", req.RuntimeImage)
+	defer func() {
+		span.end(err)
+		exportErr := h.trace.export()
+		if exportErr != nil {
+			h.log.Warn("Unable to export trace", "error", exportErr)
+		}
+	}()
+
+	done := make(chan struct{})
+	defer close(done)
+	go h.watchCancel(req.Cancel, done)
+
+	lock, err := h.lockTag(req.Tag, req.TagLockPolicy == TagLockWait)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Close()
+
+	workspace, workspaceLock, err := h.newWorkspace(req.WorkingDir)
+	if err != nil {
+		return nil, err
+	}
+	defer workspaceLock.Close()
+	req.WorkingDir = workspace
+
+	var builderCaps, runtimeCaps *Capabilities
+	err = h.phase(PhasePullImages, func() error {
+		image, err := h.checkAndPull(req.BaseImage)
+		if err != nil {
+			return err
+		}
+		builderCaps, err = h.imageCapabilities(image)
+		if err != nil || req.RuntimeImage == "" {
+			return err
+		}
+
+		image, err = h.checkAndPull(req.RuntimeImage)
+		if err != nil {
+			return err
+		}
+		runtimeCaps, err = h.imageCapabilities(image)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
 
-	incremental := !req.Clean
+	// The deployable image is built from the runtime image of an extended build, and
+	// from the build image otherwise
+	deployCaps := builderCaps
+	if runtimeCaps != nil {
+		deployCaps = runtimeCaps
+	}
+	if req.Method == "" {
+		req.Method = deployCaps.BuildMethods[0]
+	} else if !deployCaps.supportsMethod(req.Method) {
+		h.log.Error("Build method is not supported by the image", "method", req.Method, "supported", strings.Join(deployCaps.BuildMethods, ","))
+		return nil, ErrUnsupportedBuildMethod
+	}
+
+	for _, caps := range []*Capabilities{builderCaps, runtimeCaps} {
+		if caps == nil {
+			continue
+		}
+		if missing := caps.missingEnv(req.Environment); len(missing) > 0 {
+			h.log.Error("Image requires environment variables that were not given", "missing", strings.Join(missing, ","))
+			return nil, ErrMissingRequiredEnv
+		}
+	}
+
+	// An image declaring it does not support incremental builds is always built clean
+	incremental := !req.Clean && (builderCaps.Incremental || !builderCaps.declares(LabelIncremental))
 
 	// If a runtime image is defined, check for the presence of an
 	// existing build image for the app to determine if an incremental
@@ -57,59 +207,116 @@ func Build(req BuildRequest) (*BuildResult, error) {
 	}
 
 	if incremental {
-		exists, err := h.isImageInLocalRegistry(tag)
-
-		if err != nil {
-			return nil, err
-		}
-
-		if exists {
-			incremental, err = h.detectIncrementalBuild(tag)
+		err = h.phase(PhaseDetectIncremental, func() error {
+			exists, err := h.isImageInLocalRegistry(tag)
 			if err != nil {
-				return nil, err
+				return err
 			}
-		} else {
+
+			if exists {
+				incremental, err = h.detectIncrementalBuild(tag)
+				return err
+			}
+
 			incremental = false
+			return nil
+		})
+		if err != nil {
+			return nil, err
 		}
+		h.metrics.incremental(incremental)
 	}
 
-	if h.debug {
-		if incremental {
-			log.Printf("Existing image for tag %s detected for incremental build\n", tag)
-		} else {
-			log.Printf("Clean build will be performed")
-		}
+	if incremental {
+		h.log.Debug("Existing image detected for incremental build", "image", tag)
+	} else {
+		h.log.Debug("Clean build will be performed")
+	}
+
+	metadata := &BuildMetadata{
+		Tag:          req.Tag,
+		Source:       req.Source,
+		ContextDir:   req.ContextDir,
+		BuilderImage: h.imageID(req.BaseImage),
+		Method:       req.Method,
+		Incremental:  incremental,
+		Version:      Version,
+
+		BuilderName:      req.BaseImage,
+		RuntimeName:      req.RuntimeImage,
+		Ref:              req.Ref,
+		Environment:      req.Environment,
+		CopyMode:         req.CopyMode,
+		WorkingTree:      req.WorkingTree,
+		ExcludeUntracked: req.ExcludeUntracked,
+		CloneDepth:       req.CloneDepth,
+		Submodules:       req.Submodules,
+		SparsePaths:      req.SparsePaths,
+	}
+	if req.RuntimeImage != "" {
+		metadata.RuntimeImage = h.imageID(req.RuntimeImage)
 	}
-
-	var result *BuildResult
 
 	if req.RuntimeImage == "" {
-		result, err = h.build(req, incremental)
+		result, err = h.build(req, builderCaps, metadata, incremental)
 	} else {
-		result, err = h.extendedBuild(req, incremental)
+		result, err = h.extendedBuild(req, builderCaps, runtimeCaps, metadata, incremental)
+	}
+
+	if h.resources.isCancelled() {
+		return nil, ErrBuildCancelled
 	}
 
 	return result, err
 }
 
+// Takes the lock for builds of tag, waiting for other builds of the tag to finish if
+// wait is set and failing with ErrTagLocked otherwise.  The lock is released by
+// closing the returned file.
+func (h requestHandler) lockTag(tag string, wait bool) (*os.File, error) {
+	path, err := lockPath(url.QueryEscape(tag))
+	if err != nil {
+		return nil, err
+	}
+	h.log.Debug("Locking tag", "tag", tag, "path", path)
+
+	lock, err := lockFile(path, wait)
+	if err == ErrLockHeld {
+		return nil, ErrTagLocked
+	}
+
+	return lock, err
+}
+
+// Determines whether the image with the tag can be built on incrementally: whether it
+// declares that it supports incremental builds, or if it declares nothing, whether it
+// has a save-artifacts script.
 func (h requestHandler) detectIncrementalBuild(tag string) (bool, error) {
-	if h.debug {
-		log.Printf("Determining whether image %s is compatible with incremental build", tag)
+	h.log.Debug("Determining whether image is compatible with incremental build", "image", tag)
+
+	image, err := h.dockerClient.InspectImage(tag)
+	if err != nil {
+		return false, err
+	}
+	caps, err := h.imageCapabilities(image)
+	if err != nil {
+		return false, err
+	}
+	if caps.declares(LabelIncremental) {
+		return caps.Incremental, nil
 	}
 
-	container, err := h.containerFromImage(tag)
+	files, err := h.imageFiles(tag)
 	if err != nil {
 		return false, err
 	}
-	defer h.removeContainer(container.ID)
 
-	return FileExistsInContainer(h.dockerClient, container.ID, "/usr/bin/save-artifacts"), nil
+	file, err := resolveFile(caps.script("save-artifacts"), files)
+	return file != nil, err
 }
 
-func (h requestHandler) build(req BuildRequest, incremental bool) (*BuildResult, error) {
-	if h.debug {
-		log.Printf("Performing source build from %s\n", req.Source)
-	}
+func (h requestHandler) build(req BuildRequest, caps *Capabilities, metadata *BuildMetadata, incremental bool) (*BuildResult, error) {
+	h.log.Debug("Performing source build", "source", req.Source)
 	if incremental {
 		artifactTmpDir := filepath.Join(req.WorkingDir, "artifacts")
 		err := os.Mkdir(artifactTmpDir, 0700)
@@ -124,15 +331,17 @@ func (h requestHandler) build(req BuildRequest, incremental bool) (*BuildResult,
 	}
 
 	targetSourceDir := filepath.Join(req.WorkingDir, "src")
-	err := h.prepareSourceDir(req.Source, targetSourceDir)
+	err := h.phase(PhasePrepareSource, func() error {
+		return h.prepareSourceDir(req, targetSourceDir, metadata)
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	return h.buildDeployableImage(req, req.BaseImage, req.WorkingDir, incremental)
+	return h.buildDeployableImage(req, req.BaseImage, caps, req.WorkingDir, metadata, incremental)
 }
 
-func (h requestHandler) extendedBuild(req BuildRequest, incremental bool) (*BuildResult, error) {
+func (h requestHandler) extendedBuild(req BuildRequest, builderCaps *Capabilities, runtimeCaps *Capabilities, metadata *BuildMetadata, incremental bool) (*BuildResult, error) {
 	var (
 		buildImageTag = req.Tag + "-build"
 		wd            = req.WorkingDir
@@ -159,88 +368,120 @@ func (h requestHandler) extendedBuild(req BuildRequest, incremental bool) (*Buil
 		}
 	}
 
-	err := h.prepareSourceDir(req.Source, inputSourceDir)
+	err := h.phase(PhasePrepareSource, func() error {
+		return h.prepareSourceDir(req, inputSourceDir, metadata)
+	})
 	if err != nil {
 		return nil, err
 	}
 
 	// TODO: necessary to specify these, if specifying bind-mounts?
 	volumeMap := make(map[string]struct{})
-	volumeMap["/usr/artifacts"] = struct{}{}
-	volumeMap["/usr/src"] = struct{}{}
-	volumeMap["/usr/build"] = struct{}{}
+	volumeMap[builderCaps.ArtifactsDir] = struct{}{}
+	volumeMap[builderCaps.SourceDir] = struct{}{}
+	volumeMap[builderCaps.OutputDir] = struct{}{}
 
 	bindMounts := []string{
-		previousBuildVolume + ":/usr/artifacts",
-		inputSourceDir + ":/usr/src",
-		outputSourceDir + ":/usr/build",
+		previousBuildVolume + ":" + builderCaps.ArtifactsDir,
+		inputSourceDir + ":" + builderCaps.SourceDir,
+		outputSourceDir + ":" + builderCaps.OutputDir,
 	}
 
-	if h.debug {
-		log.Println("Creating build container to run source build")
-	}
+	h.log.Debug("Creating build container to run source build", "image", req.BaseImage)
 
-	config := docker.Config{Image: req.BaseImage, Cmd: []string{"/usr/bin/prepare"}, Volumes: volumeMap}
-	container, err := h.dockerClient.CreateContainer(docker.CreateContainerOptions{Name: "", Config: &config})
-	if err != nil {
-		return nil, err
-	}
-	cID := container.ID
+	var cID string
+	err = h.phase(PhaseRunBuilder, func() error {
+		config := docker.Config{Image: req.BaseImage, Cmd: []string{builderCaps.script("prepare")}, Volumes: volumeMap}
+		container, err := h.createContainer(config)
+		if err != nil {
+			return err
+		}
+		cID = container.ID
 
-	if h.debug {
-		log.Printf("Build container: %s\n", cID)
-	} else {
+		hostConfig := docker.HostConfig{Binds: bindMounts}
+		outputDone := h.streamContainerOutput(cID)
+		err = h.dockerClient.StartContainer(cID, &hostConfig)
+		if err != nil {
+			return err
+		}
+
+		exitCode, err := h.dockerClient.WaitContainer(cID)
+		if err != nil {
+			return err
+		}
+		outputDone()
+
+		if exitCode != 0 {
+			return ErrBuildFailed
+		}
+		return nil
+	})
+	if cID != "" {
 		defer h.removeContainer(cID)
 	}
-
-	hostConfig := docker.HostConfig{Binds: bindMounts}
-	err = h.dockerClient.StartContainer(cID, &hostConfig)
 	if err != nil {
 		return nil, err
 	}
 
-	exitCode, err := h.dockerClient.WaitContainer(cID)
+	buildResult, err := h.buildDeployableImage(req, req.RuntimeImage, runtimeCaps, runtimeBuildDir, metadata, false)
 	if err != nil {
 		return nil, err
 	}
 
-	if exitCode != 0 {
-		return nil, ErrBuildFailed
-	}
+	h.log.Debug("Committing build container", "container", cID, "tag", buildImageTag)
 
-	buildResult, err := h.buildDeployableImage(req, req.RuntimeImage, runtimeBuildDir, false)
-	if err != nil {
-		return nil, err
-	}
-
-	if h.debug {
-		log.Printf("Commiting build container %s to tag %s", cID, buildImageTag)
-	}
-
-	err = h.commitContainer(cID, buildImageTag)
+	buildMetadata := *metadata
+	buildMetadata.Tag = buildImageTag
+	buildMetadata.RuntimeImage = ""
+	buildMetadata.RuntimeName = ""
+	err = h.phase(PhaseCommitBuilder, func() error {
+		err := h.commitContainer(cID, buildImageTag, buildMetadata.labels())
+		if err == nil {
+			h.emit(BuildEvent{Kind: EventImageCommitted, Image: buildImageTag, ImageID: h.imageID(buildImageTag)})
+		}
+		return err
+	})
 	if err != nil {
-		log.Printf("Unable commit container %s to tag %s\n", cID, buildImageTag)
+		h.log.Warn("Unable to commit build container", "container", cID, "tag", buildImageTag, "error", err)
 	}
 
 	return buildResult, nil
 }
 
 func (h requestHandler) saveArtifacts(image string, path string) error {
-	if h.debug {
-		log.Printf("Saving build artifacts from image %s to path %s\n", image, path)
+	return h.phase(PhaseSaveArtifacts, func() error {
+		err := h.runSaveArtifacts(image, path)
+		if err == nil {
+			h.emit(BuildEvent{Kind: EventArtifactsSaved, Image: image, Bytes: directorySize(path)})
+		}
+		return err
+	})
+}
+
+func (h requestHandler) runSaveArtifacts(image string, path string) error {
+	h.log.Debug("Saving build artifacts", "image", image, "path", path)
+
+	inspected, err := h.dockerClient.InspectImage(image)
+	if err != nil {
+		return err
+	}
+	caps, err := h.imageCapabilities(inspected)
+	if err != nil {
+		return err
 	}
 
 	volumeMap := make(map[string]struct{})
-	volumeMap["/usr/artifacts"] = struct{}{}
+	volumeMap[caps.ArtifactsDir] = struct{}{}
 
-	config := docker.Config{Image: image, Cmd: []string{"/usr/bin/save-artifacts"}, Volumes: volumeMap}
-	container, err := h.dockerClient.CreateContainer(docker.CreateContainerOptions{Name: "", Config: &config})
+	config := docker.Config{Image: image, Cmd: []string{caps.script("save-artifacts")}, Volumes: volumeMap}
+	container, err := h.createContainer(config)
 	if err != nil {
 		return err
 	}
 	defer h.removeContainer(container.ID)
 
-	hostConfig := docker.HostConfig{Binds: []string{path + ":/usr/artifacts"}}
+	hostConfig := docker.HostConfig{Binds: []string{path + ":" + caps.ArtifactsDir}}
+	outputDone := h.streamContainerOutput(container.ID)
 	err = h.dockerClient.StartContainer(container.ID, &hostConfig)
 	if err != nil {
 		return err
@@ -250,6 +491,7 @@ func (h requestHandler) saveArtifacts(image string, path string) error {
 	if err != nil {
 		return err
 	}
+	outputDone()
 
 	if exitCode != 0 {
 		return ErrSaveArtifactsFailed
@@ -258,45 +500,209 @@ func (h requestHandler) saveArtifacts(image string, path string) error {
 	return nil
 }
 
-func (h requestHandler) prepareSourceDir(source string, targetSourceDir string) error {
-	re := regexp.MustCompile("^git://")
+// Fetches or copies the source of the request into targetSourceDir, recording the
+// git commit of the source on the metadata if it is known.  If the request has a
+// context directory, only that directory of the source is placed in targetSourceDir.
+func (h requestHandler) prepareSourceDir(req BuildRequest, targetSourceDir string, metadata *BuildMetadata) error {
+	if isGitURL(req.Source) {
+		return h.cloneSource(req, targetSourceDir, metadata)
+	}
 
-	if re.MatchString(source) {
-		if h.debug {
-			log.Printf("Fetching %s to directory %s", source, targetSourceDir)
+	source := filepath.Join(req.Source, req.ContextDir)
+	if req.ContextDir != "" {
+		info, err := os.Stat(source)
+		if err != nil || !info.IsDir() {
+			return ErrContextDirNotFound
 		}
-		err := gitClone(source, targetSourceDir)
+	}
+
+	if req.WorkingTree {
+		return h.copyWorkingTree(req, targetSourceDir, metadata)
+	}
+
+	h.log.Debug("Copying source", "source", source, "target", targetSourceDir, "mode", req.CopyMode)
+
+	// TODO: investigate using bind-mounts instead
+	copier := h.newSourceCopier(req)
+	err := copier.copySource(source, targetSourceDir)
+	if err != nil {
+		h.log.Debug("Copying source failed", "error", err)
+		return err
+	}
+
+	h.log.Debug("Copied source", "source", source, "files", copier.files, "bytes", copier.bytes)
+
+	if isGitRepository(req.Source) {
+		metadata.Commit, err = gitRevision(req.Source)
 		if err != nil {
-			if h.debug {
-				log.Printf("Git clone failed: %+v", err)
-			}
-			return err
+			h.log.Debug("Unable to determine git revision", "source", req.Source, "error", err)
 		}
-	} else {
-		// TODO: investigate using bind-mounts instead
-		copy(source, targetSourceDir)
 	}
 
 	return nil
 }
 
-var dockerFileTemplate = template.Must(template.New("Dockerfile").Parse("" +
+// Clones the git source of the request into targetSourceDir, recording the fetched
+// revision on the metadata.  With a context directory, the repository is cloned
+// alongside targetSourceDir and the context directory moved into place; unless other
+// sparse paths are requested, only the context directory is checked out.
+func (h requestHandler) cloneSource(req BuildRequest, targetSourceDir string, metadata *BuildMetadata) error {
+	source := req.Source
+	opts := gitCloneOptions{
+		depth:       req.CloneDepth,
+		submodules:  req.Submodules,
+		sparsePaths: req.SparsePaths,
+		ref:         req.Ref,
+	}
+
+	cloneDir := targetSourceDir
+	if req.ContextDir != "" {
+		cloneDir = targetSourceDir + ".git"
+		if len(opts.sparsePaths) == 0 {
+			opts.sparsePaths = []string{req.ContextDir}
+		}
+	}
+
+	h.log.Debug("Fetching source", "source", source, "target", cloneDir)
+	span := h.trace.start("git clone", "sti.source", source)
+	err := gitClone(source, cloneDir, opts)
+	span.end(err)
+	if err != nil {
+		h.log.Debug("Git clone failed", "source", source, "error", err)
+		return err
+	}
+
+	metadata.Commit, err = gitRevision(cloneDir)
+	if err != nil {
+		return err
+	}
+
+	h.log.Debug("Fetched source", "source", source, "commit", metadata.Commit)
+
+	if req.ContextDir == "" {
+		return nil
+	}
+	defer os.RemoveAll(cloneDir)
+
+	contextDir := filepath.Join(cloneDir, req.ContextDir)
+	info, err := os.Stat(contextDir)
+	if err != nil || !info.IsDir() {
+		return ErrContextDirNotFound
+	}
+
+	return os.Rename(contextDir, targetSourceDir)
+}
+
+// Determines whether dir, relative to the root of a repository, is checked out by a
+// sparse checkout of paths: whether it is one of the paths or within one.
+func withinPaths(dir string, paths []string) bool {
+	dir = filepath.ToSlash(dir)
+	for _, path := range paths {
+		path = strings.Trim(filepath.ToSlash(filepath.Clean(path)), "/")
+		if path == "." || path == "" || dir == path || strings.HasPrefix(dir, path+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Copies the files of the git working tree at the request's source, or its context
+// directory, into targetSourceDir, recording the commit the working tree is based on
+// and whether it has uncommitted changes.
+func (h requestHandler) copyWorkingTree(req BuildRequest, targetSourceDir string, metadata *BuildMetadata) error {
+	source := filepath.Join(req.Source, req.ContextDir)
+
+	commit, err := gitRevision(source)
+	if err != nil {
+		return ErrNotGitWorkingTree
+	}
+
+	files, err := gitWorkingTreeFiles(source, req.ExcludeUntracked)
+	if err != nil {
+		return err
+	}
+
+	dirty, err := gitIsDirty(source, req.ExcludeUntracked)
+	if err != nil {
+		return err
+	}
+
+	h.log.Debug("Copying working tree", "source", source, "commit", commit, "dirty", dirty, "target", targetSourceDir)
+
+	copier := h.newSourceCopier(req)
+	err = copier.copyFiles(source, targetSourceDir, files)
+	if err != nil {
+		h.log.Debug("Copying working tree failed", "error", err)
+		return err
+	}
+
+	h.log.Debug("Copied working tree", "source", source, "files", copier.files, "bytes", copier.bytes)
+
+	metadata.Commit = commit
+	metadata.Dirty = dirty
+	return nil
+}
+
+// Returns a copier for the local source of the request.
+func (h requestHandler) newSourceCopier(req BuildRequest) *sourceCopier {
+	copier := &sourceCopier{mode: req.CopyMode}
+	copier.progress = func(files int, bytes int64) {
+		if files%1000 == 0 {
+			h.log.Debug("Copying source", "files", files, "bytes", bytes)
+		}
+	}
+
+	return copier
+}
+
+var dockerFileTemplate = template.Must(template.New("Dockerfile").Funcs(template.FuncMap{"quoteEnvValue": quoteEnvValue}).Parse("" +
 	"FROM {{.BaseImage}}\n" +
-	"ADD ./src /usr/src/\n" +
-	"{{if .Incremental}}ADD ./artifacts /usr/artifacts\n{{end}}" +
+	"ADD ./src {{.SourceDir}}/\n" +
+	"{{if .Incremental}}ADD ./artifacts {{.ArtifactsDir}}\n{{end}}" +
 	"{{range $key, $value := .Environment}}ENV {{$key}} {{$value}}\n{{end}}" +
-	"RUN /usr/bin/prepare\n" +
-	"CMD /usr/bin/run\n"))
+	"{{range $key, $value := .Labels}}ENV {{$key}}={{quoteEnvValue $value}}\n{{end}}" +
+	"RUN {{.Prepare}}\n" +
+	"{{if .Entrypoint}}ENTRYPOINT {{.Entrypoint}}\n{{end}}" +
+	"CMD {{.Run}}\n"))
+
+// Data for dockerFileTemplate.
+type dockerFileData struct {
+	BaseImage    string
+	Environment  map[string]string
+	Labels       map[string]string
+	Incremental  bool
+	SourceDir    string
+	ArtifactsDir string
+	Prepare      string
+	Run          string
+	// JSON encoded entrypoint of the image, if it is given one
+	Entrypoint string
+}
 
-func (h requestHandler) buildDeployableImage(req BuildRequest, image string, contextDir string, incremental bool) (*BuildResult, error) {
-	if req.Method == "run" {
-		return h.buildDeployableImageWithDockerRun(req, image, contextDir, incremental)
-	}
+func (h requestHandler) buildDeployableImage(req BuildRequest, image string, caps *Capabilities, contextDir string, metadata *BuildMetadata, incremental bool) (*BuildResult, error) {
+	var result *BuildResult
+	err := h.phase(PhaseBuildImage, func() error {
+		usage, err := h.takesUsageEntrypoint(image, caps)
+		if err != nil {
+			return err
+		}
 
-	return h.buildDeployableImageWithDockerBuild(req, image, contextDir, incremental)
+		if req.Method == "run" {
+			result, err = h.buildDeployableImageWithDockerRun(req, image, caps, contextDir, metadata, incremental, usage)
+		} else {
+			result, err = h.buildDeployableImageWithDockerBuild(req, image, caps, contextDir, metadata, incremental, usage)
+		}
+		if err == nil {
+			h.emit(BuildEvent{Kind: EventImageCommitted, Image: req.Tag, ImageID: h.imageID(req.Tag)})
+		}
+		return err
+	})
+
+	return result, err
 }
 
-func (h requestHandler) buildDeployableImageWithDockerBuild(req BuildRequest, image string, contextDir string, incremental bool) (*BuildResult, error) {
+func (h requestHandler) buildDeployableImageWithDockerBuild(req BuildRequest, image string, caps *Capabilities, contextDir string, metadata *BuildMetadata, incremental bool, usage bool) (*BuildResult, error) {
 	dockerFilePath := filepath.Join(contextDir, "Dockerfile")
 	dockerFile, err := openFileExclusive(dockerFilePath, 0700)
 	if err != nil {
@@ -304,28 +710,35 @@ func (h requestHandler) buildDeployableImageWithDockerBuild(req BuildRequest, im
 	}
 	defer dockerFile.Close()
 
-	templateFiller := struct {
-		BaseImage   string
-		Environment map[string]string
-		Incremental bool
-	}{image, req.Environment, incremental}
+	templateFiller := dockerFileData{
+		BaseImage:    image,
+		Environment:  req.Environment,
+		Labels:       metadata.labels(),
+		Incremental:  incremental,
+		SourceDir:    caps.SourceDir,
+		ArtifactsDir: caps.ArtifactsDir,
+		Prepare:      caps.script("prepare"),
+		Run:          caps.script("run"),
+	}
+	if usage {
+		templateFiller.Entrypoint = usageEntrypointJSON(caps.ScriptsDir)
+	}
 	err = dockerFileTemplate.Execute(dockerFile, templateFiller)
 	if err != nil {
 		return nil, ErrCreateDockerfileFailed
 	}
 
-	if h.debug {
-		log.Printf("Wrote Dockerfile for build to %s\n", dockerFilePath)
-	}
+	h.log.Debug("Wrote Dockerfile for build", "path", dockerFilePath)
 
-	tarBall, err := tarDirectory(contextDir)
+	// The tarball is named after the working directory, whose lock keeps GC away from
+	// both.
+	tarBall, err := tarDirectory(contextDir, req.WorkingDir+".tar")
 	if err != nil {
 		return nil, err
 	}
+	h.resources.addPath(tarBall.Name())
 
-	if h.debug {
-		log.Printf("Created tarball for %s at %s\n", contextDir, tarBall.Name())
-	}
+	h.log.Debug("Created build context tarball", "dir", contextDir, "path", tarBall.Name())
 
 	tarInput, err := os.Open(tarBall.Name())
 	if err != nil {
@@ -335,31 +748,34 @@ func (h requestHandler) buildDeployableImageWithDockerBuild(req BuildRequest, im
 	tarReader := bufio.NewReader(tarInput)
 	var output []string
 
+	span := h.trace.start("docker build", "sti.image", image, "sti.tag", req.Tag)
 	if req.Writer != nil {
-		err = h.dockerClient.BuildImage(docker.BuildImageOptions{req.Tag, false, false, true, tarReader, req.Writer, ""})
+		writer := h.outputWriter(req.Writer)
+		err = h.dockerClient.BuildImage(docker.BuildImageOptions{req.Tag, false, false, true, tarReader, writer, ""})
 	} else {
 		var buf []byte
 		writer := bytes.NewBuffer(buf)
-		err = h.dockerClient.BuildImage(docker.BuildImageOptions{req.Tag, false, false, true, tarReader, writer, ""})
+		err = h.dockerClient.BuildImage(docker.BuildImageOptions{req.Tag, false, false, true, tarReader, h.outputWriter(writer), ""})
 		rawOutput := writer.String()
 		output = strings.Split(rawOutput, "\n")
 	}
+	span.end(err)
 
 	if err != nil {
 		return nil, err
 	}
 
-	return &BuildResult{true, output}, nil
+	return &BuildResult{Success: true, Messages: output, Metadata: metadata}, nil
 }
 
-func (h requestHandler) buildDeployableImageWithDockerRun(req BuildRequest, image string, contextDir string, incremental bool) (*BuildResult, error) {
+func (h requestHandler) buildDeployableImageWithDockerRun(req BuildRequest, image string, caps *Capabilities, contextDir string, metadata *BuildMetadata, incremental bool, usage bool) (*BuildResult, error) {
 	volumeMap := make(map[string]struct{})
-	volumeMap["/usr/src"] = struct{}{}
+	volumeMap[caps.SourceDir] = struct{}{}
 	if incremental {
-		volumeMap["/usr/artifacts"] = struct{}{}
+		volumeMap[caps.ArtifactsDir] = struct{}{}
 	}
 
-	config := docker.Config{Image: image, Cmd: []string{"/usr/bin/prepare"}, Volumes: volumeMap}
+	config := docker.Config{Image: image, Cmd: []string{caps.script("prepare")}, Volumes: volumeMap}
 	var cmdEnv []string
 	if len(req.Environment) > 0 {
 		for key, val := range req.Environment {
@@ -367,28 +783,25 @@ func (h requestHandler) buildDeployableImageWithDockerRun(req BuildRequest, imag
 		}
 		config.Env = cmdEnv
 	}
-	if h.debug {
-		log.Printf("Creating container using config: %+v\n", config)
-	}
+	h.log.Debug("Creating container", "image", image, "config", fmt.Sprintf("%+v", config))
 
-	container, err := h.dockerClient.CreateContainer(docker.CreateContainerOptions{Name: "", Config: &config})
+	container, err := h.createContainer(config)
 	if err != nil {
 		return nil, err
 	}
 	defer h.removeContainer(container.ID)
 
 	binds := []string{
-		filepath.Join(contextDir, "src") + ":/usr/src",
+		filepath.Join(contextDir, "src") + ":" + caps.SourceDir,
 	}
 	if incremental {
-		binds = append(binds, filepath.Join(contextDir, "artifacts")+":/usr/artifacts")
+		binds = append(binds, filepath.Join(contextDir, "artifacts")+":"+caps.ArtifactsDir)
 	}
 
 	hostConfig := docker.HostConfig{Binds: binds}
-	if h.debug {
-		log.Printf("Starting container with config: %+v\n", hostConfig)
-	}
+	h.log.Debug("Starting container", "container", container.ID, "binds", strings.Join(binds, ","))
 
+	outputDone := h.streamContainerOutput(container.ID)
 	err = h.dockerClient.StartContainer(container.ID, &hostConfig)
 	if err != nil {
 		return nil, err
@@ -398,6 +811,7 @@ func (h requestHandler) buildDeployableImageWithDockerRun(req BuildRequest, imag
 	if err != nil {
 		return nil, err
 	}
+	outputDone()
 
 	if exitCode != 0 {
 		return nil, ErrBuildFailed
@@ -418,25 +832,38 @@ func (h requestHandler) buildDeployableImageWithDockerRun(req BuildRequest, imag
 	// }
 
 	// temporary hack to work around bug in go-dockerclient
-	err = h.commitContainerWithCli(container.ID, req.Tag, cmdEnv)
+	err = h.commitContainerWithCli(container.ID, req.Tag, caps, append(cmdEnv, labelsToEnv(metadata.labels())...), usage)
 	if err != nil {
 		return nil, err
 	}
 
-	return &BuildResult{true, nil}, nil
+	return &BuildResult{Success: true, Metadata: metadata}, nil
 }
 
-func (h requestHandler) commitContainerWithCli(id, tag string, env []string) error {
-	c := exec.Command("/usr/bin/docker", "commit", `-run={"Cmd": ["/usr/bin/run"]}`, id, tag)
+func (h requestHandler) commitContainerWithCli(id, tag string, caps *Capabilities, env []string, usage bool) error {
+	var entrypoint []string
+	if usage {
+		entrypoint = usageEntrypointFor(caps.ScriptsDir)
+	}
+
+	runConfig, err := json.Marshal(struct {
+		Entrypoint []string `json:",omitempty"`
+		Cmd        []string
+		Env        []string `json:",omitempty"`
+	}{entrypoint, []string{caps.script("run")}, env})
+	if err != nil {
+		return err
+	}
+
+	c := exec.Command("/usr/bin/docker", "commit", "-run="+string(runConfig), id, tag)
 	var out, stdErr bytes.Buffer
 	c.Stdout = &out
 	c.Stderr = &stdErr
 
-	err := c.Run()
-	if h.debug {
-		log.Printf("Commit output: %s\n", out.String())
-		log.Printf("Commit stderr: %s\n", stdErr.String())
-	}
+	span := h.trace.start("commit container", "sti.container_id", id, "sti.tag", tag)
+	err = c.Run()
+	span.end(err)
+	h.log.Debug("Committed container", "container", id, "tag", tag, "output", out.String(), "stderr", stdErr.String())
 	if err != nil {
 		return err
 	}
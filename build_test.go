@@ -0,0 +1,246 @@
+package sti
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "launchpad.net/gocheck"
+)
+
+type BuildSuite struct{}
+
+var _ = Suite(&BuildSuite{})
+
+func quietHandler() requestHandler {
+	return requestHandler{log: NewTextLogger(ioutil.Discard, LevelError), resources: &resourceTracker{}}
+}
+
+// Test building a working tree with its uncommitted changes and untracked files
+func (s *BuildSuite) TestCopyWorkingTree(c *C) {
+	source := makeGitRepository(c)
+	commit := runGit(c, source, "rev-parse", "HEAD")
+	writeFile(c, source, "index.html", "<html>changed</html>\n")
+	writeFile(c, source, "new.txt", "new\n")
+	writeFile(c, source, "debug.log", "ignored\n")
+	c.Assert(os.Remove(filepath.Join(source, "docs", "README")), IsNil)
+
+	target := filepath.Join(c.MkDir(), "src")
+	metadata := &BuildMetadata{}
+	req := BuildRequest{Source: source, WorkingTree: true, CopyMode: CopyModeCopy}
+	c.Assert(quietHandler().prepareSourceDir(req, target, metadata), IsNil)
+
+	c.Assert(readFile(c, target, "index.html"), Equals, "<html>changed</html>\n")
+	c.Assert(readFile(c, target, "app/app.rb"), Equals, "puts 'hello'\n")
+	c.Assert(exists(target, "new.txt"), Equals, true)
+	c.Assert(exists(target, "debug.log"), Equals, false)
+	c.Assert(exists(target, "docs/README"), Equals, false)
+	c.Assert(exists(target, ".git"), Equals, false)
+	c.Assert(metadata.Commit, Equals, commit)
+	c.Assert(metadata.Dirty, Equals, true)
+}
+
+// Test leaving the untracked files of a working tree out of a build
+func (s *BuildSuite) TestCopyWorkingTreeExcludeUntracked(c *C) {
+	source := makeGitRepository(c)
+	writeFile(c, source, "new.txt", "new\n")
+
+	target := filepath.Join(c.MkDir(), "src")
+	metadata := &BuildMetadata{}
+	req := BuildRequest{Source: source, WorkingTree: true, ExcludeUntracked: true, CopyMode: CopyModeCopy}
+	c.Assert(quietHandler().prepareSourceDir(req, target, metadata), IsNil)
+
+	c.Assert(exists(target, "index.html"), Equals, true)
+	c.Assert(exists(target, "new.txt"), Equals, false)
+	c.Assert(metadata.Dirty, Equals, false)
+}
+
+// Test that a working tree build of a directory outside git fails
+func (s *BuildSuite) TestCopyWorkingTreeNotGit(c *C) {
+	source := c.MkDir()
+	writeFile(c, source, "index.html", "<html></html>\n")
+
+	req := BuildRequest{Source: source, WorkingTree: true, CopyMode: CopyModeCopy}
+	err := quietHandler().prepareSourceDir(req, filepath.Join(c.MkDir(), "src"), &BuildMetadata{})
+	c.Assert(err, Equals, ErrNotGitWorkingTree)
+}
+
+// Test that context directories outside the source are refused before building
+func (s *BuildSuite) TestContextDirOutsideSource(c *C) {
+	for _, dir := range []string{"..", "../app", "app/../../app", "/app"} {
+		_, err := Build(BuildRequest{Source: c.MkDir(), Tag: "test/app", ContextDir: dir})
+		c.Assert(err, Equals, ErrInvalidContextDir, Commentf(dir))
+	}
+}
+
+// Test that refs git would take for options are refused before building
+func (s *BuildSuite) TestOptionRef(c *C) {
+	_, err := Build(BuildRequest{Source: "git://github.com/pmorie/simple-html", Tag: "test/app", Ref: "--upload-pack=touch pwned"})
+	c.Assert(err, Equals, ErrInvalidRef)
+}
+
+// Test that a context directory must be within the sparse paths of a clone
+func (s *BuildSuite) TestContextDirNotSparse(c *C) {
+	_, err := Build(BuildRequest{Source: "git://github.com/pmorie/simple-html", Tag: "test/app",
+		ContextDir: "app", SparsePaths: []string{"docs", "application"}})
+	c.Assert(err, Equals, ErrContextDirNotSparse)
+}
+
+// Test matching a context directory against sparse paths
+func (s *BuildSuite) TestWithinPaths(c *C) {
+	c.Assert(withinPaths("app", []string{"docs", "app"}), Equals, true)
+	c.Assert(withinPaths("app/lib", []string{"/app/"}), Equals, true)
+	c.Assert(withinPaths("app", []string{"app/lib"}), Equals, false)
+	c.Assert(withinPaths("application", []string{"app"}), Equals, false)
+	c.Assert(withinPaths("app", []string{"."}), Equals, true)
+}
+
+// Test copying only the context directory of a local source
+func (s *BuildSuite) TestCopyContextDir(c *C) {
+	source := makeGitRepository(c)
+	commit := runGit(c, source, "rev-parse", "HEAD")
+
+	target := filepath.Join(c.MkDir(), "src")
+	metadata := &BuildMetadata{}
+	req := BuildRequest{Source: source, ContextDir: "app", CopyMode: CopyModeCopy}
+	c.Assert(quietHandler().prepareSourceDir(req, target, metadata), IsNil)
+
+	c.Assert(readFile(c, target, "app.rb"), Equals, "puts 'hello'\n")
+	c.Assert(exists(target, "index.html"), Equals, false)
+	c.Assert(metadata.Commit, Equals, commit)
+}
+
+// Test copying only the context directory of a working tree
+func (s *BuildSuite) TestCopyWorkingTreeContextDir(c *C) {
+	source := makeGitRepository(c)
+	writeFile(c, source, "app/new.rb", "new\n")
+
+	target := filepath.Join(c.MkDir(), "src")
+	metadata := &BuildMetadata{}
+	req := BuildRequest{Source: source, ContextDir: "app", WorkingTree: true, CopyMode: CopyModeCopy}
+	c.Assert(quietHandler().prepareSourceDir(req, target, metadata), IsNil)
+
+	c.Assert(exists(target, "app.rb"), Equals, true)
+	c.Assert(exists(target, "new.rb"), Equals, true)
+	c.Assert(exists(target, "index.html"), Equals, false)
+	c.Assert(metadata.Dirty, Equals, true)
+}
+
+// Test that a context directory missing from a local source fails the build
+func (s *BuildSuite) TestCopyContextDirMissing(c *C) {
+	source := makeGitRepository(c)
+
+	for _, workingTree := range []bool{false, true} {
+		req := BuildRequest{Source: source, ContextDir: "missing", WorkingTree: workingTree, CopyMode: CopyModeCopy}
+		err := quietHandler().prepareSourceDir(req, filepath.Join(c.MkDir(), "src"), &BuildMetadata{})
+		c.Assert(err, Equals, ErrContextDirNotFound)
+	}
+
+	req := BuildRequest{Source: source, ContextDir: "index.html", CopyMode: CopyModeCopy}
+	err := quietHandler().prepareSourceDir(req, filepath.Join(c.MkDir(), "src"), &BuildMetadata{})
+	c.Assert(err, Equals, ErrContextDirNotFound)
+}
+
+// Test cloning only the context directory of a git source
+func (s *BuildSuite) TestCloneContextDir(c *C) {
+	source := makeGitRepository(c)
+
+	target := filepath.Join(c.MkDir(), "src")
+	req := BuildRequest{Source: "file://" + source, ContextDir: "app"}
+	c.Assert(quietHandler().cloneSource(req, target, &BuildMetadata{}), IsNil)
+
+	c.Assert(readFile(c, target, "app.rb"), Equals, "puts 'hello'\n")
+	c.Assert(exists(target, "index.html"), Equals, false)
+	c.Assert(exists(target+".git", ""), Equals, false)
+}
+
+// Test cloning a context directory within the sparse paths of a clone
+func (s *BuildSuite) TestCloneContextDirSparse(c *C) {
+	source := makeGitRepository(c)
+
+	target := filepath.Join(c.MkDir(), "src")
+	req := BuildRequest{Source: "file://" + source, ContextDir: "app", SparsePaths: []string{"app", "docs"}}
+	c.Assert(quietHandler().cloneSource(req, target, &BuildMetadata{}), IsNil)
+
+	c.Assert(exists(target, "app.rb"), Equals, true)
+}
+
+// Test that a context directory missing from a git source fails the build
+func (s *BuildSuite) TestCloneContextDirMissing(c *C) {
+	source := makeGitRepository(c)
+
+	target := filepath.Join(c.MkDir(), "src")
+	req := BuildRequest{Source: "file://" + source, ContextDir: "missing"}
+	c.Assert(quietHandler().cloneSource(req, target, &BuildMetadata{}), Equals, ErrContextDirNotFound)
+	c.Assert(exists(target+".git", ""), Equals, false)
+}
+
+func uniqueTag(c *C) string {
+	id, err := newID()
+	c.Assert(err, IsNil)
+	return "test/sti-lock-" + id
+}
+
+// Test that a build of a locked tag fails with the fail policy
+func (s *BuildSuite) TestTagLockFail(c *C) {
+	h := quietHandler()
+	tag := uniqueTag(c)
+
+	lock, err := h.lockTag(tag, false)
+	c.Assert(err, IsNil)
+
+	_, err = h.lockTag(tag, false)
+	c.Assert(err, Equals, ErrTagLocked)
+	_, err = Build(BuildRequest{Source: c.MkDir(), Tag: tag, TagLockPolicy: TagLockFail,
+		Request: Request{Logger: NewTextLogger(ioutil.Discard, LevelError)}})
+	c.Assert(err, Equals, ErrTagLocked)
+
+	// other tags are not locked
+	other, err := h.lockTag(tag+"-build", false)
+	c.Assert(err, IsNil)
+	other.Close()
+
+	lock.Close()
+	lock, err = h.lockTag(tag, false)
+	c.Assert(err, IsNil)
+	lock.Close()
+}
+
+// Test that a build of a locked tag waits for the lock with the wait policy
+func (s *BuildSuite) TestTagLockWait(c *C) {
+	h := quietHandler()
+	tag := uniqueTag(c)
+
+	lock, err := h.lockTag(tag, false)
+	c.Assert(err, IsNil)
+
+	acquired := make(chan error, 1)
+	go func() {
+		waited, err := h.lockTag(tag, true)
+		if err == nil {
+			waited.Close()
+		}
+		acquired <- err
+	}()
+
+	select {
+	case <-acquired:
+		c.Fatal("lock acquired while held")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	lock.Close()
+	select {
+	case err := <-acquired:
+		c.Assert(err, IsNil)
+	case <-time.After(5 * time.Second):
+		c.Fatal("lock not acquired once released")
+	}
+}
+
+// Test that an unknown tag lock policy is refused
+func (s *BuildSuite) TestInvalidTagLockPolicy(c *C) {
+	_, err := Build(BuildRequest{Source: c.MkDir(), Tag: "test/app", TagLockPolicy: "steal"})
+	c.Assert(err, Equals, ErrInvalidTagLockPolicy)
+}
@@ -0,0 +1,221 @@
+package sti
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// Labels by which a build or runtime image declares its capabilities.  Like the
+// labels of build metadata, they are environment variables in the configuration of
+// the image, such as set with ENV in its Dockerfile.  Capabilities an image does not
+// declare take their default values, and whether it supports incremental builds is
+// decided by probing for its save-artifacts script.
+const (
+	// Version of the contract between sti and the image that the image implements
+	LabelProtocolVersion = "STI_PROTOCOL_VERSION"
+	// Directory of the prepare, run, save-artifacts and usage scripts
+	LabelScriptsDir = "STI_SCRIPTS_DIR"
+	// Directory the source is placed in for the prepare script
+	LabelSourceDir = "STI_SOURCE_DIR"
+	// Directory the artifacts of the previous build are placed in for the prepare
+	// script, and that the save-artifacts script saves them to
+	LabelArtifactsDir = "STI_ARTIFACTS_DIR"
+	// Directory the prepare script of the build image of an extended build places the
+	// built application in, for the runtime image
+	LabelOutputDir = "STI_OUTPUT_DIR"
+	// Whether the image supports incremental builds: true or false
+	LabelIncremental = "STI_INCREMENTAL"
+	// Build methods the image supports, comma separated: build, run or both
+	LabelBuildMethods = "STI_BUILD_METHODS"
+	// Environment variables a build with the image must be given, comma separated
+	LabelRequiredEnv = "STI_REQUIRED_ENV"
+)
+
+// Version of the contract between sti and the images it builds with that sti
+// implements.
+const ProtocolVersion = 1
+
+// Default capabilities of images.
+const (
+	defaultScriptsDir   = "/usr/bin"
+	defaultSourceDir    = "/usr/src"
+	defaultArtifactsDir = "/usr/artifacts"
+	defaultOutputDir    = "/usr/build"
+)
+
+var defaultBuildMethods = []string{"build", "run"}
+
+// Directories must be absolute paths that can be written in a Dockerfile or shell
+// command without quoting.
+var capabilityDirPattern = regexp.MustCompile(`^/[A-Za-z0-9/._-]*$`)
+
+var envNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Capabilities describes how sti builds with an image, as declared by its labels.
+type Capabilities struct {
+	ProtocolVersion int
+	ScriptsDir      string
+	SourceDir       string
+	ArtifactsDir    string
+	OutputDir       string
+	Incremental     bool
+	BuildMethods    []string
+	RequiredEnv     []string
+
+	// labels the image declares, by name
+	declared map[string]bool
+}
+
+// Returns the capabilities of an image that declares none.
+func defaultCapabilities() *Capabilities {
+	return &Capabilities{
+		ProtocolVersion: ProtocolVersion,
+		ScriptsDir:      defaultScriptsDir,
+		SourceDir:       defaultSourceDir,
+		ArtifactsDir:    defaultArtifactsDir,
+		OutputDir:       defaultOutputDir,
+		BuildMethods:    defaultBuildMethods,
+		declared:        make(map[string]bool),
+	}
+}
+
+// Returns the capabilities declared by a set of labels, and the problems with the
+// declarations, if any.  Invalid declarations are ignored in favor of default values.
+func capabilitiesFromLabels(labels map[string]string) (*Capabilities, []string) {
+	caps := defaultCapabilities()
+	var problems []string
+	invalid := func(label, value, why string) {
+		problems = append(problems, fmt.Sprintf("%s=%q %s", label, value, why))
+	}
+
+	if value, ok := labels[LabelProtocolVersion]; ok {
+		version, err := strconv.Atoi(value)
+		switch {
+		case err != nil || version < 1:
+			invalid(LabelProtocolVersion, value, "is not a version number")
+		case version > ProtocolVersion:
+			invalid(LabelProtocolVersion, value, fmt.Sprintf("is newer than the version sti implements, %d", ProtocolVersion))
+		default:
+			caps.ProtocolVersion = version
+			caps.declared[LabelProtocolVersion] = true
+		}
+	}
+
+	for label, dir := range map[string]*string{
+		LabelScriptsDir:   &caps.ScriptsDir,
+		LabelSourceDir:    &caps.SourceDir,
+		LabelArtifactsDir: &caps.ArtifactsDir,
+		LabelOutputDir:    &caps.OutputDir,
+	} {
+		value, ok := labels[label]
+		if !ok {
+			continue
+		}
+		if !capabilityDirPattern.MatchString(value) {
+			invalid(label, value, "is not an absolute path of letters, digits and /._-")
+			continue
+		}
+		*dir = path.Clean(value)
+		caps.declared[label] = true
+	}
+
+	if value, ok := labels[LabelIncremental]; ok {
+		incremental, err := strconv.ParseBool(value)
+		if err != nil {
+			invalid(LabelIncremental, value, "is not true or false")
+		} else {
+			caps.Incremental = incremental
+			caps.declared[LabelIncremental] = true
+		}
+	}
+
+	if value, ok := labels[LabelBuildMethods]; ok {
+		methods := splitList(value)
+		valid := len(methods) > 0
+		for _, method := range methods {
+			if !stringInSlice(method, defaultBuildMethods) {
+				valid = false
+			}
+		}
+		if !valid {
+			invalid(LabelBuildMethods, value, "is not a list of build methods: build, run")
+		} else {
+			caps.BuildMethods = methods
+			caps.declared[LabelBuildMethods] = true
+		}
+	}
+
+	if value, ok := labels[LabelRequiredEnv]; ok {
+		names := splitList(value)
+		valid := true
+		for _, name := range names {
+			if !envNamePattern.MatchString(name) {
+				valid = false
+			}
+		}
+		if !valid {
+			invalid(LabelRequiredEnv, value, "is not a list of environment variable names")
+		} else {
+			caps.RequiredEnv = names
+			caps.declared[LabelRequiredEnv] = true
+		}
+	}
+
+	return caps, problems
+}
+
+// Splits a comma separated list, ignoring spaces and empty elements.
+func splitList(value string) []string {
+	var list []string
+	for _, element := range strings.Split(value, ",") {
+		if element = strings.TrimSpace(element); element != "" {
+			list = append(list, element)
+		}
+	}
+
+	return list
+}
+
+// Determines whether the image declares a capability.
+func (c *Capabilities) declares(label string) bool {
+	return c.declared[label]
+}
+
+// Returns the path of a script of the image, such as prepare.
+func (c *Capabilities) script(name string) string {
+	return path.Join(c.ScriptsDir, name)
+}
+
+// Determines whether the image supports a build method.
+func (c *Capabilities) supportsMethod(method string) bool {
+	return stringInSlice(method, c.BuildMethods)
+}
+
+// Returns the required environment variables missing from an environment.
+func (c *Capabilities) missingEnv(env map[string]string) []string {
+	var missing []string
+	for _, name := range c.RequiredEnv {
+		if _, ok := env[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+
+	return missing
+}
+
+// Returns the capabilities of an image, failing with ErrInvalidCapabilities if it
+// declares invalid ones.
+func (h requestHandler) imageCapabilities(image *docker.Image) (*Capabilities, error) {
+	caps, problems := capabilitiesFromLabels(imageLabels(image))
+	if len(problems) > 0 {
+		h.log.Error("Image declares invalid capabilities", "image", image.ID, "problems", strings.Join(problems, "; "))
+		return nil, ErrInvalidCapabilities
+	}
+
+	return caps, nil
+}
@@ -0,0 +1,102 @@
+package sti
+
+import (
+	"bytes"
+	"strings"
+
+	. "launchpad.net/gocheck"
+)
+
+type CapabilitiesSuite struct{}
+
+var _ = Suite(&CapabilitiesSuite{})
+
+// Test the capabilities of an image that declares none
+func (s *CapabilitiesSuite) TestDefaults(c *C) {
+	caps, problems := capabilitiesFromLabels(map[string]string{"PATH": "/bin"})
+	c.Assert(problems, IsNil)
+	c.Assert(caps.ProtocolVersion, Equals, ProtocolVersion)
+	c.Assert(caps.script("prepare"), Equals, "/usr/bin/prepare")
+	c.Assert(caps.SourceDir, Equals, "/usr/src")
+	c.Assert(caps.ArtifactsDir, Equals, "/usr/artifacts")
+	c.Assert(caps.OutputDir, Equals, "/usr/build")
+	c.Assert(caps.BuildMethods, DeepEquals, []string{"build", "run"})
+	c.Assert(caps.RequiredEnv, IsNil)
+	c.Assert(caps.declares(LabelIncremental), Equals, false)
+}
+
+// Test the capabilities declared by the labels of an image
+func (s *CapabilitiesSuite) TestDeclared(c *C) {
+	caps, problems := capabilitiesFromLabels(map[string]string{
+		LabelProtocolVersion: "1",
+		LabelScriptsDir:      "/opt/sti/bin/",
+		LabelSourceDir:       "/opt/app-root/src",
+		LabelArtifactsDir:    "/tmp/artifacts",
+		LabelOutputDir:       "/opt/app-root/build",
+		LabelIncremental:     "false",
+		LabelBuildMethods:    "run",
+		LabelRequiredEnv:     "DATABASE_URL, SECRET_KEY",
+	})
+	c.Assert(problems, IsNil)
+	c.Assert(caps.script("run"), Equals, "/opt/sti/bin/run")
+	c.Assert(caps.SourceDir, Equals, "/opt/app-root/src")
+	c.Assert(caps.ArtifactsDir, Equals, "/tmp/artifacts")
+	c.Assert(caps.OutputDir, Equals, "/opt/app-root/build")
+	c.Assert(caps.Incremental, Equals, false)
+	c.Assert(caps.declares(LabelIncremental), Equals, true)
+	c.Assert(caps.supportsMethod("run"), Equals, true)
+	c.Assert(caps.supportsMethod("build"), Equals, false)
+	c.Assert(caps.missingEnv(map[string]string{"SECRET_KEY": "s"}), DeepEquals, []string{"DATABASE_URL"})
+	c.Assert(caps.missingEnv(map[string]string{"SECRET_KEY": "s", "DATABASE_URL": ""}), IsNil)
+}
+
+// Test invalid declarations being reported and ignored
+func (s *CapabilitiesSuite) TestInvalid(c *C) {
+	caps, problems := capabilitiesFromLabels(map[string]string{
+		LabelProtocolVersion: "2",
+		LabelScriptsDir:      "opt/bin",
+		LabelSourceDir:       "/opt/my src",
+		LabelIncremental:     "sometimes",
+		LabelBuildMethods:    "build,podman",
+		LabelRequiredEnv:     "DATABASE-URL",
+	})
+	c.Assert(problems, HasLen, 6)
+	c.Assert(strings.Join(problems, "\n"), Matches, `(?s).*STI_PROTOCOL_VERSION="2" is newer than the version sti implements, 1.*`)
+	c.Assert(caps.script("prepare"), Equals, "/usr/bin/prepare")
+	c.Assert(caps.SourceDir, Equals, "/usr/src")
+	c.Assert(caps.BuildMethods, DeepEquals, []string{"build", "run"})
+	c.Assert(caps.declares(LabelIncremental), Equals, false)
+	c.Assert(caps.RequiredEnv, IsNil)
+}
+
+// Test the Dockerfile of a build using the directories an image declares
+func (s *CapabilitiesSuite) TestDockerfile(c *C) {
+	caps, _ := capabilitiesFromLabels(map[string]string{
+		LabelScriptsDir:   "/opt/sti/bin",
+		LabelSourceDir:    "/opt/app-root/src",
+		LabelArtifactsDir: "/tmp/artifacts",
+	})
+
+	var buf bytes.Buffer
+	err := dockerFileTemplate.Execute(&buf, dockerFileData{
+		BaseImage:    "builder",
+		Incremental:  true,
+		SourceDir:    caps.SourceDir,
+		ArtifactsDir: caps.ArtifactsDir,
+		Prepare:      caps.script("prepare"),
+		Run:          caps.script("run"),
+		Entrypoint:   usageEntrypointJSON(caps.ScriptsDir),
+	})
+	c.Assert(err, IsNil)
+
+	dockerfile := buf.String()
+	for _, line := range []string{
+		"ADD ./src /opt/app-root/src/\n",
+		"ADD ./artifacts /tmp/artifacts\n",
+		"RUN /opt/sti/bin/prepare\n",
+		"CMD /opt/sti/bin/run\n",
+	} {
+		c.Assert(strings.Contains(dockerfile, line), Equals, true, Commentf("missing %q in %s", line, dockerfile))
+	}
+	c.Assert(strings.Contains(dockerfile, "[ -x /opt/sti/bin/usage ]"), Equals, true)
+}
@@ -0,0 +1,275 @@
+package sti
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// Prefix of the names of containers and working directories created by sti, by which
+// leftovers from crashed runs are found.
+const (
+	containerNamePrefix = "sti-"
+	workspacePrefix     = "sti-build-"
+)
+
+// Prefix of the names of the locks held by sti runs that have containers.
+const runLockPrefix = "run-"
+
+// resourceTracker records the containers and files created while serving a request,
+// so that they can be released when the request completes, fails or is cancelled.
+type resourceTracker struct {
+	mu         sync.Mutex
+	containers []string
+	paths      []string
+	cancelled  bool
+
+	// identifies the request in the names of its containers; the request holds the
+	// lock named after it while it has containers, so that GC leaves them alone
+	runID   string
+	runLock *os.File
+}
+
+func (t *resourceTracker) addContainer(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.containers = append(t.containers, id)
+}
+
+func (t *resourceTracker) forgetContainer(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, c := range t.containers {
+		if c == id {
+			t.containers = append(t.containers[:i], t.containers[i+1:]...)
+			return
+		}
+	}
+}
+
+func (t *resourceTracker) addPath(path string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.paths = append(t.paths, path)
+}
+
+// Removes and forgets every tracked resource, returning the containers and paths.
+func (t *resourceTracker) take() ([]string, []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	containers, paths := t.containers, t.paths
+	t.containers, t.paths = nil, nil
+	return containers, paths
+}
+
+// Returns a unique name for a container created by the request, naming the request's
+// run.  The lock of the run is taken with the first name, and held until
+// releaseRunLock.
+func (t *resourceTracker) newContainerName() (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.runLock == nil {
+		runID, err := newID()
+		if err != nil {
+			return "", err
+		}
+		path, err := lockPath(runLockPrefix + runID)
+		if err != nil {
+			return "", err
+		}
+		t.runLock, err = lockFile(path, false)
+		if err != nil {
+			return "", err
+		}
+		t.runID = runID
+	}
+
+	id, err := newID()
+	if err != nil {
+		return "", err
+	}
+
+	return containerNamePrefix + t.runID + "-" + id, nil
+}
+
+// Releases the lock of the request's run, once its containers are removed.
+func (t *resourceTracker) releaseRunLock() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.runLock != nil {
+		os.Remove(t.runLock.Name())
+		t.runLock.Close()
+		t.runLock = nil
+	}
+}
+
+func (t *resourceTracker) cancel() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.cancelled = true
+}
+
+func (t *resourceTracker) isCancelled() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.cancelled
+}
+
+// Returns a random identifier of 16 hex digits.
+func newID() (string, error) {
+	id := make([]byte, 8)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(id), nil
+}
+
+// Returns the directory of the locks of sti runs and tags on this host.
+func lockDir() string {
+	return filepath.Join(os.TempDir(), "sti-locks")
+}
+
+// Returns the path of the lock file with the given name, in the directory of the locks
+// of sti runs on this host.
+func lockPath(name string) (string, error) {
+	dir := lockDir()
+	err := os.MkdirAll(dir, 0777)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, name+".lock"), nil
+}
+
+// Determines whether a container created by sti belongs to a run in progress on this
+// host: whether the lock of the run named by the container is held.  Containers
+// named without a run, by earlier versions of sti, are never in use.
+func containerInUse(container docker.APIContainers) bool {
+	for _, name := range container.Names {
+		atoms := strings.Split(strings.TrimPrefix(name, "/"+containerNamePrefix), "-")
+		if len(atoms) != 2 {
+			continue
+		}
+
+		path, err := lockPath(runLockPrefix + atoms[0])
+		if err != nil {
+			return true
+		}
+		if _, err = os.Stat(path); err != nil {
+			continue
+		}
+
+		lock, err := lockFile(path, false)
+		if err == ErrLockHeld {
+			return true
+		}
+		if err == nil {
+			lock.Close()
+		}
+	}
+
+	return false
+}
+
+// Creates a container with the given configuration, named so that it can be found
+// by GC, and tracks it for removal when the request is released.
+func (h requestHandler) createContainer(config docker.Config) (*docker.Container, error) {
+	name, err := h.resources.newContainerName()
+	if err != nil {
+		return nil, err
+	}
+
+	span := h.trace.start("create container", "sti.image", config.Image, "sti.container_name", name)
+	container, err := h.dockerClient.CreateContainer(docker.CreateContainerOptions{Name: name, Config: &config})
+	if err == nil {
+		span.set("sti.container_id", container.ID)
+	}
+	span.end(err)
+	if err != nil {
+		return nil, err
+	}
+	h.resources.addContainer(container.ID)
+	h.emit(BuildEvent{Kind: EventContainerCreated, Image: config.Image, ContainerID: container.ID})
+
+	h.log.Debug("Created container", "name", name, "container", container.ID, "image", config.Image)
+
+	return container, nil
+}
+
+// Releases every resource tracked for the request: running containers are stopped,
+// containers removed along with their volumes, and files and directories removed.
+func (h requestHandler) release() {
+	containers, paths := h.resources.take()
+
+	for _, id := range containers {
+		h.dockerClient.StopContainer(id, 0)
+		h.removeContainer(id)
+	}
+	h.resources.releaseRunLock()
+
+	for _, path := range paths {
+		h.log.Debug("Removing working files", "path", path)
+		os.RemoveAll(path)
+	}
+}
+
+// Cancels the request, releasing its resources so that any step waiting on them
+// fails promptly.
+func (h requestHandler) cancel() {
+	h.log.Debug("Cancelling request")
+
+	h.resources.cancel()
+	h.release()
+}
+
+// Cancels the request when cancel is closed, until done is closed.
+func (h requestHandler) watchCancel(cancel <-chan struct{}, done <-chan struct{}) {
+	select {
+	case <-cancel:
+		h.cancel()
+	case <-done:
+	}
+}
+
+// Creates a uniquely named working directory for a build within parent, or within the
+// system temporary directory if parent is empty, and tracks it for removal.  The
+// returned lock file marks the directory as in use until it is closed; GC removes
+// working directories whose lock is not held.  The lock is taken before the directory
+// is created, so that GC never finds the directory unlocked.
+func (h requestHandler) newWorkspace(parent string) (string, *os.File, error) {
+	if parent == "" {
+		parent = os.TempDir()
+	}
+
+	id, err := newID()
+	if err != nil {
+		return "", nil, err
+	}
+	workspace := filepath.Join(parent, workspacePrefix+id)
+
+	lock, err := lockFile(workspace+".lock", false)
+	if err != nil {
+		return "", nil, err
+	}
+	h.resources.addPath(lock.Name())
+
+	err = os.Mkdir(workspace, 0700)
+	if err != nil {
+		lock.Close()
+		return "", nil, err
+	}
+	h.resources.addPath(workspace)
+
+	h.log.Debug("Using working directory", "path", workspace)
+
+	return workspace, lock, nil
+}
@@ -0,0 +1,161 @@
+// Package client is a client for the HTTP build service started by `sti serve`.
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/pmorie/go-sti"
+)
+
+// Client submits requests to an sti server.
+type Client struct {
+	// Base URL of the server, e.g. http://localhost:8080
+	URL        string
+	HTTPClient *http.Client
+	// Token of the server, if it requires one
+	Token string
+}
+
+// New returns a Client for the server at url.
+func New(url string) *Client {
+	return &Client{URL: strings.TrimSuffix(url, "/"), HTTPClient: http.DefaultClient}
+}
+
+// Build submits a build to the server and returns its ID.  The Request settings of
+// the server, such as its docker socket, override those of req.
+func (c *Client) Build(req sti.BuildRequest) (string, error) {
+	var submission sti.BuildSubmission
+	err := c.do("POST", "/builds", req, http.StatusAccepted, &submission)
+	if err != nil {
+		return "", err
+	}
+
+	return submission.ID, nil
+}
+
+// Status returns the status of the build with the given ID.
+func (c *Client) Status(id string) (*sti.BuildStatus, error) {
+	var status sti.BuildStatus
+	err := c.do("GET", "/builds/"+id, nil, http.StatusOK, &status)
+	if err != nil {
+		return nil, err
+	}
+
+	return &status, nil
+}
+
+// Cancel cancels the build with the given ID.
+func (c *Client) Cancel(id string) error {
+	return c.do("DELETE", "/builds/"+id, nil, http.StatusOK, nil)
+}
+
+// Logs copies the output of the build with the given ID to w as it is produced,
+// returning when the build finishes.
+func (c *Client) Logs(id string, w io.Writer) error {
+	req, err := c.newRequest("GET", "/builds/"+id+"/logs", nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// Wait streams the output of the build with the given ID to w until the build
+// finishes, and returns its final status.
+func (c *Client) Wait(id string, w io.Writer) (*sti.BuildStatus, error) {
+	err := c.Logs(id, w)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.Status(id)
+}
+
+// Validate validates images on the server.
+func (c *Client) Validate(req sti.ValidateRequest) (*sti.ValidateResult, error) {
+	var result sti.ValidateResult
+	err := c.do("POST", "/validate", req, http.StatusOK, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// Sends a request with body encoded as JSON, if not nil, and decodes the response
+// into out, if not nil.  Responses with a status other than expected are errors.
+func (c *Client) do(method string, path string, body interface{}, expected int, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := c.newRequest(method, path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expected {
+		return responseError(resp)
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Returns a request to the server, carrying its token if it has one.
+func (c *Client) newRequest(method string, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, c.URL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	return req, nil
+}
+
+// Returns the error reported by an unsuccessful response.
+func responseError(resp *http.Response) error {
+	var serverError sti.ServerError
+	err := json.NewDecoder(resp.Body).Decode(&serverError)
+	if err != nil || serverError.Error == "" {
+		return fmt.Errorf("server responded %s", resp.Status)
+	}
+
+	return errors.New(serverError.Error)
+}
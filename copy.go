@@ -0,0 +1,313 @@
+package sti
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Methods of copying a local source into the working directory.
+const (
+	// Copy the contents of every file.
+	CopyModeCopy = "copy"
+	// Hard link files into the working directory, copying only where linking fails.
+	// Scripts that modify sources in place will modify the original files.
+	CopyModeLink = "link"
+	// Clone files with copy-on-write reflinks where the filesystem supports them,
+	// copying otherwise.
+	CopyModeReflink = "reflink"
+)
+
+// Name of the file in the root of a local source listing paths to leave out of builds.
+const ignoreFileName = ".stiignore"
+
+// Hard links files for CopyModeLink; replaced by tests.
+var linkFile = os.Link
+
+// sourceCopier copies a local source tree into a working directory.
+type sourceCopier struct {
+	mode   string
+	ignore []string
+
+	// called after each file is copied with running totals of files and bytes
+	progress func(files int, bytes int64)
+
+	files int
+	bytes int64
+}
+
+// Reads the ignore patterns of the source tree rooted at dir.  Each non-empty line of
+// the ignore file that does not start with '#' is a pattern in the syntax of
+// filepath.Match.  Patterns containing a slash are matched against paths relative to
+// the root; others are matched against the base name of every path.  A pattern ending
+// in a slash matches only directories.
+func readIgnorePatterns(dir string) ([]string, error) {
+	file, err := os.Open(filepath.Join(dir, ignoreFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var patterns []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if _, err := filepath.Match(strings.TrimSuffix(line, "/"), ""); err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, line)
+	}
+
+	return patterns, scanner.Err()
+}
+
+// Determines whether the path rel, relative to the root of the source, is ignored.
+func (c *sourceCopier) ignored(rel string, isDir bool) bool {
+	rel = filepath.ToSlash(rel)
+
+	for _, pattern := range c.ignore {
+		if strings.HasSuffix(pattern, "/") {
+			if !isDir {
+				continue
+			}
+			pattern = strings.TrimSuffix(pattern, "/")
+		}
+
+		name := rel
+		if !strings.Contains(pattern, "/") {
+			name = filepath.Base(rel)
+		}
+
+		if matched, _ := filepath.Match(strings.TrimPrefix(pattern, "/"), name); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Copies the tree rooted at source to target, which must not exist.  Modes,
+// modification times and symlinks are preserved; sockets, devices and named pipes
+// are skipped.
+func (c *sourceCopier) copyTree(source string, target string) error {
+	type dirMode struct {
+		path    string
+		mode    os.FileMode
+		modTime time.Time
+	}
+	var dirs []dirMode
+
+	err := filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(source, path)
+		if err != nil {
+			return err
+		}
+
+		if rel != "." && c.ignored(rel, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		dest := filepath.Join(target, rel)
+		if info.IsDir() {
+			// Directories are created writable so that their contents can be
+			// copied, and given their own modes once the walk completes.
+			dirs = append(dirs, dirMode{dest, info.Mode().Perm(), info.ModTime()})
+			return os.Mkdir(dest, 0700)
+		}
+
+		return c.copyEntry(path, dest, info)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	// Restore modes deepest first, so that read-only directories are made read-only
+	// only after their contents are in place.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		err = os.Chmod(dirs[i].path, dirs[i].mode)
+		if err != nil {
+			return err
+		}
+
+		err = os.Chtimes(dirs[i].path, dirs[i].modTime, dirs[i].modTime)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Copies the file or symlink at source to target.  Other kinds of files are skipped.
+func (c *sourceCopier) copyEntry(source string, target string, info os.FileInfo) error {
+	mode := info.Mode()
+
+	switch {
+	case mode&os.ModeSymlink != 0:
+		link, err := os.Readlink(source)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(link, target)
+	case mode.IsRegular():
+		err := c.copyFile(source, target, info)
+		if err != nil {
+			return err
+		}
+
+		c.files++
+		c.bytes += info.Size()
+		if c.progress != nil {
+			c.progress(c.files, c.bytes)
+		}
+	}
+
+	return nil
+}
+
+// Copies the regular file at source to target according to the copier's mode.  In
+// CopyModeLink, files that cannot be linked, such as those on another filesystem or
+// that the kernel refuses to let the user link, are copied.
+func (c *sourceCopier) copyFile(source string, target string, info os.FileInfo) error {
+	if c.mode == CopyModeLink && linkFile(source, target) == nil {
+		return nil
+	}
+
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	cloned := c.mode == CopyModeReflink && reflink(out, in) == nil
+	if !cloned {
+		_, err = io.Copy(out, in)
+		if err != nil {
+			out.Close()
+			return err
+		}
+	}
+
+	err = out.Close()
+	if err != nil {
+		return err
+	}
+
+	// The mode given to OpenFile is subject to the umask.
+	err = os.Chmod(target, info.Mode())
+	if err != nil {
+		return err
+	}
+
+	return os.Chtimes(target, info.ModTime(), info.ModTime())
+}
+
+// Copies a local source to targetPath.  A source directory is copied to targetPath,
+// honoring its ignore file; any other source file is copied into a new directory at
+// targetPath.
+func (c *sourceCopier) copySource(sourcePath string, targetPath string) error {
+	info, err := os.Stat(sourcePath)
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		err = os.Mkdir(targetPath, 0700)
+		if err != nil {
+			return err
+		}
+
+		return c.copyFile(sourcePath, filepath.Join(targetPath, filepath.Base(sourcePath)), info)
+	}
+
+	c.ignore, err = readIgnorePatterns(sourcePath)
+	if err != nil {
+		return err
+	}
+
+	return c.copyTree(sourcePath, targetPath)
+}
+
+// Copies the listed files, given relative to source, from source to target, honoring
+// the ignore file of source.  Missing files are skipped, and listed directories are
+// copied whole.  Parent directories are created as needed.
+func (c *sourceCopier) copyFiles(source string, target string, files []string) error {
+	var err error
+	c.ignore, err = readIgnorePatterns(source)
+	if err != nil {
+		return err
+	}
+
+	err = os.Mkdir(target, 0700)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		path := filepath.Join(source, file)
+		info, err := os.Lstat(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if c.ignoredPath(file, info.IsDir()) {
+			continue
+		}
+
+		dest := filepath.Join(target, file)
+		err = os.MkdirAll(filepath.Dir(dest), 0755)
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			err = c.copyTree(path, dest)
+		} else {
+			err = c.copyEntry(path, dest, info)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Determines whether rel, or any directory containing it, is ignored.
+func (c *sourceCopier) ignoredPath(rel string, isDir bool) bool {
+	if c.ignored(rel, isDir) {
+		return true
+	}
+
+	for dir := filepath.Dir(rel); dir != "."; dir = filepath.Dir(dir) {
+		if c.ignored(dir, true) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,91 @@
+package sti
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	. "launchpad.net/gocheck"
+)
+
+type CopySuite struct{}
+
+var _ = Suite(&CopySuite{})
+
+// Test that modes and symlinks are preserved and ignored paths are left out
+func (s *CopySuite) TestCopySource(c *C) {
+	source := c.MkDir()
+	makeSourceTree(c, source)
+	c.Assert(os.MkdirAll(filepath.Join(source, "tmp", "cache"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(source, "debug.log"), []byte("log"), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(source, ignoreFileName), []byte("# build output\ntmp/\n*.log\n"), 0644), IsNil)
+
+	target := filepath.Join(c.MkDir(), "src")
+	copier := &sourceCopier{mode: CopyModeCopy}
+	c.Assert(copier.copySource(source, target), IsNil)
+
+	info, err := os.Stat(filepath.Join(target, "lib", "app.rb"))
+	c.Assert(err, IsNil)
+	c.Assert(info.Mode().Perm(), Equals, os.FileMode(0755))
+
+	link, err := os.Readlink(filepath.Join(target, "app"))
+	c.Assert(err, IsNil)
+	c.Assert(link, Equals, "lib/app.rb")
+
+	_, err = os.Stat(filepath.Join(target, "lib", "empty"))
+	c.Assert(err, IsNil)
+	_, err = os.Stat(filepath.Join(target, "tmp"))
+	c.Assert(os.IsNotExist(err), Equals, true)
+	_, err = os.Stat(filepath.Join(target, "debug.log"))
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	c.Assert(copier.files, Equals, 3)
+}
+
+// Test that hard link mode links files rather than copying them
+func (s *CopySuite) TestCopySourceWithLinks(c *C) {
+	source := c.MkDir()
+	makeSourceTree(c, source)
+
+	target := filepath.Join(c.MkDir(), "src")
+	copier := &sourceCopier{mode: CopyModeLink}
+	c.Assert(copier.copySource(source, target), IsNil)
+
+	original, err := os.Stat(filepath.Join(source, "index.html"))
+	c.Assert(err, IsNil)
+	copied, err := os.Stat(filepath.Join(target, "index.html"))
+	c.Assert(err, IsNil)
+	c.Assert(os.SameFile(original, copied), Equals, true)
+}
+
+// Test that hard link mode copies files that cannot be linked
+func (s *CopySuite) TestCopySourceWithFailingLinks(c *C) {
+	defer func() { linkFile = os.Link }()
+	for _, errno := range []syscall.Errno{syscall.EXDEV, syscall.EPERM, syscall.EMLINK} {
+		linkFile = func(oldname, newname string) error {
+			return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: errno}
+		}
+
+		source := c.MkDir()
+		makeSourceTree(c, source)
+
+		target := filepath.Join(c.MkDir(), "src")
+		copier := &sourceCopier{mode: CopyModeLink}
+		c.Assert(copier.copySource(source, target), IsNil, Commentf("%s", errno))
+
+		original, err := os.Stat(filepath.Join(source, "index.html"))
+		c.Assert(err, IsNil)
+		copied, err := os.Stat(filepath.Join(target, "index.html"))
+		c.Assert(err, IsNil)
+		c.Assert(os.SameFile(original, copied), Equals, false)
+		c.Assert(copied.Size(), Equals, original.Size())
+	}
+}
+
+// Test that a missing source is an error
+func (s *CopySuite) TestCopyMissingSource(c *C) {
+	copier := &sourceCopier{mode: CopyModeCopy}
+	err := copier.copySource(filepath.Join(c.MkDir(), "missing"), filepath.Join(c.MkDir(), "src"))
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
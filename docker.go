@@ -1,7 +1,7 @@
 package sti
 
 import (
-	"log"
+	"time"
 
 	"github.com/fsouza/go-dockerclient"
 )
@@ -16,12 +16,30 @@ type Request struct {
 	DockerTimeout int
 	WorkingDir    string
 	Debug         bool
+
+	// Receives the log messages of the request.  If it is not set, messages are
+	// written to standard error as text, with debug messages only if Debug is set.
+	Logger Logger `json:"-"`
+	// Collects measurements of the request, if set.
+	Metrics *Metrics `json:"-"`
+	// Records the spans of builds, if set.
+	Tracer *Tracer `json:"-"`
+
+	// Closing Cancel cancels the request, stopping and removing its containers and
+	// removing its working files.
+	Cancel <-chan struct{} `json:"-"`
 }
 
 // requestHandler encapsulates dependencies needed to fulfill requests.
 type requestHandler struct {
 	dockerClient *docker.Client
-	debug        bool
+	log          Logger
+	metrics      *Metrics
+	resources    *resourceTracker
+	// receives the progress of a build, if set
+	events func(BuildEvent)
+	// spans of the build being performed, if traced
+	trace *buildTrace
 }
 
 type STIResult struct {
@@ -31,16 +49,15 @@ type STIResult struct {
 
 // Returns a new handler for a given request.
 func newHandler(req Request) (*requestHandler, error) {
-	if req.Debug {
-		log.Printf("Using docker socket: %s\n", req.DockerSocket)
-	}
+	logger := req.logger()
+	logger.Debug("Using docker socket", "url", req.DockerSocket)
 
 	dockerClient, err := docker.NewClient(req.DockerSocket)
 	if err != nil {
 		return nil, ErrDockerConnectionFailed
 	}
 
-	return &requestHandler{dockerClient, req.Debug}, nil
+	return &requestHandler{dockerClient: dockerClient, log: logger, metrics: req.Metrics, resources: &resourceTracker{}}, nil
 }
 
 // Determines whether the supplied image is in the local registry.
@@ -56,19 +73,36 @@ func (h requestHandler) isImageInLocalRegistry(imageName string) (bool, error) {
 	return false, err
 }
 
+// Returns the ID of the named image, or an empty string if the image cannot be inspected.
+func (h requestHandler) imageID(imageName string) string {
+	image, err := h.dockerClient.InspectImage(imageName)
+	if err != nil || image == nil {
+		return ""
+	}
+
+	return image.ID
+}
+
 // Pull an image into the local registry
 func (h requestHandler) checkAndPull(imageName string) (*docker.Image, error) {
+	span := h.trace.start("inspect image", "sti.image", imageName)
 	image, err := h.dockerClient.InspectImage(imageName)
-	if err != nil {
+	if err == docker.ErrNoSuchImage {
+		span.end(nil)
+	} else {
+		span.end(err)
+	}
+	if err != nil && err != docker.ErrNoSuchImage {
 		return nil, ErrPullImageFailed
 	}
 
 	if image == nil {
-		if h.debug {
-			log.Printf("Pulling image %s\n", imageName)
-		}
+		h.log.Debug("Pulling image", "image", imageName)
 
+		start := time.Now()
+		span = h.trace.start("pull image", "sti.image", imageName)
 		err = h.dockerClient.PullImage(docker.PullImageOptions{Repository: imageName}, docker.AuthConfiguration{})
+		span.end(err)
 		if err != nil {
 			return nil, ErrPullImageFailed
 		}
@@ -77,47 +111,27 @@ func (h requestHandler) checkAndPull(imageName string) (*docker.Image, error) {
 		if err != nil {
 			return nil, err
 		}
-	} else if h.debug {
-		log.Printf("Image %s available locally\n", imageName)
+		h.emit(BuildEvent{Kind: EventImagePulled, Image: imageName, ImageID: image.ID, Duration: time.Since(start)})
+	} else {
+		h.log.Debug("Image available locally", "image", imageName)
 	}
 
 	return image, nil
 }
 
-// Creates a container from a given image name and returns the ID of the created container.
-func (h requestHandler) containerFromImage(imageName string) (*docker.Container, error) {
-	config := docker.Config{Image: imageName, AttachStdout: false, AttachStderr: false, Cmd: []string{"/bin/true"}}
-	container, err := h.dockerClient.CreateContainer(docker.CreateContainerOptions{Name: "", Config: &config})
-	if err != nil {
-		return nil, err
-	}
-
-	err = h.dockerClient.StartContainer(container.ID, &docker.HostConfig{})
-	if err != nil {
-		return nil, err
-	}
-
-	exitCode, err := h.dockerClient.WaitContainer(container.ID)
-	if err != nil {
-		return nil, err
-	}
-
-	if exitCode != 0 {
-		log.Printf("Container exit code: %d\n", exitCode)
-		return nil, ErrCreateContainerFailed
-	}
-
-	return container, nil
-}
-
 // Remove a container and its associated volumes.
 func (h requestHandler) removeContainer(id string) {
 	h.dockerClient.RemoveContainer(docker.RemoveContainerOptions{id, true})
+	h.resources.forgetContainer(id)
 }
 
-// Commit the container with the given ID with the given tag.
-func (h requestHandler) commitContainer(id, tag string) error {
+// Commit the container with the given ID with the given tag, stamping the given labels
+// on the resulting image.
+func (h requestHandler) commitContainer(id, tag string, labels map[string]string) error {
 	// TODO: commit message / author?
-	_, err := h.dockerClient.CommitContainer(docker.CommitContainerOptions{Container: id, Repository: tag})
+	config := docker.Config{Env: labelsToEnv(labels)}
+	span := h.trace.start("commit container", "sti.container_id", id, "sti.tag", tag)
+	_, err := h.dockerClient.CommitContainer(docker.CommitContainerOptions{Container: id, Repository: tag, Run: &config})
+	span.end(err)
 	return err
 }
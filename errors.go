@@ -13,6 +13,29 @@ const (
 	ErrInvalidBuildMethod
 	ErrBuildFailed
 	ErrCommitContainerFailed
+	ErrNoBuildMetadata
+	ErrInvalidCopyMode
+	ErrNotGitWorkingTree
+	ErrInvalidContextDir
+	ErrInvalidTagLockPolicy
+	ErrTagLocked
+	ErrLockHeld
+	ErrBuildCancelled
+	ErrQueueClosed
+	ErrNoUsageScript
+	ErrUsageFailed
+	ErrInvalidCapabilities
+	ErrUnsupportedBuildMethod
+	ErrMissingRequiredEnv
+	ErrInvalidScaffoldName
+	ErrScaffoldDirNotEmpty
+	ErrContextDirNotFound
+	ErrContextDirNotSparse
+	ErrInvalidRef
+	ErrInvalidCommit
+	ErrInvalidCloneURL
+	ErrReadImageFailed
+	ErrLocalSource
 )
 
 func (s StiError) Error() string {
@@ -37,6 +60,52 @@ func (s StiError) Error() string {
 		return "Running /usr/bin/prepare in base image failed"
 	case ErrCommitContainerFailed:
 		return "Failed to commit built container"
+	case ErrNoBuildMetadata:
+		return "Image has no sti build metadata"
+	case ErrInvalidCopyMode:
+		return "Invalid copy mode - valid modes are: copy,link,reflink"
+	case ErrNotGitWorkingTree:
+		return "Source is not a git working tree"
+	case ErrInvalidContextDir:
+		return "Context directory is not a directory within the source"
+	case ErrInvalidTagLockPolicy:
+		return "Invalid tag lock policy - valid policies are: wait,fail"
+	case ErrTagLocked:
+		return "Another build of the tag is in progress"
+	case ErrLockHeld:
+		return "Lock is held by another process"
+	case ErrBuildCancelled:
+		return "Build was cancelled"
+	case ErrQueueClosed:
+		return "Build queue is closed"
+	case ErrNoUsageScript:
+		return "Image has no usage script"
+	case ErrUsageFailed:
+		return "Running the usage script in image failed"
+	case ErrInvalidCapabilities:
+		return "Image declares invalid capabilities"
+	case ErrUnsupportedBuildMethod:
+		return "Build method is not supported by the image"
+	case ErrMissingRequiredEnv:
+		return "Image requires environment variables that were not given"
+	case ErrInvalidScaffoldName:
+		return "Invalid image name to generate a builder image skeleton for"
+	case ErrScaffoldDirNotEmpty:
+		return "Directory to generate the builder image skeleton in is not empty"
+	case ErrContextDirNotFound:
+		return "Context directory does not exist in the source"
+	case ErrContextDirNotSparse:
+		return "Context directory is not within the sparse paths to check out"
+	case ErrInvalidRef:
+		return "Invalid git ref to build"
+	case ErrInvalidCommit:
+		return "Pushed commit is not a commit ID"
+	case ErrInvalidCloneURL:
+		return "Clone URL of the push is not a remote URL of the repository"
+	case ErrReadImageFailed:
+		return "Error reading the files of the image"
+	case ErrLocalSource:
+		return "Only git URLs can be built by the server"
 	default:
 		return "Unknown error"
 	}
@@ -0,0 +1,184 @@
+package sti
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// Kinds of BuildEvent.
+const (
+	// A phase of the build started.
+	EventPhaseStarted = "PhaseStarted"
+	// A phase of the build finished, successfully unless the event has an Error.
+	EventPhaseFinished = "PhaseFinished"
+	// An image was pulled from its registry.
+	EventImagePulled = "ImagePulled"
+	// A container was created.
+	EventContainerCreated = "ContainerCreated"
+	// A line of output was written by a script or by docker build.
+	EventOutput = "Output"
+	// The artifacts of the previous build were saved.
+	EventArtifactsSaved = "ArtifactsSaved"
+	// A built image was committed and tagged.
+	EventImageCommitted = "ImageCommitted"
+)
+
+// Phases of a build, reported by EventPhaseStarted and EventPhaseFinished.
+const (
+	PhasePullImages        = "pull-images"
+	PhaseDetectIncremental = "detect-incremental"
+	PhaseSaveArtifacts     = "save-artifacts"
+	PhasePrepareSource     = "prepare-source"
+	PhaseRunBuilder        = "run-builder"
+	PhaseBuildImage        = "build-image"
+	PhaseCommitBuilder     = "commit-builder"
+)
+
+// BuildEvent reports the progress of a build to the Events callback of its request.
+// Fields that do not apply to the kind of event are empty.
+type BuildEvent struct {
+	Kind string
+	Time time.Time
+
+	Phase       string        `json:",omitempty"`
+	Image       string        `json:",omitempty"`
+	ImageID     string        `json:",omitempty"`
+	ContainerID string        `json:",omitempty"`
+	Line        string        `json:",omitempty"`
+	Bytes       int64         `json:",omitempty"`
+	Duration    time.Duration `json:",omitempty"`
+	Error       string        `json:",omitempty"`
+}
+
+// Delivers an event to the request's callback, if it has one, and records its
+// measurements in the request's metrics.
+func (h requestHandler) emit(event BuildEvent) {
+	h.metrics.event(event)
+	if h.events == nil {
+		return
+	}
+
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	h.events(event)
+}
+
+// Runs a phase of the build, reporting its start and finish.
+func (h requestHandler) phase(name string, f func() error) error {
+	start := time.Now()
+	h.log.Debug("Phase started", "phase", name)
+	h.emit(BuildEvent{Kind: EventPhaseStarted, Time: start, Phase: name})
+	span := h.trace.start(name, "sti.phase", name)
+
+	err := f()
+	span.end(err)
+
+	finished := BuildEvent{Kind: EventPhaseFinished, Phase: name, Duration: time.Since(start)}
+	if err != nil {
+		finished.Error = err.Error()
+		h.log.Debug("Phase failed", "phase", name, "duration", finished.Duration, "error", err)
+	} else {
+		h.log.Debug("Phase finished", "phase", name, "duration", finished.Duration)
+	}
+	h.emit(finished)
+
+	return err
+}
+
+// Reports the output of a container line by line, as it is written, if the request
+// has an Events callback.  Called before the container is started; the returned
+// function waits for the last of the output once the container has exited.
+func (h requestHandler) streamContainerOutput(id string) func() {
+	if h.events == nil {
+		return func() {}
+	}
+
+	return h.streamOutput(id, h.dockerClient.AttachToContainer)
+}
+
+// Reports the output of a container line by line, as attach writes it, until attach
+// returns.  Output written before the streams are attached is read from the logs of
+// the container, so that none is missed whenever the container starts.
+func (h requestHandler) streamOutput(id string, attach func(docker.AttachToContainerOptions) error) func() {
+	output := &eventWriter{h: h, containerID: id}
+	done := make(chan error, 1)
+	go func() {
+		done <- attach(docker.AttachToContainerOptions{
+			Container:    id,
+			OutputStream: output,
+			ErrorStream:  output,
+			Logs:         true,
+			Stream:       true,
+			Stdout:       true,
+			Stderr:       true,
+		})
+	}()
+
+	return func() {
+		err := <-done
+		if err != nil {
+			h.log.Warn("Unable to read the output of container", "container", id, "error", err)
+			return
+		}
+		output.flush()
+	}
+}
+
+// Returns the total size of the regular files under dir.
+func directorySize(dir string) int64 {
+	var size int64
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+
+	return size
+}
+
+// eventWriter reports the lines written to it as EventOutput events.
+type eventWriter struct {
+	h           requestHandler
+	containerID string
+	partial     []byte
+}
+
+func (w *eventWriter) Write(p []byte) (int, error) {
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
+		}
+
+		w.h.emit(BuildEvent{Kind: EventOutput, ContainerID: w.containerID, Line: string(w.partial[:i])})
+		w.partial = w.partial[i+1:]
+	}
+
+	return len(p), nil
+}
+
+// Reports the final line, if it was not terminated by a newline.
+func (w *eventWriter) flush() {
+	if len(w.partial) > 0 {
+		w.h.emit(BuildEvent{Kind: EventOutput, ContainerID: w.containerID, Line: string(w.partial)})
+		w.partial = nil
+	}
+}
+
+// Returns a writer for docker build output that also reports each line of it, if the
+// request has an Events callback.
+func (h requestHandler) outputWriter(w io.Writer) io.Writer {
+	if h.events == nil {
+		return w
+	}
+
+	return io.MultiWriter(w, &eventWriter{h: h})
+}
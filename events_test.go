@@ -0,0 +1,119 @@
+package sti
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	. "launchpad.net/gocheck"
+)
+
+type EventsSuite struct{}
+
+var _ = Suite(&EventsSuite{})
+
+func recordEvents(events *[]BuildEvent) requestHandler {
+	return requestHandler{
+		log: NewTextLogger(ioutil.Discard, LevelDebug),
+		events: func(event BuildEvent) {
+			*events = append(*events, event)
+		},
+	}
+}
+
+// Test a phase reporting its start and finish, with the error it failed with
+func (s *EventsSuite) TestPhase(c *C) {
+	var events []BuildEvent
+	h := recordEvents(&events)
+
+	c.Assert(h.phase(PhasePrepareSource, func() error { return nil }), IsNil)
+	failure := errors.New("failed")
+	c.Assert(h.phase(PhaseBuildImage, func() error { return failure }), Equals, failure)
+
+	c.Assert(events, HasLen, 4)
+	c.Assert(events[0].Kind, Equals, EventPhaseStarted)
+	c.Assert(events[0].Phase, Equals, PhasePrepareSource)
+	c.Assert(events[0].Time.IsZero(), Equals, false)
+	c.Assert(events[1].Kind, Equals, EventPhaseFinished)
+	c.Assert(events[1].Phase, Equals, PhasePrepareSource)
+	c.Assert(events[1].Error, Equals, "")
+	c.Assert(events[3].Kind, Equals, EventPhaseFinished)
+	c.Assert(events[3].Phase, Equals, PhaseBuildImage)
+	c.Assert(events[3].Error, Equals, "failed")
+}
+
+// Test output being reported line by line, however it is written
+func (s *EventsSuite) TestOutputLines(c *C) {
+	var events []BuildEvent
+	h := recordEvents(&events)
+
+	w := &eventWriter{h: h, containerID: "abc"}
+	w.Write([]byte("Step 1 : FROM"))
+	w.Write([]byte(" builder\nStep 2 : ADD\n"))
+	w.Write([]byte("done"))
+	c.Assert(events, HasLen, 2)
+	w.flush()
+
+	c.Assert(events, HasLen, 3)
+	c.Assert(events[0].Kind, Equals, EventOutput)
+	c.Assert(events[0].ContainerID, Equals, "abc")
+	c.Assert(events[0].Line, Equals, "Step 1 : FROM builder")
+	c.Assert(events[1].Line, Equals, "Step 2 : ADD")
+	c.Assert(events[2].Line, Equals, "done")
+}
+
+// Test the output of a container being reported in order as it is written, while the
+// container is running
+func (s *EventsSuite) TestStreamOutput(c *C) {
+	lines := make(chan string, 10)
+	h := requestHandler{
+		log: NewTextLogger(ioutil.Discard, LevelDebug),
+		events: func(event BuildEvent) {
+			lines <- event.Line
+		},
+	}
+
+	exited := make(chan struct{})
+	outputDone := h.streamOutput("abc", func(opts docker.AttachToContainerOptions) error {
+		c.Check(opts.Container, Equals, "abc")
+		c.Check(opts.Stream, Equals, true)
+		opts.OutputStream.Write([]byte("---> Installing\n---> Build"))
+		opts.ErrorStream.Write([]byte("ing\n"))
+		<-exited
+		opts.OutputStream.Write([]byte("---> Done"))
+		return nil
+	})
+
+	for _, expected := range []string{"---> Installing", "---> Building"} {
+		select {
+		case line := <-lines:
+			c.Assert(line, Equals, expected)
+		case <-time.After(5 * time.Second):
+			c.Fatal("output was not reported while the container was running")
+		}
+	}
+	c.Assert(lines, HasLen, 0)
+
+	close(exited)
+	outputDone()
+	c.Assert(<-lines, Equals, "---> Done")
+	c.Assert(lines, HasLen, 0)
+}
+
+// Test handlers without a callback reporting nothing
+func (s *EventsSuite) TestNoCallback(c *C) {
+	h := requestHandler{log: NewTextLogger(ioutil.Discard, LevelDebug)}
+	c.Assert(h.phase(PhaseBuildImage, func() error { return nil }), IsNil)
+	h.emit(BuildEvent{Kind: EventOutput})
+	c.Assert(h.outputWriter(ioutil.Discard), Equals, ioutil.Discard)
+}
+
+// Test the size of saved artifacts counting regular files only
+func (s *EventsSuite) TestDirectorySize(c *C) {
+	dir := c.MkDir()
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "a"), make([]byte, 10), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "b"), make([]byte, 5), 0644), IsNil)
+	c.Assert(directorySize(dir), Equals, int64(15))
+}
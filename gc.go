@@ -0,0 +1,171 @@
+package sti
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// Describes a request to remove the leftovers of sti runs that crashed or were killed.
+type GCRequest struct {
+	Request
+	// Only remove containers and temporary files older than this.
+	OlderThan time.Duration
+	// Report what would be removed without removing anything.
+	DryRun bool
+}
+
+// Lists what was removed by GC.
+type GCResult struct {
+	Containers []string
+	Paths      []string
+}
+
+// GC removes the resources left behind by sti runs that did not finish: stopped sti
+// containers, unused build working directories and their build context tarballs
+// within the request's WorkingDir (or the system temporary directory), and the lock
+// files of runs and tags no sti run holds.
+func GC(req GCRequest) (*GCResult, error) {
+	h, err := newHandler(req.Request)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := req.WorkingDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	cutoff := time.Now().Add(-req.OlderThan)
+	result := &GCResult{}
+
+	result.Containers, err = h.removeStoppedContainers(cutoff, req.DryRun)
+	if err != nil {
+		return nil, err
+	}
+
+	result.Paths, err = h.removeUnusedWorkspaces(dir, cutoff, req.DryRun)
+	if err != nil {
+		return nil, err
+	}
+
+	locks, err := h.removeUnusedLocks(lockDir(), cutoff, req.DryRun)
+	if err != nil {
+		return nil, err
+	}
+	result.Paths = append(result.Paths, locks...)
+
+	return result, nil
+}
+
+// Removes the working directories within dir that were created before cutoff and are
+// not in use by a build, along with their build context tarballs, returning their
+// paths.  With dryRun, the directories are only listed.
+func (h requestHandler) removeUnusedWorkspaces(dir string, cutoff time.Time, dryRun bool) ([]string, error) {
+	workspaces, err := filepath.Glob(filepath.Join(dir, workspacePrefix+"*"))
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []string
+	for _, workspace := range workspaces {
+		info, err := os.Stat(workspace)
+		if err != nil || !info.IsDir() || info.ModTime().After(cutoff) {
+			continue
+		}
+
+		// A build holds the lock on its working directory until it finishes.
+		lock, err := lockFile(workspace+".lock", false)
+		if err != nil {
+			continue
+		}
+
+		h.log.Debug("Removing working directory", "path", workspace)
+		if !dryRun {
+			os.RemoveAll(workspace)
+			os.Remove(workspace + ".tar")
+			os.Remove(lock.Name())
+		}
+		lock.Close()
+		removed = append(removed, workspace)
+	}
+
+	return removed, nil
+}
+
+// Removes the lock files within dir, of runs and tags, that were created before cutoff
+// and are not held, returning their paths.  With dryRun, the files are only listed.
+func (h requestHandler) removeUnusedLocks(dir string, cutoff time.Time, dryRun bool) ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.lock"))
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil || !info.Mode().IsRegular() || info.ModTime().After(cutoff) {
+			continue
+		}
+
+		// The lock is removed while it is held, so that no run takes it in between.
+		lock, err := lockFile(path, false)
+		if err != nil {
+			continue
+		}
+
+		h.log.Debug("Removing lock file", "path", path)
+		if !dryRun {
+			os.Remove(path)
+		}
+		lock.Close()
+		removed = append(removed, path)
+	}
+
+	return removed, nil
+}
+
+// Removes the stopped containers created by sti before cutoff, returning their IDs.
+// Containers of runs in progress on this host are left alone, even if they were never
+// started, as are running containers.  With dryRun, the containers are only listed.
+func (h requestHandler) removeStoppedContainers(cutoff time.Time, dryRun bool) ([]string, error) {
+	containers, err := h.dockerClient.ListContainers(docker.ListContainersOptions{All: true})
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []string
+	for _, container := range containers {
+		if !isStiContainer(container) || strings.HasPrefix(container.Status, "Up") || containerInUse(container) {
+			continue
+		}
+		if time.Unix(container.Created, 0).After(cutoff) {
+			continue
+		}
+
+		h.log.Debug("Removing container", "name", container.Names[0], "container", container.ID)
+		if !dryRun {
+			err = h.dockerClient.RemoveContainer(docker.RemoveContainerOptions{ID: container.ID, RemoveVolumes: true})
+			if err != nil {
+				h.log.Warn("Unable to remove container", "container", container.ID, "error", err)
+				continue
+			}
+		}
+		removed = append(removed, container.ID)
+	}
+
+	return removed, nil
+}
+
+// Determines whether a container was created by sti.
+func isStiContainer(container docker.APIContainers) bool {
+	for _, name := range container.Names {
+		if strings.HasPrefix(strings.TrimPrefix(name, "/"), containerNamePrefix) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,185 @@
+package sti
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	. "launchpad.net/gocheck"
+)
+
+type GCSuite struct{}
+
+var _ = Suite(&GCSuite{})
+
+// Makes a working directory in dir that is not in use and was last modified at modTime.
+func makeWorkspace(c *C, dir string, name string, modTime time.Time) string {
+	workspace := filepath.Join(dir, workspacePrefix+name)
+	c.Assert(os.Mkdir(workspace, 0700), IsNil)
+	c.Assert(os.Chtimes(workspace, modTime, modTime), IsNil)
+	return workspace
+}
+
+// Test that a working directory is locked as soon as it exists
+func (s *GCSuite) TestNewWorkspaceLocked(c *C) {
+	h := quietHandler()
+	dir := c.MkDir()
+
+	workspace, lock, err := h.newWorkspace(dir)
+	c.Assert(err, IsNil)
+	c.Assert(filepath.Dir(workspace), Equals, dir)
+	c.Assert(exists(workspace, ""), Equals, true)
+
+	_, err = lockFile(workspace+".lock", false)
+	c.Assert(err, Equals, ErrLockHeld)
+
+	lock.Close()
+	h.release()
+	c.Assert(exists(workspace, ""), Equals, false)
+	c.Assert(exists(workspace+".lock", ""), Equals, false)
+}
+
+// Test removing only the old working directories that no build is using
+func (s *GCSuite) TestRemoveUnusedWorkspaces(c *C) {
+	h := quietHandler()
+	dir := c.MkDir()
+	cutoff := time.Now().Add(-time.Hour)
+
+	old := makeWorkspace(c, dir, "old", cutoff.Add(-time.Hour))
+	c.Assert(ioutil.WriteFile(old+".tar", nil, 0600), IsNil)
+	recent := makeWorkspace(c, dir, "recent", cutoff.Add(time.Minute))
+	used, lock, err := h.newWorkspace(dir)
+	c.Assert(err, IsNil)
+	defer lock.Close()
+	c.Assert(os.Chtimes(used, cutoff.Add(-time.Hour), cutoff.Add(-time.Hour)), IsNil)
+
+	removed, err := h.removeUnusedWorkspaces(dir, cutoff, true)
+	c.Assert(err, IsNil)
+	c.Assert(removed, DeepEquals, []string{old})
+	c.Assert(exists(old, ""), Equals, true)
+
+	removed, err = h.removeUnusedWorkspaces(dir, cutoff, false)
+	c.Assert(err, IsNil)
+	c.Assert(removed, DeepEquals, []string{old})
+	c.Assert(exists(old, ""), Equals, false)
+	c.Assert(exists(old+".tar", ""), Equals, false)
+	c.Assert(exists(recent, ""), Equals, true)
+	c.Assert(exists(used, ""), Equals, true)
+}
+
+// Test that the containers of a run are in use until the run releases them
+func (s *GCSuite) TestContainerInUse(c *C) {
+	resources := &resourceTracker{}
+	first, err := resources.newContainerName()
+	c.Assert(err, IsNil)
+	second, err := resources.newContainerName()
+	c.Assert(err, IsNil)
+	c.Assert(first, Not(Equals), second)
+
+	for _, name := range []string{first, second} {
+		container := docker.APIContainers{Names: []string{"/" + name}}
+		c.Assert(isStiContainer(container), Equals, true)
+		c.Assert(containerInUse(container), Equals, true)
+	}
+
+	other := &resourceTracker{}
+	third, err := other.newContainerName()
+	c.Assert(err, IsNil)
+	other.releaseRunLock()
+	c.Assert(containerInUse(docker.APIContainers{Names: []string{"/" + third}}), Equals, false)
+
+	resources.releaseRunLock()
+	c.Assert(containerInUse(docker.APIContainers{Names: []string{"/" + first}}), Equals, false)
+}
+
+// Test that containers named by earlier versions of sti are never in use
+func (s *GCSuite) TestContainerInUseWithoutRun(c *C) {
+	container := docker.APIContainers{Names: []string{"/" + containerNamePrefix + "0123456789abcdef"}}
+	c.Assert(isStiContainer(container), Equals, true)
+	c.Assert(containerInUse(container), Equals, false)
+}
+
+// Test that a build context tarball is written next to its working directory
+func (s *GCSuite) TestTarballInWorkspace(c *C) {
+	h := quietHandler()
+	dir := c.MkDir()
+	workspace, lock, err := h.newWorkspace(dir)
+	c.Assert(err, IsNil)
+	defer lock.Close()
+
+	tarball, err := tarDirectory(workspace, workspace+".tar")
+	c.Assert(err, IsNil)
+	c.Assert(exists(tarball.Name(), ""), Equals, true)
+
+	removed, err := h.removeUnusedWorkspaces(dir, time.Now().Add(time.Hour), false)
+	c.Assert(err, IsNil)
+	c.Assert(removed, HasLen, 0)
+	c.Assert(exists(tarball.Name(), ""), Equals, true)
+
+	_, err = tarDirectory(workspace, workspace+".tar")
+	c.Assert(os.IsExist(err), Equals, true)
+}
+
+// Test removing only the old lock files that no run holds
+func (s *GCSuite) TestRemoveUnusedLocks(c *C) {
+	h := quietHandler()
+	dir := c.MkDir()
+	cutoff := time.Now().Add(-time.Hour)
+
+	lockAt := func(name string, modTime time.Time) string {
+		path := filepath.Join(dir, name+".lock")
+		c.Assert(ioutil.WriteFile(path, nil, 0666), IsNil)
+		c.Assert(os.Chtimes(path, modTime, modTime), IsNil)
+		return path
+	}
+	old := lockAt("old%2Fapp", cutoff.Add(-time.Hour))
+	recent := lockAt("recent%2Fapp", cutoff.Add(time.Minute))
+	held := lockAt(runLockPrefix+"0123456789abcdef", cutoff.Add(-time.Hour))
+	lock, err := lockFile(held, false)
+	c.Assert(err, IsNil)
+	defer lock.Close()
+
+	removed, err := h.removeUnusedLocks(dir, cutoff, true)
+	c.Assert(err, IsNil)
+	c.Assert(removed, DeepEquals, []string{old})
+	c.Assert(exists(old, ""), Equals, true)
+
+	removed, err = h.removeUnusedLocks(dir, cutoff, false)
+	c.Assert(err, IsNil)
+	c.Assert(removed, DeepEquals, []string{old})
+	c.Assert(exists(old, ""), Equals, false)
+	c.Assert(exists(recent, ""), Equals, true)
+	c.Assert(exists(held, ""), Equals, true)
+}
+
+// Test that a lock waited for while its file is removed is taken on the file that
+// replaces it, so that it excludes later runs
+func (s *GCSuite) TestLockFileRemovedWhileWaiting(c *C) {
+	path := filepath.Join(c.MkDir(), "tag.lock")
+	first, err := lockFile(path, false)
+	c.Assert(err, IsNil)
+
+	locked := make(chan *os.File)
+	go func() {
+		second, err := lockFile(path, true)
+		c.Check(err, IsNil)
+		locked <- second
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	c.Assert(os.Remove(path), IsNil)
+	first.Close()
+
+	second := <-locked
+	defer second.Close()
+	current, err := os.Stat(path)
+	c.Assert(err, IsNil)
+	info, err := second.Stat()
+	c.Assert(err, IsNil)
+	c.Assert(os.SameFile(info, current), Equals, true)
+
+	_, err = lockFile(path, false)
+	c.Assert(err, Equals, ErrLockHeld)
+}
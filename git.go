@@ -0,0 +1,186 @@
+package sti
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// gitCloneOptions control how a git source is fetched.
+type gitCloneOptions struct {
+	// create a shallow clone with history truncated to this many commits, if non-zero
+	depth int
+	// check out submodules, recursively
+	submodules bool
+	// check out only these paths, relative to the repository root, if any
+	sparsePaths []string
+	// branch, tag or commit to check out instead of the default branch, if any
+	ref string
+}
+
+// Clones the repository at source into targetPath.
+func gitClone(source string, targetPath string, opts gitCloneOptions) error {
+	args := []string{"clone", "--quiet"}
+	if opts.depth > 0 {
+		args = append(args, "--depth", strconv.Itoa(opts.depth))
+	}
+	if len(opts.sparsePaths) > 0 || opts.ref != "" {
+		args = append(args, "--no-checkout")
+	}
+	args = append(args, "--", source, targetPath)
+
+	err := exec.Command("git", args...).Run()
+	if err != nil {
+		return err
+	}
+
+	if len(opts.sparsePaths) > 0 {
+		err = gitSparseCheckout(targetPath, opts.sparsePaths)
+		if err != nil {
+			return err
+		}
+	}
+
+	if opts.ref != "" {
+		err = gitCheckout(targetPath, opts.ref, opts.depth)
+		if err != nil {
+			return err
+		}
+	} else if len(opts.sparsePaths) > 0 {
+		_, err = gitOutput(targetPath, "read-tree", "-mu", "HEAD")
+		if err != nil {
+			return err
+		}
+	}
+
+	if opts.submodules {
+		_, err = gitOutput(targetPath, "submodule", "--quiet", "update", "--init", "--recursive")
+	}
+
+	return err
+}
+
+// Checks out ref in the cloned repository at dir.  A ref that was not fetched by the
+// clone, such as a commit beyond the history of a shallow clone, is fetched from origin.
+func gitCheckout(dir string, ref string, depth int) error {
+	// git would take such a ref for an option
+	if strings.HasPrefix(ref, "-") {
+		return ErrInvalidRef
+	}
+
+	_, err := gitOutput(dir, "checkout", "--quiet", ref, "--")
+	if err == nil {
+		return nil
+	}
+
+	args := []string{"fetch", "--quiet"}
+	if depth > 0 {
+		args = append(args, "--depth", strconv.Itoa(depth))
+	}
+	args = append(args, "--end-of-options", "origin", ref)
+	_, err = gitOutput(dir, args...)
+	if err != nil {
+		return err
+	}
+
+	_, err = gitOutput(dir, "checkout", "--quiet", "FETCH_HEAD", "--")
+	return err
+}
+
+// Restricts checkouts in the repository at dir to the given paths.
+func gitSparseCheckout(dir string, paths []string) error {
+	_, err := gitOutput(dir, "config", "core.sparseCheckout", "true")
+	if err != nil {
+		return err
+	}
+
+	var patterns bytes.Buffer
+	for _, path := range paths {
+		patterns.WriteString("/" + strings.Trim(filepath.ToSlash(path), "/") + "\n")
+	}
+
+	infoDir := filepath.Join(dir, ".git", "info")
+	err = os.MkdirAll(infoDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(infoDir, "sparse-checkout"), patterns.Bytes(), 0644)
+}
+
+// Runs git with the given arguments in dir and returns its output.
+func gitOutput(dir string, args ...string) ([]byte, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	return cmd.Output()
+}
+
+// Returns the commit checked out in the git repository at dir.
+func gitRevision(dir string) (string, error) {
+	out, err := gitOutput(dir, "rev-parse", "HEAD")
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+var gitURLPattern = regexp.MustCompile(`^((git|ssh|https?)://|[\w.-]+@[\w.-]+:)`)
+
+// Determines whether source is the URL of a git repository to clone rather than a local
+// directory: a git://, ssh:// or http(s):// URL, or an scp-style user@host:path.
+func isGitURL(source string) bool {
+	return gitURLPattern.MatchString(source)
+}
+
+// Determines whether dir is the root of a git repository.
+func isGitRepository(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, ".git"))
+	return err == nil
+}
+
+// Lists the files of the git working tree at dir, relative to dir: tracked files, and
+// untracked files that are not ignored by git unless excludeUntracked is set.  Tracked
+// files deleted from the working tree are listed too.
+func gitWorkingTreeFiles(dir string, excludeUntracked bool) ([]string, error) {
+	args := []string{"ls-files", "-z", "--cached"}
+	if !excludeUntracked {
+		args = append(args, "--others", "--exclude-standard")
+	}
+
+	out, err := gitOutput(dir, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, file := range bytes.Split(out, []byte{0}) {
+		if len(file) > 0 {
+			files = append(files, string(file))
+		}
+	}
+
+	return files, nil
+}
+
+// Determines whether the git working tree at dir differs from its HEAD commit.
+// Untracked files are not considered if excludeUntracked is set.
+func gitIsDirty(dir string, excludeUntracked bool) (bool, error) {
+	args := []string{"status", "--porcelain"}
+	if excludeUntracked {
+		args = append(args, "--untracked-files=no")
+	}
+	args = append(args, "--", ".")
+
+	out, err := gitOutput(dir, args...)
+	if err != nil {
+		return false, err
+	}
+
+	return len(bytes.TrimSpace(out)) > 0, nil
+}
@@ -0,0 +1,226 @@
+package sti
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	. "launchpad.net/gocheck"
+)
+
+type GitSuite struct{}
+
+var _ = Suite(&GitSuite{})
+
+// Runs git in dir for a fixture, with a fixed identity, and returns its output.
+func runGit(c *C, dir string, args ...string) string {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=sti", "GIT_AUTHOR_EMAIL=sti@example.com",
+		"GIT_COMMITTER_NAME=sti", "GIT_COMMITTER_EMAIL=sti@example.com",
+		"GIT_CONFIG_NOSYSTEM=1", "HOME="+dir)
+	out, err := cmd.CombinedOutput()
+	c.Assert(err, IsNil, Commentf("git %s: %s", strings.Join(args, " "), out))
+
+	return strings.TrimSpace(string(out))
+}
+
+func writeFile(c *C, dir string, path string, content string) {
+	path = filepath.Join(dir, filepath.FromSlash(path))
+	c.Assert(os.MkdirAll(filepath.Dir(path), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(path, []byte(content), 0644), IsNil)
+}
+
+func readFile(c *C, dir string, path string) string {
+	content, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(path)))
+	c.Assert(err, IsNil)
+	return string(content)
+}
+
+func exists(dir string, path string) bool {
+	_, err := os.Lstat(filepath.Join(dir, filepath.FromSlash(path)))
+	return err == nil
+}
+
+// Creates a git repository with a committed application, and returns its path.
+func makeGitRepository(c *C) string {
+	dir := c.MkDir()
+	runGit(c, dir, "init", "--quiet")
+	writeFile(c, dir, "index.html", "<html></html>\n")
+	writeFile(c, dir, "app/app.rb", "puts 'hello'\n")
+	writeFile(c, dir, "docs/README", "docs\n")
+	writeFile(c, dir, ".gitignore", "*.log\n")
+	runGit(c, dir, "add", ".")
+	runGit(c, dir, "commit", "--quiet", "-m", "initial")
+
+	return dir
+}
+
+func sorted(files []string) []string {
+	sort.Strings(files)
+	return files
+}
+
+// Test listing the tracked, untracked and deleted files of a working tree
+func (s *GitSuite) TestWorkingTreeFiles(c *C) {
+	dir := makeGitRepository(c)
+	writeFile(c, dir, "new.txt", "new\n")
+	writeFile(c, dir, "debug.log", "ignored\n")
+	c.Assert(os.Remove(filepath.Join(dir, "docs", "README")), IsNil)
+
+	files, err := gitWorkingTreeFiles(dir, false)
+	c.Assert(err, IsNil)
+	c.Assert(sorted(files), DeepEquals, []string{".gitignore", "app/app.rb", "docs/README", "index.html", "new.txt"})
+
+	files, err = gitWorkingTreeFiles(dir, true)
+	c.Assert(err, IsNil)
+	c.Assert(sorted(files), DeepEquals, []string{".gitignore", "app/app.rb", "docs/README", "index.html"})
+}
+
+// Test that a working tree is dirty with uncommitted changes, and with untracked
+// files unless they are excluded
+func (s *GitSuite) TestIsDirty(c *C) {
+	dir := makeGitRepository(c)
+
+	dirty, err := gitIsDirty(dir, false)
+	c.Assert(err, IsNil)
+	c.Assert(dirty, Equals, false)
+
+	writeFile(c, dir, "debug.log", "ignored\n")
+	dirty, err = gitIsDirty(dir, false)
+	c.Assert(err, IsNil)
+	c.Assert(dirty, Equals, false)
+
+	writeFile(c, dir, "new.txt", "new\n")
+	dirty, err = gitIsDirty(dir, false)
+	c.Assert(err, IsNil)
+	c.Assert(dirty, Equals, true)
+	dirty, err = gitIsDirty(dir, true)
+	c.Assert(err, IsNil)
+	c.Assert(dirty, Equals, false)
+
+	writeFile(c, dir, "index.html", "<html>changed</html>\n")
+	dirty, err = gitIsDirty(dir, true)
+	c.Assert(err, IsNil)
+	c.Assert(dirty, Equals, true)
+}
+
+// Test recognizing the URLs of git repositories, as opposed to local paths
+func (s *GitSuite) TestIsGitURL(c *C) {
+	for _, url := range []string{"git://github.com/pmorie/simple-html", "https://github.com/pmorie/simple-html.git",
+		"ssh://git@github.com/pmorie/simple-html", "git@github.com:pmorie/simple-html.git"} {
+		c.Assert(isGitURL(url), Equals, true, Commentf(url))
+	}
+	for _, path := range []string{"/src/app", "app", "./git@host:app", "file:///src/app"} {
+		c.Assert(isGitURL(path), Equals, false, Commentf(path))
+	}
+}
+
+// Adds a commit changing index.html to the repository at dir, and returns it.
+func commitChange(c *C, dir string, content string) string {
+	writeFile(c, dir, "index.html", content)
+	runGit(c, dir, "commit", "--quiet", "-a", "-m", "change")
+
+	return runGit(c, dir, "rev-parse", "HEAD")
+}
+
+// Test a shallow clone
+func (s *GitSuite) TestCloneDepth(c *C) {
+	source := makeGitRepository(c)
+	commitChange(c, source, "<html>1</html>\n")
+	head := commitChange(c, source, "<html>2</html>\n")
+
+	target := filepath.Join(c.MkDir(), "src")
+	c.Assert(gitClone("file://"+source, target, gitCloneOptions{depth: 1}), IsNil)
+
+	c.Assert(runGit(c, target, "rev-parse", "HEAD"), Equals, head)
+	c.Assert(runGit(c, target, "rev-list", "--count", "HEAD"), Equals, "1")
+	c.Assert(readFile(c, target, "index.html"), Equals, "<html>2</html>\n")
+}
+
+// Test checking out only some paths of a clone
+func (s *GitSuite) TestCloneSparsePaths(c *C) {
+	source := makeGitRepository(c)
+
+	target := filepath.Join(c.MkDir(), "src")
+	c.Assert(gitClone(source, target, gitCloneOptions{sparsePaths: []string{"app/", "docs"}}), IsNil)
+
+	c.Assert(exists(target, "app/app.rb"), Equals, true)
+	c.Assert(exists(target, "docs/README"), Equals, true)
+	c.Assert(exists(target, "index.html"), Equals, false)
+}
+
+// Test cloning a commit other than the head of the default branch
+func (s *GitSuite) TestCloneRef(c *C) {
+	source := makeGitRepository(c)
+	first := runGit(c, source, "rev-parse", "HEAD")
+	commitChange(c, source, "<html>2</html>\n")
+
+	target := filepath.Join(c.MkDir(), "src")
+	c.Assert(gitClone(source, target, gitCloneOptions{ref: first}), IsNil)
+
+	c.Assert(runGit(c, target, "rev-parse", "HEAD"), Equals, first)
+	c.Assert(readFile(c, target, "index.html"), Equals, "<html></html>\n")
+}
+
+// Test cloning a branch that a shallow clone of the default branch does not fetch
+func (s *GitSuite) TestCloneRefFetched(c *C) {
+	source := makeGitRepository(c)
+	runGit(c, source, "checkout", "--quiet", "-b", "feature")
+	feature := commitChange(c, source, "<html>feature</html>\n")
+	runGit(c, source, "checkout", "--quiet", "-")
+
+	target := filepath.Join(c.MkDir(), "src")
+	c.Assert(gitClone("file://"+source, target, gitCloneOptions{depth: 1, ref: "feature"}), IsNil)
+
+	c.Assert(runGit(c, target, "rev-parse", "HEAD"), Equals, feature)
+	c.Assert(runGit(c, target, "rev-list", "--count", "HEAD"), Equals, "1")
+	c.Assert(readFile(c, target, "index.html"), Equals, "<html>feature</html>\n")
+}
+
+// Test that cloning a ref that does not exist fails
+func (s *GitSuite) TestCloneMissingRef(c *C) {
+	source := makeGitRepository(c)
+
+	target := filepath.Join(c.MkDir(), "src")
+	c.Assert(gitClone(source, target, gitCloneOptions{ref: "missing"}), NotNil)
+}
+
+// Test that refs git would take for options are refused
+func (s *GitSuite) TestCloneOptionRef(c *C) {
+	source := makeGitRepository(c)
+
+	target := filepath.Join(c.MkDir(), "src")
+	c.Assert(gitClone(source, target, gitCloneOptions{ref: "--upload-pack=touch pwned"}), Equals, ErrInvalidRef)
+	c.Assert(exists(target, "pwned"), Equals, false)
+}
+
+// Test checking out the submodules of a clone
+func (s *GitSuite) TestCloneSubmodules(c *C) {
+	// git only clones submodules from local paths when allowed to
+	os.Setenv("GIT_CONFIG_COUNT", "1")
+	os.Setenv("GIT_CONFIG_KEY_0", "protocol.file.allow")
+	os.Setenv("GIT_CONFIG_VALUE_0", "always")
+	defer func() {
+		os.Unsetenv("GIT_CONFIG_COUNT")
+		os.Unsetenv("GIT_CONFIG_KEY_0")
+		os.Unsetenv("GIT_CONFIG_VALUE_0")
+	}()
+
+	library := makeGitRepository(c)
+	source := makeGitRepository(c)
+	runGit(c, source, "submodule", "--quiet", "add", library, "lib")
+	runGit(c, source, "commit", "--quiet", "-m", "add lib")
+
+	target := filepath.Join(c.MkDir(), "src")
+	c.Assert(gitClone(source, target, gitCloneOptions{}), IsNil)
+	c.Assert(exists(target, "lib/app/app.rb"), Equals, false)
+
+	target = filepath.Join(c.MkDir(), "src")
+	c.Assert(gitClone(source, target, gitCloneOptions{submodules: true}), IsNil)
+	c.Assert(exists(target, "lib/app/app.rb"), Equals, true)
+}
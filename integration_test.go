@@ -130,6 +130,20 @@ func (s *IntegrationTestSuite) TestValidateExtendedFailure(c *C) {
 	c.Assert(resp.Success, Equals, false, Commentf("Validation should have failed: invalid response"))
 }
 
+// Test asking for the usage of an image without a usage script
+func (s *IntegrationTestSuite) TestUsageMissing(c *C) {
+	req := UsageRequest{
+		Request: Request{
+			WorkingDir:   s.tempDir,
+			DockerSocket: DockerSocket,
+			Debug:        true,
+			BaseImage:    FakeBaseImage,
+		},
+	}
+	_, err := Usage(req)
+	c.Assert(err, Equals, ErrNoUsageScript)
+}
+
 // Test a clean build.  The simplest case.
 func (s *IntegrationTestSuite) TestCleanBuild(c *C) {
 	s.exerciseCleanBuild(c, TagCleanBuild, false)
@@ -165,6 +179,51 @@ func (s *IntegrationTestSuite) exerciseCleanBuild(c *C, tag string, useRun bool)
 	s.checkBasicBuildState(c, containerId)
 }
 
+// Test a builder image with clean and incremental builds with both methods
+func (s *IntegrationTestSuite) TestBuilder(c *C) {
+	req := TestBuilderRequest{
+		Request: Request{
+			WorkingDir:   s.tempDir,
+			DockerSocket: DockerSocket,
+			Debug:        true,
+			BaseImage:    FakeBaseImage},
+		App:     TestSource,
+		Methods: []string{"build", "run"},
+		Writer:  os.Stdout}
+
+	resp, err := TestBuilder(req)
+	c.Assert(err, IsNil, Commentf("Builder test failed"))
+	c.Assert(resp.Validation.Success, Equals, true)
+	c.Assert(resp.Cases, HasLen, 4)
+	for _, testCase := range resp.Cases {
+		c.Assert(testCase.Build, Equals, CheckPassed, Commentf("%s %s build: %s", testCase.Method, testCase.Kind, testCase.Detail))
+	}
+}
+
+// Test rebuilding an image from the inputs recorded on it
+func (s *IntegrationTestSuite) TestRebuild(c *C) {
+	s.exerciseCleanBuild(c, TagCleanBuild, false)
+
+	req := RebuildRequest{
+		Request: Request{
+			WorkingDir:   s.tempDir,
+			DockerSocket: DockerSocket,
+			Debug:        true},
+		Tag:    TagCleanBuild,
+		Clean:  true,
+		Writer: os.Stdout}
+
+	resp, err := Rebuild(req)
+	c.Assert(err, IsNil, Commentf("Sti rebuild failed"))
+	c.Assert(resp.Success, Equals, true, Commentf("Sti rebuild failed"))
+	c.Assert(resp.Metadata.BuilderName, Equals, FakeBaseImage)
+	c.Assert(resp.Metadata.Source, Equals, TestSource)
+
+	containerId := s.createContainer(c, TagCleanBuild)
+	defer s.removeContainer(containerId)
+	s.checkBasicBuildState(c, containerId)
+}
+
 // Test an incremental build.
 func (s *IntegrationTestSuite) TestIncrementalBuild(c *C) {
 	s.exerciseIncrementalBuild(c, TagIncrementalBuild, false)
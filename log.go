@@ -0,0 +1,181 @@
+package sti
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Logger receives the log messages of a request.  Each message may be followed by
+// fields, given as alternating keys and values, such as the image or container it
+// concerns.
+type Logger interface {
+	Debug(msg string, fields ...interface{})
+	Info(msg string, fields ...interface{})
+	Warn(msg string, fields ...interface{})
+	Error(msg string, fields ...interface{})
+
+	// With returns a Logger adding the given fields to every message.
+	With(fields ...interface{}) Logger
+}
+
+// Level is the severity of a log message.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	}
+
+	return strconv.Itoa(int(l))
+}
+
+// streamLogger writes the messages of at least its level to a stream, formatted by
+// its format function.
+type streamLogger struct {
+	mu     *sync.Mutex
+	w      io.Writer
+	level  Level
+	format func(buf *bytes.Buffer, t time.Time, level Level, msg string, fields []interface{})
+	fields []interface{}
+}
+
+// NewTextLogger returns a Logger writing messages of at least the given level to w as
+// human-readable lines: the time, level and message followed by key=value fields.
+func NewTextLogger(w io.Writer, level Level) Logger {
+	return &streamLogger{mu: &sync.Mutex{}, w: w, level: level, format: formatText}
+}
+
+// NewJSONLogger returns a Logger writing messages of at least the given level to w as
+// JSON objects, one per line, with time, level and msg keys alongside the fields.
+func NewJSONLogger(w io.Writer, level Level) Logger {
+	return &streamLogger{mu: &sync.Mutex{}, w: w, level: level, format: formatJSON}
+}
+
+func (l *streamLogger) Debug(msg string, fields ...interface{}) {
+	l.log(LevelDebug, msg, fields)
+}
+
+func (l *streamLogger) Info(msg string, fields ...interface{}) {
+	l.log(LevelInfo, msg, fields)
+}
+
+func (l *streamLogger) Warn(msg string, fields ...interface{}) {
+	l.log(LevelWarn, msg, fields)
+}
+
+func (l *streamLogger) Error(msg string, fields ...interface{}) {
+	l.log(LevelError, msg, fields)
+}
+
+func (l *streamLogger) With(fields ...interface{}) Logger {
+	with := *l
+	with.fields = append(append([]interface{}{}, l.fields...), fields...)
+	return &with
+}
+
+func (l *streamLogger) log(level Level, msg string, fields []interface{}) {
+	if level < l.level {
+		return
+	}
+
+	var buf bytes.Buffer
+	l.format(&buf, time.Now(), level, msg, append(append([]interface{}{}, l.fields...), fields...))
+	buf.WriteByte('\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write(buf.Bytes())
+}
+
+// Returns the key of the field at i, and its value, or nil if it has none.
+func fieldAt(fields []interface{}, i int) (string, interface{}) {
+	key := fmt.Sprint(fields[i])
+	if i+1 < len(fields) {
+		return key, fields[i+1]
+	}
+
+	return key, nil
+}
+
+func formatText(buf *bytes.Buffer, t time.Time, level Level, msg string, fields []interface{}) {
+	buf.WriteString(t.Format("2006-01-02T15:04:05.000Z07:00"))
+	buf.WriteString(" " + strings.ToUpper(level.String()) + " " + msg)
+
+	for i := 0; i < len(fields); i += 2 {
+		key, value := fieldAt(fields, i)
+		text := fmt.Sprint(value)
+		if text == "" || strings.ContainsAny(text, " \t\n\"=") {
+			text = strconv.Quote(text)
+		}
+		buf.WriteString(" " + key + "=" + text)
+	}
+}
+
+func formatJSON(buf *bytes.Buffer, t time.Time, level Level, msg string, fields []interface{}) {
+	buf.WriteString(`{"time":`)
+	writeJSONValue(buf, t.Format(time.RFC3339Nano))
+	buf.WriteString(`,"level":`)
+	writeJSONValue(buf, level.String())
+	buf.WriteString(`,"msg":`)
+	writeJSONValue(buf, msg)
+
+	for i := 0; i < len(fields); i += 2 {
+		key, value := fieldAt(fields, i)
+		buf.WriteByte(',')
+		writeJSONValue(buf, key)
+		buf.WriteByte(':')
+		writeJSONValue(buf, value)
+	}
+
+	buf.WriteByte('}')
+}
+
+// Writes the JSON encoding of a field value; errors are written as their message, and
+// values that cannot be encoded as their default format.
+func writeJSONValue(buf *bytes.Buffer, value interface{}) {
+	if err, ok := value.(error); ok {
+		value = err.Error()
+	}
+
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		encoded, _ = json.Marshal(fmt.Sprint(value))
+	}
+	buf.Write(encoded)
+}
+
+// Returns the logger of a request: its Logger if set, and otherwise a text logger
+// writing to standard error, including debug messages if Debug is set.
+func (r Request) logger() Logger {
+	if r.Logger != nil {
+		return r.Logger
+	}
+
+	level := LevelInfo
+	if r.Debug {
+		level = LevelDebug
+	}
+
+	return NewTextLogger(os.Stderr, level)
+}
@@ -0,0 +1,81 @@
+package sti
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	. "launchpad.net/gocheck"
+)
+
+type LogSuite struct{}
+
+var _ = Suite(&LogSuite{})
+
+// Test text messages carrying their level, message and fields, quoted where needed
+func (s *LogSuite) TestTextLogger(c *C) {
+	var buf bytes.Buffer
+	logger := NewTextLogger(&buf, LevelInfo)
+
+	logger.Info("Validating image", "image", "pmorie/centos-ruby2", "incremental", true)
+	logger.Error("Unable to commit", "error", errors.New("no such container"), "tag", "")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	c.Assert(lines, HasLen, 2)
+	c.Assert(strings.HasSuffix(lines[0], " INFO Validating image image=pmorie/centos-ruby2 incremental=true"), Equals, true)
+	c.Assert(strings.HasSuffix(lines[1], ` ERROR Unable to commit error="no such container" tag=""`), Equals, true)
+}
+
+// Test JSON messages being objects with time, level, msg and field keys
+func (s *LogSuite) TestJSONLogger(c *C) {
+	var buf bytes.Buffer
+	logger := NewJSONLogger(&buf, LevelDebug).With("build", "abc123")
+
+	logger.Debug("Created container", "container", "f00", "files", 3, "error", errors.New("failed"))
+
+	var entry map[string]interface{}
+	c.Assert(json.Unmarshal(buf.Bytes(), &entry), IsNil)
+	c.Assert(entry["time"], NotNil)
+	c.Assert(entry["level"], Equals, "debug")
+	c.Assert(entry["msg"], Equals, "Created container")
+	c.Assert(entry["build"], Equals, "abc123")
+	c.Assert(entry["container"], Equals, "f00")
+	c.Assert(entry["files"], Equals, float64(3))
+	c.Assert(entry["error"], Equals, "failed")
+}
+
+// Test messages below the logger's level being dropped
+func (s *LogSuite) TestLevel(c *C) {
+	var buf bytes.Buffer
+	logger := NewTextLogger(&buf, LevelWarn)
+
+	logger.Debug("debug")
+	logger.Info("info")
+	c.Assert(buf.Len(), Equals, 0)
+
+	logger.Warn("warn")
+	c.Assert(strings.Contains(buf.String(), " WARN warn"), Equals, true)
+}
+
+// Test fields added by With applying to derived loggers only
+func (s *LogSuite) TestWith(c *C) {
+	var buf bytes.Buffer
+	logger := NewTextLogger(&buf, LevelInfo)
+	build := logger.With("build", "abc123")
+	build.With("phase", PhaseBuildImage).Info("started")
+	logger.Info("plain")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	c.Assert(strings.HasSuffix(lines[0], "started build=abc123 phase=build-image"), Equals, true)
+	c.Assert(strings.HasSuffix(lines[1], "INFO plain"), Equals, true)
+}
+
+// Test the default logger of a request following its debug setting
+func (s *LogSuite) TestRequestLogger(c *C) {
+	var buf bytes.Buffer
+	custom := NewTextLogger(&buf, LevelInfo)
+	c.Assert(Request{Logger: custom}.logger(), Equals, custom)
+	c.Assert(Request{Debug: true}.logger().(*streamLogger).level, Equals, LevelDebug)
+	c.Assert(Request{}.logger().(*streamLogger).level, Equals, LevelInfo)
+}
@@ -0,0 +1,219 @@
+package sti
+
+import (
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// Labels recording the provenance of images built by sti.  The docker remote API
+// used by sti has no native support for image labels, so labels are stored as
+// environment variables in the configuration of the output image.  The environment
+// and sparse paths of a build are URL query encoded, so that they fit on a line of a
+// Dockerfile.
+const (
+	LabelBuildTag          = "STI_BUILD_TAG"
+	LabelBuildSource       = "STI_BUILD_SOURCE"
+	LabelBuildCommit       = "STI_BUILD_COMMIT"
+	LabelBuildDirty        = "STI_BUILD_DIRTY"
+	LabelBuildContextDir   = "STI_BUILD_CONTEXT_DIR"
+	LabelBuildBuilderImage = "STI_BUILD_BUILDER_IMAGE"
+	LabelBuildRuntimeImage = "STI_BUILD_RUNTIME_IMAGE"
+	LabelBuildMethod       = "STI_BUILD_METHOD"
+	LabelBuildIncremental  = "STI_BUILD_INCREMENTAL"
+	LabelBuildVersion      = "STI_BUILD_VERSION"
+
+	// Inputs of the build, recorded so that it can be repeated by Rebuild
+	LabelBuildBuilderName      = "STI_BUILD_BUILDER_NAME"
+	LabelBuildRuntimeName      = "STI_BUILD_RUNTIME_NAME"
+	LabelBuildRef              = "STI_BUILD_REF"
+	LabelBuildEnvironment      = "STI_BUILD_ENV"
+	LabelBuildCopyMode         = "STI_BUILD_COPY_MODE"
+	LabelBuildWorkingTree      = "STI_BUILD_WORKING_TREE"
+	LabelBuildExcludeUntracked = "STI_BUILD_EXCLUDE_UNTRACKED"
+	LabelBuildCloneDepth       = "STI_BUILD_CLONE_DEPTH"
+	LabelBuildSubmodules       = "STI_BUILD_SUBMODULES"
+	LabelBuildSparsePaths      = "STI_BUILD_SPARSE_PATHS"
+)
+
+// BuildMetadata describes how an image was produced by sti.
+type BuildMetadata struct {
+	Tag          string
+	Source       string
+	Commit       string
+	Dirty        bool
+	ContextDir   string
+	BuilderImage string
+	RuntimeImage string
+	Method       string
+	Incremental  bool
+	Version      string
+
+	// Names the build and runtime images were given by, as opposed to their IDs
+	BuilderName string
+	RuntimeName string
+	// Inputs of the build request
+	Ref              string
+	Environment      map[string]string
+	CopyMode         string
+	WorkingTree      bool
+	ExcludeUntracked bool
+	CloneDepth       int
+	Submodules       bool
+	SparsePaths      []string
+}
+
+// Returns the labels to stamp on an image built with this metadata.  Every label is
+// returned, with an empty value for empty fields, so that labels inherited from an
+// image the build image was itself built from by sti are overridden.
+func (m *BuildMetadata) labels() map[string]string {
+	labels := map[string]string{
+		LabelBuildTag:          m.Tag,
+		LabelBuildSource:       m.Source,
+		LabelBuildCommit:       m.Commit,
+		LabelBuildDirty:        strconv.FormatBool(m.Dirty),
+		LabelBuildContextDir:   m.ContextDir,
+		LabelBuildBuilderImage: m.BuilderImage,
+		LabelBuildRuntimeImage: m.RuntimeImage,
+		LabelBuildMethod:       m.Method,
+		LabelBuildIncremental:  strconv.FormatBool(m.Incremental),
+		LabelBuildVersion:      m.Version,
+
+		LabelBuildBuilderName:      m.BuilderName,
+		LabelBuildRuntimeName:      m.RuntimeName,
+		LabelBuildRef:              m.Ref,
+		LabelBuildCopyMode:         m.CopyMode,
+		LabelBuildWorkingTree:      strconv.FormatBool(m.WorkingTree),
+		LabelBuildExcludeUntracked: strconv.FormatBool(m.ExcludeUntracked),
+		LabelBuildCloneDepth:       strconv.Itoa(m.CloneDepth),
+		LabelBuildSubmodules:       strconv.FormatBool(m.Submodules),
+		LabelBuildEnvironment:      "",
+		LabelBuildSparsePaths:      "",
+	}
+	if len(m.Environment) > 0 {
+		values := url.Values{}
+		for key, value := range m.Environment {
+			values.Set(key, value)
+		}
+		labels[LabelBuildEnvironment] = values.Encode()
+	}
+	if len(m.SparsePaths) > 0 {
+		labels[LabelBuildSparsePaths] = url.Values{"path": m.SparsePaths}.Encode()
+	}
+
+	return labels
+}
+
+// Returns the build metadata recorded in a set of labels, or nil if the labels do
+// not describe an sti build.
+func metadataFromLabels(labels map[string]string) *BuildMetadata {
+	version, ok := labels[LabelBuildVersion]
+	if !ok {
+		return nil
+	}
+
+	dirty, _ := strconv.ParseBool(labels[LabelBuildDirty])
+	incremental, _ := strconv.ParseBool(labels[LabelBuildIncremental])
+	workingTree, _ := strconv.ParseBool(labels[LabelBuildWorkingTree])
+	excludeUntracked, _ := strconv.ParseBool(labels[LabelBuildExcludeUntracked])
+	submodules, _ := strconv.ParseBool(labels[LabelBuildSubmodules])
+	cloneDepth, _ := strconv.Atoi(labels[LabelBuildCloneDepth])
+
+	metadata := &BuildMetadata{
+		Tag:          labels[LabelBuildTag],
+		Source:       labels[LabelBuildSource],
+		Commit:       labels[LabelBuildCommit],
+		Dirty:        dirty,
+		ContextDir:   labels[LabelBuildContextDir],
+		BuilderImage: labels[LabelBuildBuilderImage],
+		RuntimeImage: labels[LabelBuildRuntimeImage],
+		Method:       labels[LabelBuildMethod],
+		Incremental:  incremental,
+		Version:      version,
+
+		BuilderName:      labels[LabelBuildBuilderName],
+		RuntimeName:      labels[LabelBuildRuntimeName],
+		Ref:              labels[LabelBuildRef],
+		CopyMode:         labels[LabelBuildCopyMode],
+		WorkingTree:      workingTree,
+		ExcludeUntracked: excludeUntracked,
+		CloneDepth:       cloneDepth,
+		Submodules:       submodules,
+	}
+	if values, err := url.ParseQuery(labels[LabelBuildEnvironment]); err == nil && len(values) > 0 {
+		metadata.Environment = make(map[string]string)
+		for key := range values {
+			metadata.Environment[key] = values.Get(key)
+		}
+	}
+	if values, err := url.ParseQuery(labels[LabelBuildSparsePaths]); err == nil {
+		metadata.SparsePaths = values["path"]
+	}
+
+	return metadata
+}
+
+// Returns the labels recorded on an image.
+func imageLabels(image *docker.Image) map[string]string {
+	labels := make(map[string]string)
+	if image.Config == nil {
+		return labels
+	}
+
+	for _, env := range image.Config.Env {
+		atoms := strings.SplitN(env, "=", 2)
+		if len(atoms) == 2 {
+			labels[atoms[0]] = atoms[1]
+		}
+	}
+
+	return labels
+}
+
+// Quotes a label value for an ENV instruction of a Dockerfile, which expands
+// variables and removes quotes, so that empty values are kept.
+func quoteEnvValue(value string) string {
+	return `"` + envValueEscaper.Replace(value) + `"`
+}
+
+var envValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`)
+
+// Converts labels to environment entries, sorted by name.
+func labelsToEnv(labels map[string]string) []string {
+	env := make([]string, 0, len(labels))
+	for key, value := range labels {
+		env = append(env, key+"="+value)
+	}
+	sort.Strings(env)
+
+	return env
+}
+
+// Describes a request to read the build metadata of an image.
+type InspectRequest struct {
+	Request
+	Tag string
+}
+
+// Inspect returns the build metadata recorded on the image with the requested tag.
+func Inspect(req InspectRequest) (*BuildMetadata, error) {
+	h, err := newHandler(req.Request)
+	if err != nil {
+		return nil, err
+	}
+
+	image, err := h.dockerClient.InspectImage(req.Tag)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := metadataFromLabels(imageLabels(image))
+	if metadata == nil {
+		return nil, ErrNoBuildMetadata
+	}
+
+	return metadata, nil
+}
@@ -0,0 +1,83 @@
+package sti
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+	. "launchpad.net/gocheck"
+)
+
+type MetadataSuite struct{}
+
+var _ = Suite(&MetadataSuite{})
+
+func imageWithEnv(env []string) *docker.Image {
+	return &docker.Image{Config: &docker.Config{Env: env}}
+}
+
+func (s *MetadataSuite) TestRoundTrip(c *C) {
+	metadata := &BuildMetadata{
+		Tag:              "test/app",
+		Source:           "git://github.com/pmorie/simple-html",
+		Commit:           "0123456789abcdef0123456789abcdef01234567",
+		Dirty:            true,
+		ContextDir:       "site",
+		BuilderImage:     "1234",
+		RuntimeImage:     "5678",
+		Method:           "run",
+		Incremental:      true,
+		Version:          "0.1",
+		BuilderName:      "pmorie/sti-fake-builder",
+		RuntimeName:      "pmorie/sti-fake",
+		Ref:              "v1",
+		Environment:      map[string]string{"GREETING": "hello \"world\"", "EMPTY": ""},
+		CopyMode:         CopyModeLink,
+		WorkingTree:      true,
+		ExcludeUntracked: true,
+		CloneDepth:       1,
+		Submodules:       true,
+		SparsePaths:      []string{"site", "lib/a b"},
+	}
+
+	read := metadataFromLabels(imageLabels(imageWithEnv(labelsToEnv(metadata.labels()))))
+	c.Assert(read, DeepEquals, metadata)
+}
+
+func (s *MetadataSuite) TestEmptyFieldsOverrideInherited(c *C) {
+	inherited := (&BuildMetadata{
+		Tag:          "test/base",
+		ContextDir:   "site",
+		RuntimeImage: "5678",
+		RuntimeName:  "pmorie/sti-fake",
+		Ref:          "v1",
+		Environment:  map[string]string{"GREETING": "hello"},
+		CloneDepth:   1,
+		SparsePaths:  []string{"site"},
+		Version:      "0.1",
+	}).labels()
+	metadata := &BuildMetadata{Tag: "test/app", Version: "0.1"}
+
+	// later entries of an image's environment override earlier ones
+	env := append(labelsToEnv(inherited), labelsToEnv(metadata.labels())...)
+	read := metadataFromLabels(imageLabels(imageWithEnv(env)))
+	c.Assert(read, DeepEquals, metadata)
+}
+
+func (s *MetadataSuite) TestDockerfileLabels(c *C) {
+	var buf bytes.Buffer
+	err := dockerFileTemplate.Execute(&buf, dockerFileData{
+		BaseImage: "pmorie/sti-fake",
+		Labels:    map[string]string{LabelBuildRef: "", LabelBuildSource: `/src/"$HOME"\app`},
+	})
+	c.Assert(err, IsNil)
+
+	dockerfile := buf.String()
+	c.Assert(strings.Contains(dockerfile, "ENV STI_BUILD_REF=\"\"\n"), Equals, true)
+	c.Assert(strings.Contains(dockerfile, `ENV STI_BUILD_SOURCE="/src/\"\$HOME\"\\app"`+"\n"), Equals, true)
+}
+
+func (s *MetadataSuite) TestNoMetadata(c *C) {
+	c.Assert(metadataFromLabels(imageLabels(imageWithEnv([]string{"PATH=/usr/bin"}))), IsNil)
+	c.Assert(metadataFromLabels(imageLabels(&docker.Image{})), IsNil)
+}
@@ -0,0 +1,272 @@
+package sti
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Results of builds, counted by sti_builds_total.
+const (
+	ResultSuccess   = "success"
+	ResultFailure   = "failure"
+	ResultError     = "error"
+	ResultCancelled = "cancelled"
+)
+
+var (
+	durationBuckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 120, 300, 600, 1800}
+	sizeBuckets     = []float64{1e3, 1e4, 1e5, 1e6, 1e7, 1e8, 1e9, 1e10}
+)
+
+// Metrics collects measurements of the builds of the requests that refer to it, and
+// writes them in the Prometheus text exposition format.
+type Metrics struct {
+	mu       sync.Mutex
+	families []*metricFamily
+	byName   map[string]*metricFamily
+}
+
+type metricFamily struct {
+	name    string
+	help    string
+	kind    string
+	buckets []float64
+	series  map[string]*metricSeries
+}
+
+// A value of a metric family, for one set of labels.
+type metricSeries struct {
+	value  float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// NewMetrics returns an empty collection of build metrics.
+func NewMetrics() *Metrics {
+	m := &Metrics{byName: make(map[string]*metricFamily)}
+	m.register("sti_builds_total", "Builds finished, by result.", "counter", nil)
+	m.register("sti_build_duration_seconds", "Duration of builds.", "histogram", durationBuckets)
+	m.register("sti_phase_duration_seconds", "Duration of build phases, by phase.", "histogram", durationBuckets)
+	m.register("sti_incremental_builds_total", "Builds that were not clean, by whether an image to build incrementally on was found.", "counter", nil)
+	m.register("sti_artifact_bytes", "Size of the artifacts saved from previous builds.", "histogram", sizeBuckets)
+	m.register("sti_image_pull_duration_seconds", "Duration of image pulls.", "histogram", durationBuckets)
+	m.register("sti_queue_depth", "Builds waiting to start.", "gauge", nil)
+	m.register("sti_builds_active", "Builds in progress.", "gauge", nil)
+
+	return m
+}
+
+func (m *Metrics) register(name, help, kind string, buckets []float64) {
+	family := &metricFamily{name: name, help: help, kind: kind, buckets: buckets, series: make(map[string]*metricSeries)}
+	m.families = append(m.families, family)
+	m.byName[name] = family
+}
+
+// Returns the series of a family with the given labels, creating it if necessary.
+// The caller must hold the lock.
+func (m *Metrics) get(name string, labels []string) *metricSeries {
+	family := m.byName[name]
+	key := formatLabels(labels)
+	series, ok := family.series[key]
+	if !ok {
+		series = &metricSeries{counts: make([]uint64, len(family.buckets))}
+		family.series[key] = series
+	}
+
+	return series
+}
+
+// Adds delta to a counter; labels alternate names and values.
+func (m *Metrics) add(name string, delta float64, labels ...string) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(name, labels).value += delta
+}
+
+// Sets a gauge.
+func (m *Metrics) set(name string, value float64, labels ...string) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(name, labels).value = value
+}
+
+// Records a value in a histogram.
+func (m *Metrics) observe(name string, value float64, labels ...string) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	series := m.get(name, labels)
+	for i, bound := range m.byName[name].buckets {
+		if value <= bound {
+			series.counts[i]++
+		}
+	}
+	series.sum += value
+	series.count++
+}
+
+// Records the measurements carried by a build event.
+func (m *Metrics) event(event BuildEvent) {
+	switch event.Kind {
+	case EventPhaseFinished:
+		m.observe("sti_phase_duration_seconds", event.Duration.Seconds(), "phase", event.Phase)
+	case EventImagePulled:
+		m.observe("sti_image_pull_duration_seconds", event.Duration.Seconds())
+	case EventArtifactsSaved:
+		m.observe("sti_artifact_bytes", float64(event.Bytes))
+	}
+}
+
+// Records a finished build.
+func (m *Metrics) build(result *BuildResult, err error, duration time.Duration) {
+	outcome := ResultSuccess
+	switch {
+	case err == ErrBuildCancelled:
+		outcome = ResultCancelled
+	case err == ErrBuildFailed || (err == nil && (result == nil || !result.Success)):
+		outcome = ResultFailure
+	case err != nil:
+		outcome = ResultError
+	}
+
+	m.add("sti_builds_total", 1, "result", outcome)
+	m.observe("sti_build_duration_seconds", duration.Seconds())
+}
+
+// Records whether a build that was not clean found an image to build incrementally on.
+func (m *Metrics) incremental(hit bool) {
+	m.add("sti_incremental_builds_total", 1, "hit", strconv.FormatBool(hit))
+}
+
+// WriteTo writes the metrics to w in the Prometheus text exposition format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	out := &countingWriter{w: bufio.NewWriter(w)}
+	for _, family := range m.families {
+		fmt.Fprintf(out, "# HELP %s %s\n", family.name, family.help)
+		fmt.Fprintf(out, "# TYPE %s %s\n", family.name, family.kind)
+
+		keys := make([]string, 0, len(family.series))
+		for key := range family.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			series := family.series[key]
+			if family.kind != "histogram" {
+				fmt.Fprintf(out, "%s%s %s\n", family.name, key, formatValue(series.value))
+				continue
+			}
+
+			for i, bound := range family.buckets {
+				fmt.Fprintf(out, "%s_bucket%s %d\n", family.name, withLabel(key, "le", formatValue(bound)), series.counts[i])
+			}
+			fmt.Fprintf(out, "%s_bucket%s %d\n", family.name, withLabel(key, "le", "+Inf"), series.count)
+			fmt.Fprintf(out, "%s_sum%s %s\n", family.name, key, formatValue(series.sum))
+			fmt.Fprintf(out, "%s_count%s %d\n", family.name, key, series.count)
+		}
+	}
+
+	if out.err != nil {
+		return out.n, out.err
+	}
+	return out.n, out.w.(*bufio.Writer).Flush()
+}
+
+// WriteFile writes the metrics to the file at path, replacing it atomically, for
+// collection by the textfile collector of the Prometheus node exporter.
+func (m *Metrics) WriteFile(path string) error {
+	file, err := ioutil.TempFile(filepath.Dir(path), ".sti-metrics")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	_, err = m.WriteTo(file)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), path)
+}
+
+// Formats alternating label names and values as {name="value",...}.
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, labels[i]+"="+strconv.Quote(labels[i+1]))
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Adds a label to formatted labels.
+func withLabel(labels, name, value string) string {
+	label := name + "=" + strconv.Quote(value)
+	if labels == "" {
+		return "{" + label + "}"
+	}
+
+	return labels[:len(labels)-1] + "," + label + "}"
+}
+
+func formatValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// countingWriter counts the bytes written through it and remembers the first error.
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	w.err = err
+	return n, err
+}
@@ -0,0 +1,102 @@
+package sti
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "launchpad.net/gocheck"
+)
+
+type MetricsSuite struct{}
+
+var _ = Suite(&MetricsSuite{})
+
+func exposition(c *C, m *Metrics) string {
+	var buf bytes.Buffer
+	_, err := m.WriteTo(&buf)
+	c.Assert(err, IsNil)
+	return buf.String()
+}
+
+func assertLines(c *C, text string, lines ...string) {
+	for _, line := range lines {
+		c.Assert(strings.Contains(text, "\n"+line+"\n"), Equals, true, Commentf("missing %q in:\n%s", line, text))
+	}
+}
+
+// Test builds being counted by result, and their durations recorded
+func (s *MetricsSuite) TestBuilds(c *C) {
+	m := NewMetrics()
+	m.build(&BuildResult{Success: true}, nil, 2*time.Second)
+	m.build(&BuildResult{Success: true}, nil, 20*time.Second)
+	m.build(nil, ErrBuildFailed, time.Second)
+	m.build(nil, ErrPullImageFailed, time.Second)
+	m.build(nil, ErrBuildCancelled, time.Second)
+
+	assertLines(c, exposition(c, m),
+		"# TYPE sti_builds_total counter",
+		`sti_builds_total{result="success"} 2`,
+		`sti_builds_total{result="failure"} 1`,
+		`sti_builds_total{result="error"} 1`,
+		`sti_builds_total{result="cancelled"} 1`,
+		`sti_build_duration_seconds_bucket{le="1"} 3`,
+		`sti_build_duration_seconds_bucket{le="5"} 4`,
+		`sti_build_duration_seconds_bucket{le="30"} 5`,
+		`sti_build_duration_seconds_bucket{le="+Inf"} 5`,
+		`sti_build_duration_seconds_sum 25`,
+		`sti_build_duration_seconds_count 5`,
+	)
+}
+
+// Test phase durations, pulls and artifact sizes being recorded from build events
+func (s *MetricsSuite) TestEvents(c *C) {
+	m := NewMetrics()
+	h := requestHandler{log: NewTextLogger(ioutil.Discard, LevelError), metrics: m}
+
+	h.emit(BuildEvent{Kind: EventPhaseFinished, Phase: PhaseSaveArtifacts, Duration: 3 * time.Second})
+	h.emit(BuildEvent{Kind: EventImagePulled, Image: "builder", Duration: 40 * time.Second})
+	h.emit(BuildEvent{Kind: EventArtifactsSaved, Bytes: 5e6})
+	h.metrics.incremental(true)
+	h.metrics.incremental(false)
+	h.metrics.incremental(true)
+
+	assertLines(c, exposition(c, m),
+		`sti_phase_duration_seconds_bucket{phase="save-artifacts",le="1"} 0`,
+		`sti_phase_duration_seconds_bucket{phase="save-artifacts",le="5"} 1`,
+		`sti_phase_duration_seconds_count{phase="save-artifacts"} 1`,
+		`sti_image_pull_duration_seconds_bucket{le="30"} 0`,
+		`sti_image_pull_duration_seconds_bucket{le="60"} 1`,
+		`sti_artifact_bytes_bucket{le="1e+06"} 0`,
+		`sti_artifact_bytes_bucket{le="1e+07"} 1`,
+		`sti_artifact_bytes_sum 5e+06`,
+		`sti_incremental_builds_total{hit="false"} 1`,
+		`sti_incremental_builds_total{hit="true"} 2`,
+	)
+}
+
+// Test handlers without metrics recording nothing
+func (s *MetricsSuite) TestNoMetrics(c *C) {
+	var m *Metrics
+	m.build(nil, ErrBuildFailed, time.Second)
+	m.incremental(true)
+	m.event(BuildEvent{Kind: EventArtifactsSaved, Bytes: 10})
+}
+
+// Test metrics being written to a file for the textfile collector
+func (s *MetricsSuite) TestWriteFile(c *C) {
+	m := NewMetrics()
+	m.build(&BuildResult{Success: true}, nil, time.Second)
+
+	path := filepath.Join(c.MkDir(), "sti.prom")
+	c.Assert(m.WriteFile(path), IsNil)
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, exposition(c, m))
+
+	files, err := ioutil.ReadDir(filepath.Dir(path))
+	c.Assert(err, IsNil)
+	c.Assert(files, HasLen, 1)
+}
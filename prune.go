@@ -0,0 +1,185 @@
+package sti
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// Describes a request to remove the images of previous builds that are no longer
+// needed, and the stopped containers of sti runs.
+type PruneRequest struct {
+	Request
+	// Number of images to keep for each tag built, at least 1.  The images still
+	// carrying their tag are always kept, and count towards this number.
+	Keep int
+	// Only remove images and containers older than this.
+	OlderThan time.Duration
+	// Report what would be removed without removing anything.
+	DryRun bool
+}
+
+// Lists what was removed by Prune.
+type PruneResult struct {
+	Images     []string
+	Containers []string
+}
+
+// An image built by sti.
+type stiImage struct {
+	ID       string
+	RepoTags []string
+	Created  time.Time
+	// Tag the image was built as, which groups the images of previous builds
+	Tag string
+}
+
+// Determines whether the image still carries the tag it was built as.
+func (i stiImage) tagged() bool {
+	tag := normalizeTag(i.Tag)
+	for _, repoTag := range i.RepoTags {
+		if repoTag == tag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Determines whether the image carries any tag, such as one it was given after it
+// was built.
+func (i stiImage) named() bool {
+	for _, repoTag := range i.RepoTags {
+		if repoTag != "<none>:<none>" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Prune removes the images of previous builds of each tag, keeping the requested
+// number of the most recent ones, and the stopped containers created by sti.  Images
+// built by sti are identified by their build metadata, and grouped by the tag they
+// were built as; the -build images of extended builds, recorded as built as
+// <tag>-build, are kept apart from the images of their application.
+func Prune(req PruneRequest) (*PruneResult, error) {
+	h, err := newHandler(req.Request)
+	if err != nil {
+		return nil, err
+	}
+
+	cutoff := time.Now().Add(-req.OlderThan)
+	result := &PruneResult{}
+
+	result.Containers, err = h.removeStoppedContainers(cutoff, req.DryRun)
+	if err != nil {
+		return nil, err
+	}
+
+	images, err := h.stiImages()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, image := range prunableImages(images, req.Keep, cutoff) {
+		h.log.Debug("Removing image", "image", image.ID, "tag", image.Tag)
+		if !req.DryRun {
+			err = h.dockerClient.RemoveImage(image.ID)
+			if err != nil {
+				h.log.Warn("Unable to remove image", "image", image.ID, "tag", image.Tag, "error", err)
+				continue
+			}
+		}
+		result.Images = append(result.Images, image.ID)
+	}
+
+	return result, nil
+}
+
+// Lists the images built by sti.
+func (h requestHandler) stiImages() ([]stiImage, error) {
+	images, err := h.dockerClient.ListImages(false)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []stiImage
+	for _, apiImage := range images {
+		image := stiImage{ID: apiImage.ID, RepoTags: apiImage.RepoTags, Created: time.Unix(apiImage.Created, 0)}
+
+		inspected, err := h.dockerClient.InspectImage(apiImage.ID)
+		if err != nil {
+			h.log.Debug("Unable to inspect image", "image", apiImage.ID, "error", err)
+			continue
+		}
+
+		metadata := metadataFromLabels(imageLabels(inspected))
+		if metadata == nil || metadata.Tag == "" {
+			continue
+		}
+
+		image.Tag = metadata.Tag
+		result = append(result, image)
+	}
+
+	return result, nil
+}
+
+// Returns the images to remove so that no more than keep images remain for each tag,
+// keeping the images that carry their tag, then the most recent, and all images
+// created after cutoff or carrying other tags.
+func prunableImages(images []stiImage, keep int, cutoff time.Time) []stiImage {
+	if keep < 1 {
+		keep = 1
+	}
+
+	byTag := make(map[string][]stiImage)
+	var tags []string
+	for _, image := range images {
+		tag := normalizeTag(image.Tag)
+		if _, ok := byTag[tag]; !ok {
+			tags = append(tags, tag)
+		}
+		byTag[tag] = append(byTag[tag], image)
+	}
+	sort.Strings(tags)
+
+	var prunable []stiImage
+	for _, tag := range tags {
+		group := byTag[tag]
+		sort.Sort(byPreference(group))
+
+		for i, image := range group {
+			if i < keep || image.named() || image.Created.After(cutoff) {
+				continue
+			}
+			prunable = append(prunable, image)
+		}
+	}
+
+	return prunable
+}
+
+// Sorts images with those carrying their tag first, then the most recent first.
+type byPreference []stiImage
+
+func (p byPreference) Len() int      { return len(p) }
+func (p byPreference) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p byPreference) Less(i, j int) bool {
+	if p[i].tagged() != p[j].tagged() {
+		return p[i].tagged()
+	}
+
+	return p[i].Created.After(p[j].Created)
+}
+
+// Returns a tag in the form docker lists repository tags in, with the latest tag if
+// it has none.
+func normalizeTag(tag string) string {
+	if strings.LastIndex(tag, ":") > strings.LastIndex(tag, "/") {
+		return tag
+	}
+
+	return tag + ":latest"
+}
@@ -0,0 +1,80 @@
+package sti
+
+import (
+	"time"
+
+	. "launchpad.net/gocheck"
+)
+
+type PruneSuite struct{}
+
+var _ = Suite(&PruneSuite{})
+
+func imageIDs(images []stiImage) []string {
+	ids := []string{}
+	for _, image := range images {
+		ids = append(ids, image.ID)
+	}
+
+	return ids
+}
+
+// Test pruning keeping the most recent images of each tag
+func (s *PruneSuite) TestPrunableImages(c *C) {
+	now := time.Now()
+	images := []stiImage{
+		{ID: "app1", Tag: "app", Created: now.Add(-3 * time.Hour)},
+		{ID: "app3", Tag: "app", Created: now.Add(-1 * time.Hour), RepoTags: []string{"app:latest"}},
+		{ID: "app2", Tag: "app", Created: now.Add(-2 * time.Hour)},
+		{ID: "build1", Tag: "app-build", Created: now.Add(-3 * time.Hour)},
+		{ID: "build2", Tag: "app-build", Created: now.Add(-2 * time.Hour), RepoTags: []string{"app-build:latest"}},
+		{ID: "other1", Tag: "registry:5000/other:v1", Created: now.Add(-2 * time.Hour), RepoTags: []string{"registry:5000/other:v1"}},
+	}
+
+	c.Assert(imageIDs(prunableImages(images, 1, now)), DeepEquals, []string{"build1", "app2", "app1"})
+	c.Assert(imageIDs(prunableImages(images, 0, now)), DeepEquals, []string{"build1", "app2", "app1"})
+	c.Assert(imageIDs(prunableImages(images, 2, now)), DeepEquals, []string{"app1"})
+	c.Assert(imageIDs(prunableImages(images, 3, now)), DeepEquals, []string{})
+}
+
+// Test pruning keeping the image that carries its tag, even if it is not the most recent
+func (s *PruneSuite) TestPrunableImagesKeepsTagged(c *C) {
+	now := time.Now()
+	images := []stiImage{
+		{ID: "new", Tag: "app:v2", Created: now.Add(-1 * time.Hour)},
+		{ID: "old", Tag: "app:v2", Created: now.Add(-2 * time.Hour), RepoTags: []string{"app:v2"}},
+	}
+
+	c.Assert(imageIDs(prunableImages(images, 1, now)), DeepEquals, []string{"new"})
+}
+
+// Test pruning keeping images given other tags
+func (s *PruneSuite) TestPrunableImagesKeepsNamed(c *C) {
+	now := time.Now()
+	images := []stiImage{
+		{ID: "app3", Tag: "app", Created: now.Add(-1 * time.Hour), RepoTags: []string{"app:latest"}},
+		{ID: "app2", Tag: "app", Created: now.Add(-2 * time.Hour), RepoTags: []string{"app:release"}},
+		{ID: "app1", Tag: "app", Created: now.Add(-3 * time.Hour), RepoTags: []string{"<none>:<none>"}},
+	}
+
+	c.Assert(imageIDs(prunableImages(images, 1, now)), DeepEquals, []string{"app1"})
+}
+
+// Test pruning keeping images created after the cutoff
+func (s *PruneSuite) TestPrunableImagesOlderThan(c *C) {
+	now := time.Now()
+	images := []stiImage{
+		{ID: "app3", Tag: "app", Created: now.Add(-1 * time.Minute), RepoTags: []string{"app:latest"}},
+		{ID: "app2", Tag: "app", Created: now.Add(-2 * time.Minute)},
+		{ID: "app1", Tag: "app", Created: now.Add(-2 * time.Hour)},
+	}
+
+	c.Assert(imageIDs(prunableImages(images, 1, now.Add(-time.Hour))), DeepEquals, []string{"app1"})
+}
+
+func (s *PruneSuite) TestNormalizeTag(c *C) {
+	c.Assert(normalizeTag("app"), Equals, "app:latest")
+	c.Assert(normalizeTag("app:v1"), Equals, "app:v1")
+	c.Assert(normalizeTag("registry:5000/app"), Equals, "registry:5000/app:latest")
+	c.Assert(normalizeTag("registry:5000/app:v1"), Equals, "registry:5000/app:v1")
+}
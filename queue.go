@@ -0,0 +1,225 @@
+package sti
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// QueuedBuild is a build submitted to a Queue.
+type QueuedBuild struct {
+	Request  BuildRequest
+	Priority int
+
+	key      string
+	done     chan struct{}
+	started  time.Time
+	finished time.Time
+	result   *BuildResult
+	err      error
+}
+
+// Done returns a channel that is closed when the build finishes.
+func (b *QueuedBuild) Done() <-chan struct{} {
+	return b.done
+}
+
+// Wait waits for the build to finish and returns its result.
+func (b *QueuedBuild) Wait() (*BuildResult, error) {
+	<-b.done
+	return b.result, b.err
+}
+
+// Queue performs builds with bounded concurrency.  Queued builds start in order of
+// priority, highest first, and in order of submission within a priority.  A build
+// submitted while an identical build is still queued is coalesced with it, so that
+// repeated requests do not cause repeated builds.  Requests are identical if their
+// JSON encodings are: every setting counts, but not the writer, cancellation,
+// events, logger, metrics or tracer of the request.
+type Queue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending []*QueuedBuild
+	active  int
+	closed  bool
+
+	// performs builds; Build unless replaced
+	build func(BuildRequest) (*BuildResult, error)
+}
+
+// NewQueue returns a Queue performing at most concurrency builds at once.
+func NewQueue(concurrency int) *Queue {
+	return newQueue(concurrency, Build)
+}
+
+func newQueue(concurrency int, build func(BuildRequest) (*BuildResult, error)) *Queue {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	q := &Queue{build: build}
+	q.cond = sync.NewCond(&q.mu)
+	for i := 0; i < concurrency; i++ {
+		go q.worker()
+	}
+
+	return q
+}
+
+// Identifies builds that produce the same image: builds with the same settings, as
+// given by the JSON encoding of their requests, which leaves out the fields that do
+// not affect the image and encodes maps in the order of their keys.
+func coalesceKey(req BuildRequest) string {
+	// the fields of a BuildRequest that JSON cannot encode are left out of it
+	data, _ := json.Marshal(req)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Submit queues a build with the given priority and returns it.  If an equivalent
+// build is already queued, that build is returned instead, its priority raised to
+// the given priority if that is higher.
+func (q *Queue) Submit(req BuildRequest, priority int) *QueuedBuild {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	key := coalesceKey(req)
+	for i, queued := range q.pending {
+		if queued.key == key {
+			if priority > queued.Priority {
+				queued.Priority = priority
+				q.pending = append(q.pending[:i], q.pending[i+1:]...)
+				q.insert(queued)
+			}
+			return queued
+		}
+	}
+
+	build := &QueuedBuild{Request: req, Priority: priority, key: key, done: make(chan struct{})}
+	if q.closed {
+		build.err = ErrQueueClosed
+		close(build.done)
+		return build
+	}
+
+	q.insert(build)
+	q.cond.Signal()
+
+	return build
+}
+
+// Inserts a build into the pending list after every build of the same or higher
+// priority.
+func (q *Queue) insert(build *QueuedBuild) {
+	i := 0
+	for i < len(q.pending) && q.pending[i].Priority >= build.Priority {
+		i++
+	}
+
+	q.pending = append(q.pending, nil)
+	copy(q.pending[i+1:], q.pending[i:])
+	q.pending[i] = build
+}
+
+// Position returns the position of a build in the queue, counting from 1 for the next
+// build to start, or 0 if the build is no longer queued.
+func (q *Queue) Position(build *QueuedBuild) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for i, queued := range q.pending {
+		if queued == build {
+			return i + 1
+		}
+	}
+
+	return 0
+}
+
+// Started returns the time the build started, or the zero time if it has not.
+func (q *Queue) Started(build *QueuedBuild) time.Time {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return build.started
+}
+
+// Finished returns the time the build finished, or the zero time if it has not.
+func (q *Queue) Finished(build *QueuedBuild) time.Time {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return build.finished
+}
+
+// Remove removes a build that has not started from the queue, finishing it with
+// ErrBuildCancelled.  It returns false if the build is not queued.
+func (q *Queue) Remove(build *QueuedBuild) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for i, queued := range q.pending {
+		if queued == build {
+			q.pending = append(q.pending[:i], q.pending[i+1:]...)
+			build.err = ErrBuildCancelled
+			build.finished = time.Now()
+			close(build.done)
+			return true
+		}
+	}
+
+	return false
+}
+
+// Len returns the number of builds waiting to start.
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending)
+}
+
+// Active returns the number of builds in progress.
+func (q *Queue) Active() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.active
+}
+
+// Close stops the queue accepting builds.  Builds already queued are still performed.
+func (q *Queue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+// Performs queued builds until the queue is closed and empty.
+func (q *Queue) worker() {
+	for {
+		q.mu.Lock()
+		for len(q.pending) == 0 && !q.closed {
+			q.cond.Wait()
+		}
+
+		if len(q.pending) == 0 {
+			q.mu.Unlock()
+			return
+		}
+
+		build := q.pending[0]
+		q.pending = q.pending[1:]
+		build.started = time.Now()
+		q.active++
+		q.mu.Unlock()
+
+		result, err := q.build(build.Request)
+
+		q.mu.Lock()
+		build.result, build.err = result, err
+		build.finished = time.Now()
+		q.active--
+		q.mu.Unlock()
+
+		close(build.done)
+	}
+}
@@ -0,0 +1,118 @@
+package sti
+
+import (
+	"bytes"
+
+	. "launchpad.net/gocheck"
+)
+
+type QueueSuite struct {
+	queue   *Queue
+	started chan string
+	release chan bool
+}
+
+var _ = Suite(&QueueSuite{})
+
+func (s *QueueSuite) SetUpTest(c *C) {
+	started, release := make(chan string), make(chan bool)
+	s.started, s.release = started, release
+	s.queue = newQueue(1, func(req BuildRequest) (*BuildResult, error) {
+		select {
+		case started <- req.Tag:
+			<-release
+		case <-release:
+		}
+		return &BuildResult{Success: true}, nil
+	})
+}
+
+func (s *QueueSuite) TearDownTest(c *C) {
+	s.queue.Close()
+	close(s.release)
+}
+
+// Test that queued builds start in order of priority, then submission
+func (s *QueueSuite) TestPriority(c *C) {
+	s.queue.Submit(BuildRequest{Tag: "running"}, 0)
+	c.Assert(<-s.started, Equals, "running")
+
+	low := s.queue.Submit(BuildRequest{Tag: "low"}, 0)
+	high := s.queue.Submit(BuildRequest{Tag: "high"}, 5)
+	later := s.queue.Submit(BuildRequest{Tag: "later"}, 0)
+
+	c.Assert(s.queue.Position(high), Equals, 1)
+	c.Assert(s.queue.Position(low), Equals, 2)
+	c.Assert(s.queue.Position(later), Equals, 3)
+	c.Assert(s.queue.Len(), Equals, 3)
+	c.Assert(s.queue.Active(), Equals, 1)
+
+	for _, tag := range []string{"high", "low", "later"} {
+		s.release <- true
+		c.Assert(<-s.started, Equals, tag)
+	}
+}
+
+// Test that equivalent queued builds are coalesced, taking the higher priority
+func (s *QueueSuite) TestCoalescing(c *C) {
+	s.queue.Submit(BuildRequest{Tag: "running"}, 0)
+	c.Assert(<-s.started, Equals, "running")
+
+	other := s.queue.Submit(BuildRequest{Tag: "other"}, 1)
+	first := s.queue.Submit(BuildRequest{Tag: "app", Source: "git://example.com/app"}, 0)
+	second := s.queue.Submit(BuildRequest{Tag: "app", Source: "git://example.com/app"}, 2)
+	different := s.queue.Submit(BuildRequest{Tag: "app", Source: "git://example.com/fork"}, 0)
+
+	c.Assert(second, Equals, first)
+	c.Assert(different, Not(Equals), first)
+	c.Assert(s.queue.Position(first), Equals, 1)
+	c.Assert(s.queue.Position(other), Equals, 2)
+	c.Assert(s.queue.Len(), Equals, 3)
+}
+
+// Test that queued builds differing in any setting are not coalesced
+func (s *QueueSuite) TestCoalescingSettings(c *C) {
+	s.queue.Submit(BuildRequest{Tag: "running"}, 0)
+	c.Assert(<-s.started, Equals, "running")
+
+	base := BuildRequest{Tag: "app", Source: "git://example.com/app", Environment: map[string]string{"A": "1", "B": "2"}}
+	first := s.queue.Submit(base, 0)
+
+	same := base
+	same.Environment = map[string]string{"B": "2", "A": "1"}
+	same.Writer = &bytes.Buffer{}
+	same.Cancel = make(chan struct{})
+	c.Assert(s.queue.Submit(same, 0), Equals, first)
+
+	environment := base
+	environment.Environment = map[string]string{"A": "1", "B": "3"}
+	clean := base
+	clean.Clean = true
+	depth := base
+	depth.CloneDepth = 1
+	sparse := base
+	sparse.SparsePaths = []string{"app"}
+	workingTree := base
+	workingTree.WorkingTree = true
+	copyMode := base
+	copyMode.CopyMode = CopyModeLink
+
+	for _, req := range []BuildRequest{environment, clean, depth, sparse, workingTree, copyMode} {
+		c.Assert(s.queue.Submit(req, 0), Not(Equals), first)
+	}
+	c.Assert(s.queue.Len(), Equals, 7)
+}
+
+// Test that removed builds finish without running
+func (s *QueueSuite) TestRemove(c *C) {
+	s.queue.Submit(BuildRequest{Tag: "running"}, 0)
+	c.Assert(<-s.started, Equals, "running")
+
+	queued := s.queue.Submit(BuildRequest{Tag: "queued"}, 0)
+	c.Assert(s.queue.Remove(queued), Equals, true)
+	c.Assert(s.queue.Remove(queued), Equals, false)
+
+	_, err := queued.Wait()
+	c.Assert(err, Equals, ErrBuildCancelled)
+	c.Assert(s.queue.Len(), Equals, 0)
+}
@@ -0,0 +1,86 @@
+package sti
+
+import (
+	"io"
+)
+
+// RebuildRequest asks to build an image again, with the inputs recorded on it when it
+// was built.  The BaseImage and RuntimeImage of the request, if set, replace the
+// recorded build and runtime images, such as to rebuild with a newer builder.
+type RebuildRequest struct {
+	Request
+	// Tag of the image to rebuild, which the rebuilt image replaces
+	Tag string
+	// Branch, tag or commit of the git source to build instead of the recorded one,
+	// if set
+	Ref string
+	// Perform a clean build rather than an incremental one
+	Clean  bool
+	Writer io.Writer `json:"-"`
+
+	// Receives the progress of the build, if set.
+	Events func(BuildEvent) `json:"-"`
+}
+
+// Rebuild reads the build metadata recorded on the image with the requested tag and
+// builds the image again with the same inputs.  It returns ErrNoBuildMetadata if the
+// image was not built by sti.
+func Rebuild(req RebuildRequest) (*BuildResult, error) {
+	metadata, err := Inspect(InspectRequest{Request: req.Request, Tag: req.Tag})
+	if err != nil {
+		return nil, err
+	}
+
+	buildReq := rebuildRequest(req, metadata)
+	buildReq.Request.logger().Debug("Rebuilding image", "tag", req.Tag, "source", buildReq.Source,
+		"builder", buildReq.BaseImage, "runtime", buildReq.RuntimeImage, "ref", buildReq.Ref)
+
+	return Build(buildReq)
+}
+
+// Returns the request to build an image again with the inputs recorded in its
+// metadata, overridden by those of the rebuild request.
+func rebuildRequest(req RebuildRequest, metadata *BuildMetadata) BuildRequest {
+	buildReq := BuildRequest{
+		Request:          req.Request,
+		Source:           metadata.Source,
+		Tag:              req.Tag,
+		Clean:            req.Clean,
+		Environment:      metadata.Environment,
+		Method:           metadata.Method,
+		CopyMode:         metadata.CopyMode,
+		Writer:           req.Writer,
+		WorkingTree:      metadata.WorkingTree,
+		ExcludeUntracked: metadata.ExcludeUntracked,
+		CloneDepth:       metadata.CloneDepth,
+		Submodules:       metadata.Submodules,
+		SparsePaths:      metadata.SparsePaths,
+		Ref:              metadata.Ref,
+		ContextDir:       metadata.ContextDir,
+		Events:           req.Events,
+	}
+
+	// Images built before their names were recorded are rebuilt with the IDs of
+	// their build and runtime images
+	if buildReq.BaseImage == "" {
+		buildReq.BaseImage = firstNonEmpty(metadata.BuilderName, metadata.BuilderImage)
+	}
+	if buildReq.RuntimeImage == "" {
+		buildReq.RuntimeImage = firstNonEmpty(metadata.RuntimeName, metadata.RuntimeImage)
+	}
+	if req.Ref != "" {
+		buildReq.Ref = req.Ref
+	}
+
+	return buildReq
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+
+	return ""
+}
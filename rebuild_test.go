@@ -0,0 +1,105 @@
+package sti
+
+import (
+	. "launchpad.net/gocheck"
+)
+
+type RebuildSuite struct{}
+
+var _ = Suite(&RebuildSuite{})
+
+func recordedMetadata() *BuildMetadata {
+	return &BuildMetadata{
+		Tag:          "app",
+		Source:       "git://example.com/app.git",
+		Commit:       "0123abc",
+		BuilderImage: "1d0a9b",
+		RuntimeImage: "7f2c4e",
+		Method:       "run",
+		Version:      Version,
+
+		BuilderName:      "builder:1",
+		RuntimeName:      "runtime:1",
+		Ref:              "release",
+		Environment:      map[string]string{"MODE": "production & fast", "OPTS": "a=b c"},
+		CopyMode:         CopyModeLink,
+		CloneDepth:       1,
+		Submodules:       true,
+		SparsePaths:      []string{"app", "lib,shared"},
+		ContextDir:       "app",
+		WorkingTree:      false,
+		ExcludeUntracked: false,
+	}
+}
+
+// Test the inputs of a build surviving their round trip through labels
+func (s *RebuildSuite) TestLabelsRoundTrip(c *C) {
+	metadata := recordedMetadata()
+	labels := metadata.labels()
+
+	for _, env := range labelsToEnv(labels) {
+		c.Assert(env, Not(Matches), "(?s).*[\\n\"].*")
+	}
+	c.Assert(metadataFromLabels(labels), DeepEquals, metadata)
+}
+
+// Test the labels of a build without optional inputs
+func (s *RebuildSuite) TestLabelsWithoutInputs(c *C) {
+	labels := (&BuildMetadata{Source: "src", Version: Version}).labels()
+	for _, label := range []string{LabelBuildEnvironment, LabelBuildSparsePaths, LabelBuildRef} {
+		value, ok := labels[label]
+		c.Assert(ok, Equals, true, Commentf("missing label %s", label))
+		c.Assert(value, Equals, "", Commentf("unexpected value of label %s", label))
+	}
+	c.Assert(labels[LabelBuildCloneDepth], Equals, "0")
+
+	metadata := metadataFromLabels(labels)
+	c.Assert(metadata.Environment, IsNil)
+	c.Assert(metadata.SparsePaths, IsNil)
+}
+
+// Test a rebuild repeating the recorded inputs
+func (s *RebuildSuite) TestRebuildRequest(c *C) {
+	metadata := recordedMetadata()
+	req := rebuildRequest(RebuildRequest{Tag: "app:rebuilt"}, metadata)
+
+	c.Assert(req.Tag, Equals, "app:rebuilt")
+	c.Assert(req.Source, Equals, metadata.Source)
+	c.Assert(req.BaseImage, Equals, "builder:1")
+	c.Assert(req.RuntimeImage, Equals, "runtime:1")
+	c.Assert(req.Ref, Equals, "release")
+	c.Assert(req.Method, Equals, "run")
+	c.Assert(req.CopyMode, Equals, CopyModeLink)
+	c.Assert(req.Environment, DeepEquals, metadata.Environment)
+	c.Assert(req.CloneDepth, Equals, 1)
+	c.Assert(req.Submodules, Equals, true)
+	c.Assert(req.SparsePaths, DeepEquals, metadata.SparsePaths)
+	c.Assert(req.ContextDir, Equals, "app")
+	c.Assert(req.Clean, Equals, false)
+}
+
+// Test a rebuild overriding the builder, runtime image and ref
+func (s *RebuildSuite) TestRebuildRequestOverrides(c *C) {
+	req := rebuildRequest(RebuildRequest{
+		Request: Request{BaseImage: "builder:2", RuntimeImage: "runtime:2"},
+		Tag:     "app",
+		Ref:     "main",
+		Clean:   true,
+	}, recordedMetadata())
+
+	c.Assert(req.BaseImage, Equals, "builder:2")
+	c.Assert(req.RuntimeImage, Equals, "runtime:2")
+	c.Assert(req.Ref, Equals, "main")
+	c.Assert(req.Clean, Equals, true)
+}
+
+// Test rebuilding an image built before the names of its images were recorded
+func (s *RebuildSuite) TestRebuildRequestWithoutNames(c *C) {
+	metadata := recordedMetadata()
+	metadata.BuilderName = ""
+	metadata.RuntimeName = ""
+
+	req := rebuildRequest(RebuildRequest{Tag: "app"}, metadata)
+	c.Assert(req.BaseImage, Equals, "1d0a9b")
+	c.Assert(req.RuntimeImage, Equals, "7f2c4e")
+}
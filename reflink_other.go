@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package sti
+
+import (
+	"errors"
+	"os"
+)
+
+// Reflinks are only supported on linux; callers fall back to copying.
+func reflink(dst *os.File, src *os.File) error {
+	return errors.New("reflinks are not supported on this platform")
+}
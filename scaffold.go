@@ -0,0 +1,331 @@
+package sti
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// Describes a request to generate the skeleton of a new builder image.
+type ScaffoldRequest struct {
+	// Name of the builder image
+	Name string
+	// Directory to generate the skeleton in, which must not exist or be empty;
+	// defaults to Name
+	Dir string
+	// Image the builder image is built from
+	From string
+	// Generate a build image and a runtime image for extended builds, rather than a
+	// single builder image
+	Extended bool
+}
+
+// Lists the files generated by Scaffold, relative to its directory.
+type ScaffoldResult struct {
+	Dir   string
+	Files []string
+}
+
+// A file of a skeleton, with a template of its content.
+type scaffoldFile struct {
+	path     string
+	mode     os.FileMode
+	template string
+}
+
+// Scaffold generates the skeleton of a builder image: a Dockerfile declaring its
+// capabilities, stubs of its scripts, a sample application to test it with, and a
+// Makefile building, validating and testing it.  With Extended, it generates the
+// skeletons of a build image and a runtime image for extended builds.
+func Scaffold(req ScaffoldRequest) (*ScaffoldResult, error) {
+	if req.Name == "" || strings.ContainsAny(req.Name, " \t\n") {
+		return nil, ErrInvalidScaffoldName
+	}
+	if req.Dir == "" {
+		req.Dir = filepath.Base(req.Name)
+	}
+	if req.From == "" {
+		req.From = "centos"
+	}
+
+	entries, err := filepath.Glob(filepath.Join(req.Dir, "*"))
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) > 0 {
+		return nil, ErrScaffoldDirNotEmpty
+	}
+
+	files := builderScaffold
+	if req.Extended {
+		files = extendedScaffold
+	}
+
+	result := &ScaffoldResult{Dir: req.Dir}
+	for _, file := range files {
+		err = writeScaffoldFile(req, file)
+		if err != nil {
+			return nil, err
+		}
+		result.Files = append(result.Files, file.path)
+	}
+
+	return result, nil
+}
+
+func writeScaffoldFile(req ScaffoldRequest, file scaffoldFile) error {
+	path := filepath.Join(req.Dir, filepath.FromSlash(file.path))
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, file.mode)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	tmpl, err := template.New(file.path).Delims("[[", "]]").Parse(file.template)
+	if err != nil {
+		return err
+	}
+
+	return tmpl.Execute(out, req)
+}
+
+// Files of the skeleton of a builder image.
+var builderScaffold = []scaffoldFile{
+	{"Dockerfile", 0644, builderDockerfile},
+	{"bin/prepare", 0755, builderPrepare},
+	{"bin/run", 0755, builderRun},
+	{"bin/save-artifacts", 0755, builderSaveArtifacts},
+	{"bin/usage", 0755, builderUsage},
+	{"test/test-app/run.sh", 0755, testAppRun},
+	{"Makefile", 0644, builderMakefile},
+}
+
+// Files of the skeletons of a build image and a runtime image for extended builds.
+var extendedScaffold = []scaffoldFile{
+	{"builder/Dockerfile", 0644, extendedBuilderDockerfile},
+	{"builder/bin/prepare", 0755, extendedBuilderPrepare},
+	{"builder/bin/run", 0755, extendedBuilderRun},
+	{"builder/bin/save-artifacts", 0755, extendedBuilderSaveArtifacts},
+	{"builder/bin/usage", 0755, extendedBuilderUsage},
+	{"runtime/Dockerfile", 0644, runtimeDockerfile},
+	{"runtime/bin/prepare", 0755, runtimePrepare},
+	{"runtime/bin/run", 0755, builderRun},
+	{"runtime/bin/save-artifacts", 0755, runtimeSaveArtifacts},
+	{"test/test-app/run.sh", 0755, testAppRun},
+	{"Makefile", 0644, extendedMakefile},
+}
+
+// Templates of the files of skeletons, delimited by [[ ]] to leave shell and make
+// syntax alone.
+const (
+	builderDockerfile = `FROM [[.From]]
+
+# Capabilities of the image, read by sti; see "Declaring capabilities" in the sti
+# README.  The directories are the defaults, declared for reference.
+ENV STI_PROTOCOL_VERSION 1
+ENV STI_SCRIPTS_DIR /usr/bin
+ENV STI_SOURCE_DIR /usr/src
+ENV STI_ARTIFACTS_DIR /usr/artifacts
+ENV STI_INCREMENTAL true
+ENV STI_BUILD_METHODS build,run
+
+# TODO: install the tools needed to build and run applications
+
+ADD ./bin/ /usr/bin/
+`
+
+	builderPrepare = `#!/bin/sh -e
+#
+# Builds the application source in /usr/src and deploys it to /opt/app.  For
+# incremental builds, the artifacts saved from the previous build by save-artifacts
+# are in /usr/artifacts.
+
+if [ -d /usr/artifacts ] && [ -n "$(ls -A /usr/artifacts)" ]; then
+  echo "---> Restoring build artifacts"
+  mkdir -p /opt/app
+  cp -a /usr/artifacts/. /opt/app/
+fi
+
+echo "---> Installing application source"
+mkdir -p /opt/app
+cp -a /usr/src/. /opt/app/
+
+# TODO: build the application, such as by installing its dependencies
+`
+
+	builderRun = `#!/bin/sh -e
+#
+# Runs the application deployed to /opt/app by prepare.
+
+cd /opt/app
+
+# TODO: run the application the way the image expects to
+if [ -x ./run.sh ]; then
+  exec ./run.sh
+fi
+
+echo "The application has no run.sh script" >&2
+exit 1
+`
+
+	builderSaveArtifacts = `#!/bin/sh -e
+#
+# Runs in the image of the previous build, and saves the artifacts worth reusing in
+# the next build, such as downloaded dependencies, to /usr/artifacts.
+
+# TODO: save artifacts, for example:
+#   cp -a /opt/app/vendor /usr/artifacts/
+`
+
+	builderUsage = `#!/bin/sh
+#
+# Prints how to use the image, for sti usage and for images built with it that are
+# run with --help.
+
+cat <<EOF
+[[.Name]] builds and runs applications with sti:
+
+    sti build <source> [[.Name]] <application image>
+
+The source is deployed to /opt/app and run with its run.sh script.
+EOF
+`
+
+	testAppRun = `#!/bin/sh
+#
+# A sample application, built by make test.
+
+echo "Hello from the test application"
+`
+
+	builderMakefile = `IMAGE = [[.Name]]
+
+.PHONY: build test
+
+build:
+	docker build -t $(IMAGE) .
+
+test: build
+	sti validate $(IMAGE) --incremental
+	sti build test/test-app $(IMAGE) $(IMAGE)-test-app
+	docker run --rm $(IMAGE)-test-app
+`
+
+	extendedBuilderDockerfile = `FROM [[.From]]
+
+# Capabilities of the image, read by sti; see "Declaring capabilities" in the sti
+# README.  The directories are the defaults, declared for reference.
+ENV STI_PROTOCOL_VERSION 1
+ENV STI_SCRIPTS_DIR /usr/bin
+ENV STI_SOURCE_DIR /usr/src
+ENV STI_ARTIFACTS_DIR /usr/artifacts
+ENV STI_OUTPUT_DIR /usr/build
+ENV STI_INCREMENTAL true
+
+# TODO: install the tools needed to build applications
+
+ADD ./bin/ /usr/bin/
+`
+
+	extendedBuilderPrepare = `#!/bin/sh -e
+#
+# Builds the application source in /usr/src and places the result in /usr/build,
+# from which the runtime image deploys it.  For incremental builds, the artifacts
+# saved from the previous build by save-artifacts are in /usr/artifacts.
+
+mkdir -p /opt/cache
+if [ -d /usr/artifacts ] && [ -n "$(ls -A /usr/artifacts)" ]; then
+  echo "---> Restoring build artifacts"
+  cp -a /usr/artifacts/. /opt/cache/
+fi
+
+echo "---> Building application source"
+cp -a /usr/src/. /usr/build/
+
+# TODO: build the application, keeping reusable artifacts such as downloaded
+# dependencies in /opt/cache
+`
+
+	extendedBuilderRun = `#!/bin/sh
+#
+# The build image is not meant to be run; prints its usage.
+
+exec /usr/bin/usage
+`
+
+	extendedBuilderSaveArtifacts = `#!/bin/sh -e
+#
+# Runs in the image of the previous build, and saves the artifacts worth reusing in
+# the next build, kept in /opt/cache by prepare, to /usr/artifacts.
+
+if [ -d /opt/cache ]; then
+  cp -a /opt/cache/. /usr/artifacts/
+fi
+`
+
+	extendedBuilderUsage = `#!/bin/sh
+#
+# Prints how to use the image, for sti usage and for images built with it that are
+# run with --help.
+
+cat <<EOF
+[[.Name]] builds applications with sti, to run on [[.Name]]-runtime:
+
+    sti build <source> [[.Name]] <application image> -R [[.Name]]-runtime
+
+The built application is deployed to /opt/app and run with its run.sh script.
+EOF
+`
+
+	runtimeDockerfile = `FROM [[.From]]
+
+# Capabilities of the image, read by sti; see "Declaring capabilities" in the sti
+# README.  The directories are the defaults, declared for reference.
+ENV STI_PROTOCOL_VERSION 1
+ENV STI_SCRIPTS_DIR /usr/bin
+ENV STI_SOURCE_DIR /usr/src
+ENV STI_BUILD_METHODS build,run
+
+# TODO: install the tools needed to run applications
+
+ADD ./bin/ /usr/bin/
+`
+
+	runtimePrepare = `#!/bin/sh -e
+#
+# Deploys the application built by the build image, in /usr/src, to /opt/app.
+
+echo "---> Deploying application"
+mkdir -p /opt/app
+cp -a /usr/src/. /opt/app/
+`
+
+	runtimeSaveArtifacts = `#!/bin/sh -e
+#
+# Saves artifacts of the deployed application to /usr/artifacts.  sti validate -R
+# validates the runtime image for incremental builds; the artifacts reused by builds
+# are saved by the build image's save-artifacts, so this saves nothing by default.
+
+# TODO: save artifacts of the deployed application, if any
+`
+
+	extendedMakefile = `IMAGE = [[.Name]]
+
+.PHONY: build test
+
+build:
+	docker build -t $(IMAGE) builder
+	docker build -t $(IMAGE)-runtime runtime
+
+test: build
+	sti validate $(IMAGE) -R $(IMAGE)-runtime
+	sti build test/test-app $(IMAGE) $(IMAGE)-test-app -R $(IMAGE)-runtime
+	docker run --rm $(IMAGE)-test-app
+`
+)
@@ -0,0 +1,140 @@
+package sti
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	. "launchpad.net/gocheck"
+)
+
+type ScaffoldSuite struct{}
+
+var _ = Suite(&ScaffoldSuite{})
+
+// Reads the capabilities a generated Dockerfile declares with ENV instructions.
+func dockerfileCapabilities(c *C, path string) *Capabilities {
+	content, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+
+	labels := map[string]string{}
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 3 && fields[0] == "ENV" {
+			labels[fields[1]] = fields[2]
+		}
+	}
+
+	caps, problems := capabilitiesFromLabels(labels)
+	c.Assert(problems, HasLen, 0)
+
+	return caps
+}
+
+// Checks the scripts of a generated image the way sti validate does, with the
+// contents of its bin directory in its scripts directory: for incremental builds when
+// incremental is set, and with a usage script when usage is.
+func (s *ScaffoldSuite) assertValidImage(c *C, dir string, incremental bool, usage bool) {
+	caps := dockerfileCapabilities(c, filepath.Join(dir, "Dockerfile"))
+	if caps.declares(LabelIncremental) {
+		c.Assert(caps.Incremental, Equals, incremental)
+	}
+
+	image := fakeImage{"/bin/sh": fakeFile(0755, "\x7fELF")}
+	bins, err := ioutil.ReadDir(filepath.Join(dir, "bin"))
+	c.Assert(err, IsNil)
+	for _, bin := range bins {
+		content, err := ioutil.ReadFile(filepath.Join(dir, "bin", bin.Name()))
+		c.Assert(err, IsNil)
+		image[caps.script(bin.Name())] = fakeFile(int64(bin.Mode().Perm()), string(content))
+
+		err = exec.Command("/bin/sh", "-n", filepath.Join(dir, "bin", bin.Name())).Run()
+		c.Assert(err, IsNil, Commentf("%s is not a valid shell script", bin.Name()))
+	}
+
+	scripts := []string{"prepare", "run"}
+	if incremental {
+		scripts = append(scripts, "save-artifacts")
+	}
+	if usage {
+		scripts = append(scripts, "usage")
+	}
+	for _, script := range scripts {
+		checks, err := checkScript(caps.script(script), image.lookup, defaultPath)
+		c.Assert(err, IsNil)
+		for _, check := range checks {
+			c.Assert(check.Status, Equals, CheckPassed, Commentf("%s", check))
+		}
+	}
+}
+
+func (s *ScaffoldSuite) TestBuilder(c *C) {
+	dir := filepath.Join(c.MkDir(), "ruby")
+	res, err := Scaffold(ScaffoldRequest{Name: "example/ruby", Dir: dir, From: "centos"})
+	c.Assert(err, IsNil)
+	c.Assert(res.Files, HasLen, len(builderScaffold))
+
+	s.assertValidImage(c, dir, true, true)
+
+	dockerfile, _ := ioutil.ReadFile(filepath.Join(dir, "Dockerfile"))
+	c.Assert(strings.HasPrefix(string(dockerfile), "FROM centos\n"), Equals, true)
+	c.Assert(strings.Contains(string(dockerfile), "ENTRYPOINT"), Equals, false)
+
+	makefile, _ := ioutil.ReadFile(filepath.Join(dir, "Makefile"))
+	c.Assert(strings.Contains(string(makefile), "IMAGE = example/ruby\n"), Equals, true)
+	c.Assert(strings.Contains(string(makefile), "\n\tsti validate $(IMAGE) --incremental\n"), Equals, true)
+
+	info, err := os.Stat(filepath.Join(dir, "test", "test-app", "run.sh"))
+	c.Assert(err, IsNil)
+	c.Assert(info.Mode().Perm(), Equals, os.FileMode(0755))
+}
+
+func (s *ScaffoldSuite) TestExtended(c *C) {
+	dir := filepath.Join(c.MkDir(), "ruby")
+	res, err := Scaffold(ScaffoldRequest{Name: "ruby", Dir: dir, Extended: true})
+	c.Assert(err, IsNil)
+	c.Assert(res.Files, HasLen, len(extendedScaffold))
+
+	// sti validate -R validates the runtime image for incremental builds
+	s.assertValidImage(c, filepath.Join(dir, "builder"), true, true)
+	s.assertValidImage(c, filepath.Join(dir, "runtime"), true, false)
+
+	makefile, _ := ioutil.ReadFile(filepath.Join(dir, "Makefile"))
+	c.Assert(strings.Contains(string(makefile), "\n\tsti validate $(IMAGE) -R $(IMAGE)-runtime\n"), Equals, true)
+}
+
+func (s *ScaffoldSuite) TestDefaultDir(c *C) {
+	cwd, err := os.Getwd()
+	c.Assert(err, IsNil)
+	defer os.Chdir(cwd)
+	c.Assert(os.Chdir(c.MkDir()), IsNil)
+
+	res, err := Scaffold(ScaffoldRequest{Name: "example/ruby"})
+	c.Assert(err, IsNil)
+	c.Assert(res.Dir, Equals, "ruby")
+
+	dockerfile, err := ioutil.ReadFile(filepath.Join("ruby", "Dockerfile"))
+	c.Assert(err, IsNil)
+	c.Assert(strings.HasPrefix(string(dockerfile), "FROM centos\n"), Equals, true)
+}
+
+func (s *ScaffoldSuite) TestDirNotEmpty(c *C) {
+	dir := c.MkDir()
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "Dockerfile"), []byte("FROM scratch\n"), 0644), IsNil)
+
+	_, err := Scaffold(ScaffoldRequest{Name: "ruby", Dir: dir})
+	c.Assert(err, Equals, ErrScaffoldDirNotEmpty)
+
+	content, _ := ioutil.ReadFile(filepath.Join(dir, "Dockerfile"))
+	c.Assert(string(content), Equals, "FROM scratch\n")
+}
+
+func (s *ScaffoldSuite) TestInvalidName(c *C) {
+	_, err := Scaffold(ScaffoldRequest{Name: "", Dir: c.MkDir()})
+	c.Assert(err, Equals, ErrInvalidScaffoldName)
+
+	_, err = Scaffold(ScaffoldRequest{Name: "my image", Dir: c.MkDir()})
+	c.Assert(err, Equals, ErrInvalidScaffoldName)
+}
@@ -0,0 +1,438 @@
+package sti
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// Number of bytes of the beginning of a file in an image that are kept for inspection;
+// as many of its #! line as the kernel reads.
+const fileHeadSize = 256
+
+// Search path for interpreters run through env when an image does not set PATH.
+const defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// A file in an image, as described by the header of its archive entry, with the
+// beginning of its content.
+type imageFile struct {
+	header *tar.Header
+	head   []byte
+}
+
+// Looks up a file in an image, returning nil if there is none at the path.
+type fileLookup func(path string) (*imageFile, error)
+
+// Checks that a script exists in an image, that it is an executable regular file, and
+// that it is either a binary or has a #! line naming an interpreter that exists in the
+// image.  Checks that cannot apply once a check has failed are left out.
+func checkScript(script string, lookup fileLookup, searchPath string) ([]ValidationCheck, error) {
+	file, err := resolveFile(script, lookup)
+	if err != nil {
+		return nil, err
+	}
+
+	check := newScriptCheck(CheckScriptExists, script, file != nil)
+	checks := []ValidationCheck{check}
+	if file == nil {
+		check.Remediation = "Add an executable " + script + " script to the image"
+		return []ValidationCheck{check}, nil
+	}
+
+	regular := file.header.Typeflag == tar.TypeReg || file.header.Typeflag == tar.TypeRegA
+	check = newScriptCheck(CheckScriptRegularFile, script, regular)
+	if !regular {
+		check.Detail = describeType(file.header)
+		check.Remediation = "Replace " + script + " with a regular file"
+	}
+	checks = append(checks, check)
+	if !regular {
+		return checks, nil
+	}
+
+	mode := file.header.Mode & 0777
+	check = newScriptCheck(CheckScriptExecutable, script, mode&0111 != 0)
+	check.Detail = fmt.Sprintf("mode %04o", mode)
+	if mode&0111 == 0 {
+		check.Remediation = "Make the script executable, such as with chmod +x " + script
+	}
+	checks = append(checks, check)
+
+	check = newScriptCheck(CheckScriptInterpreter, script, true)
+	interpreter, args, ok := parseShebang(file.head)
+	switch {
+	case bytes.HasPrefix(file.head, []byte("\x7fELF")):
+		check.Detail = "binary"
+	case !ok:
+		check.Status = CheckFailed
+		check.Detail = "no #! line"
+		check.Remediation = "Start the script with a #! line naming its interpreter, such as #!/bin/sh"
+	default:
+		check.Detail = interpreter
+		missing := interpreter
+		found, err := checkExecutable(interpreter, lookup)
+		if err != nil {
+			return nil, err
+		}
+		if found && path.Base(interpreter) == "env" && len(args) > 0 {
+			missing = args[0]
+			check.Detail = interpreter + " " + missing
+			program, err := lookPath(missing, lookup, searchPath)
+			if err != nil {
+				return nil, err
+			}
+			found = program != ""
+		}
+		if !found {
+			check.Status = CheckFailed
+			check.Detail += " not found"
+			check.Remediation = "Install " + missing + " in the image, or change the #! line of the script"
+		}
+	}
+
+	return append(checks, check), nil
+}
+
+// Returns a check of a script, of error severity.
+func newScriptCheck(id string, script string, passed bool) ValidationCheck {
+	status := CheckPassed
+	if !passed {
+		status = CheckFailed
+	}
+
+	return ValidationCheck{ID: id, Script: script, Status: status, Severity: SeverityError}
+}
+
+// Returns the interpreter named by the #! line at the beginning of a script, and its
+// arguments, or false if the script has none.
+func parseShebang(head []byte) (string, []string, bool) {
+	if !bytes.HasPrefix(head, []byte("#!")) {
+		return "", nil, false
+	}
+
+	line := head[2:]
+	if i := bytes.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) == 0 {
+		return "", nil, false
+	}
+
+	// env may be given options before the program it runs
+	args := fields[1:]
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		args = args[1:]
+	}
+
+	return fields[0], args, true
+}
+
+// Determines whether an executable regular file exists at a path.
+func checkExecutable(filePath string, lookup fileLookup) (bool, error) {
+	file, err := resolveFile(filePath, lookup)
+	if err != nil || file == nil {
+		return false, err
+	}
+
+	regular := file.header.Typeflag == tar.TypeReg || file.header.Typeflag == tar.TypeRegA
+	return regular && file.header.Mode&0111 != 0, nil
+}
+
+// Returns the path of the executable program in the directories of searchPath, or ""
+// if there is none.
+func lookPath(program string, lookup fileLookup, searchPath string) (string, error) {
+	if strings.Contains(program, "/") {
+		found, err := checkExecutable(program, lookup)
+		if err != nil || !found {
+			return "", err
+		}
+		return program, nil
+	}
+
+	for _, dir := range strings.Split(searchPath, ":") {
+		if dir == "" {
+			continue
+		}
+
+		candidate := path.Join(dir, program)
+		found, err := checkExecutable(candidate, lookup)
+		if err != nil {
+			return "", err
+		}
+		if found {
+			return candidate, nil
+		}
+	}
+
+	return "", nil
+}
+
+// Looks up a file, following symlinks.
+func resolveFile(filePath string, lookup fileLookup) (*imageFile, error) {
+	for i := 0; i < 16; i++ {
+		file, err := lookup(filePath)
+		if err != nil || file == nil || file.header.Typeflag != tar.TypeSymlink {
+			return file, err
+		}
+
+		target := file.header.Linkname
+		if !path.IsAbs(target) {
+			target = path.Join(path.Dir(filePath), target)
+		}
+		filePath = target
+	}
+
+	return nil, nil
+}
+
+func describeType(header *tar.Header) string {
+	switch header.Typeflag {
+	case tar.TypeDir:
+		return "directory"
+	case tar.TypeSymlink:
+		return "symlink to " + header.Linkname
+	case tar.TypeChar, tar.TypeBlock:
+		return "device"
+	case tar.TypeFifo:
+		return "fifo"
+	}
+
+	return fmt.Sprintf("type %q", header.Typeflag)
+}
+
+// Returns a lookup of the files of an image, read from the archive of the image that
+// docker save writes.  Nothing is run in the image, and no container is created from
+// it, so that images lacking even a shell can be inspected.
+func (h requestHandler) imageFiles(imageName string) (fileLookup, error) {
+	c := exec.Command("/usr/bin/docker", "save", imageName)
+	var stdErr bytes.Buffer
+	c.Stderr = &stdErr
+	out, err := c.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	span := h.trace.start("save image", "sti.image", imageName)
+	err = c.Start()
+	if err != nil {
+		span.end(err)
+		h.log.Error("Unable to read the files of image", "image", imageName, "error", err)
+		return nil, ErrReadImageFailed
+	}
+
+	files, err := readImageArchive(out)
+	io.Copy(ioutil.Discard, out)
+	if waitErr := c.Wait(); waitErr != nil {
+		err = fmt.Errorf("docker save: %v: %s", waitErr, strings.TrimSpace(stdErr.String()))
+	}
+	span.end(err)
+	if err != nil {
+		h.log.Error("Unable to read the files of image", "image", imageName, "error", err)
+		return nil, ErrReadImageFailed
+	}
+
+	return files, nil
+}
+
+// Reads the files of an image from the archive of it written by docker save.  The
+// archive holds the layers of the image, each a tarball of the files it adds, changes
+// and removes, which are applied in order from the base layer.  manifest.json lists
+// the layers in order; archives written by earlier versions of docker have none, and
+// name the parent of each layer in its json file instead.
+func readImageArchive(r io.Reader) (fileLookup, error) {
+	var manifest []struct {
+		Layers []string
+	}
+	parents := map[string]string{}
+	layers := map[string]map[string]*imageFile{}
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		name := path.Clean(header.Name)
+		switch {
+		case name == "manifest.json":
+			err = json.NewDecoder(tr).Decode(&manifest)
+		case path.Base(name) == "json" && path.Dir(name) != ".":
+			var layer struct {
+				Parent string `json:"parent"`
+			}
+			err = json.NewDecoder(tr).Decode(&layer)
+			parents[path.Dir(name)] = layer.Parent
+		case path.Base(name) == "layer.tar":
+			layers[name], err = readLayer(tr)
+		case strings.HasPrefix(name, "blobs/") && header.Typeflag != tar.TypeDir:
+			// content addressed archives keep the configuration of the image along
+			// with its layers, which are told apart by manifest.json
+			if layer, err := readLayer(tr); err == nil {
+				layers[name] = layer
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	order, err := layerOrder(manifest, parents)
+	if err != nil {
+		return nil, err
+	}
+
+	files := map[string]*imageFile{}
+	for _, name := range order {
+		layer, ok := layers[name]
+		if !ok {
+			return nil, fmt.Errorf("layer %s is missing from the archive of the image", name)
+		}
+		applyLayer(files, layer)
+	}
+
+	return func(filePath string) (*imageFile, error) {
+		file := files[path.Clean(filePath)]
+		if file != nil && file.header.Typeflag == tar.TypeLink {
+			file = files[path.Clean("/"+file.header.Linkname)]
+		}
+
+		return file, nil
+	}, nil
+}
+
+// Returns the names of the layer tarballs of an image archive, from the base layer up.
+func layerOrder(manifest []struct{ Layers []string }, parents map[string]string) ([]string, error) {
+	if len(manifest) > 1 {
+		return nil, fmt.Errorf("the archive holds %d images", len(manifest))
+	}
+	if len(manifest) == 1 {
+		var order []string
+		for _, layer := range manifest[0].Layers {
+			order = append(order, path.Clean(layer))
+		}
+		return order, nil
+	}
+
+	// the top layer is the one that is no other layer's parent
+	top := ""
+	for id := range parents {
+		isParent := false
+		for _, parent := range parents {
+			isParent = isParent || parent == id
+		}
+		if isParent {
+			continue
+		}
+		if top != "" {
+			return nil, errors.New("the archive holds more than one image")
+		}
+		top = id
+	}
+	if top == "" {
+		return nil, errors.New("the archive holds no image")
+	}
+
+	var order []string
+	for id := top; id != ""; id = parents[id] {
+		if len(order) > len(parents) {
+			return nil, errors.New("the layers of the image form a cycle")
+		}
+		order = append([]string{path.Join(id, "layer.tar")}, order...)
+	}
+
+	return order, nil
+}
+
+// Reads the files of a layer tarball, by path, with the beginning of each regular
+// file.
+func readLayer(r io.Reader) (map[string]*imageFile, error) {
+	files := map[string]*imageFile{}
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		file := &imageFile{header: header}
+		if header.Typeflag == tar.TypeReg || header.Typeflag == tar.TypeRegA {
+			head := make([]byte, fileHeadSize)
+			n, err := io.ReadFull(tr, head)
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				return nil, err
+			}
+			file.head = head[:n]
+		}
+		files[path.Clean("/"+header.Name)] = file
+	}
+}
+
+// Names of the files by which a layer removes files of the layers below it: .wh.NAME
+// removes the file or directory NAME, and .wh..wh..opq the contents of the directory
+// it is in.
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = whiteoutPrefix + whiteoutPrefix + ".opq"
+)
+
+// Applies the files of a layer to the files of the layers below it.
+func applyLayer(files map[string]*imageFile, layer map[string]*imageFile) {
+	for name := range layer {
+		dir, base := path.Split(name)
+		switch {
+		case base == whiteoutOpaque:
+			removeFiles(files, dir, false)
+		case strings.HasPrefix(base, whiteoutPrefix):
+			removeFiles(files, path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix)), true)
+		}
+	}
+
+	for name, file := range layer {
+		if !strings.HasPrefix(path.Base(name), whiteoutPrefix) {
+			files[name] = file
+		}
+	}
+}
+
+// Removes the files within a directory, and with removeDir, the directory itself.
+func removeFiles(files map[string]*imageFile, dir string, removeDir bool) {
+	dir = path.Clean(dir)
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	for name := range files {
+		if (removeDir && name == dir) || strings.HasPrefix(name, prefix) {
+			delete(files, name)
+		}
+	}
+}
+
+// Returns the search path of an image: the PATH of its configuration, or the default
+// search path.
+func imageSearchPath(image *docker.Image) string {
+	if image.Config != nil {
+		for _, env := range image.Config.Env {
+			if strings.HasPrefix(env, "PATH=") {
+				return strings.TrimPrefix(env, "PATH=")
+			}
+		}
+	}
+
+	return defaultPath
+}
@@ -0,0 +1,304 @@
+package sti
+
+import (
+	"archive/tar"
+	"bytes"
+	"strings"
+
+	. "launchpad.net/gocheck"
+)
+
+type ScriptSuite struct{}
+
+var _ = Suite(&ScriptSuite{})
+
+// A fake image: files by path
+type fakeImage map[string]*imageFile
+
+func (f fakeImage) lookup(path string) (*imageFile, error) {
+	return f[path], nil
+}
+
+func fakeFile(mode int64, content string) *imageFile {
+	return &imageFile{header: &tar.Header{Typeflag: tar.TypeReg, Mode: mode}, head: []byte(content)}
+}
+
+func fakeLink(target string) *imageFile {
+	return &imageFile{header: &tar.Header{Typeflag: tar.TypeSymlink, Linkname: target}}
+}
+
+func checkSummary(checks []ValidationCheck) []string {
+	summary := []string{}
+	for _, check := range checks {
+		summary = append(summary, check.String())
+	}
+
+	return summary
+}
+
+func (s *ScriptSuite) assertChecks(c *C, image fakeImage, expected ...string) {
+	checks, err := checkScript("/usr/bin/prepare", image.lookup, defaultPath)
+	c.Assert(err, IsNil)
+	c.Assert(checkSummary(checks), DeepEquals, expected)
+}
+
+func (s *ScriptSuite) TestValidScript(c *C) {
+	s.assertChecks(c, fakeImage{
+		"/usr/bin/prepare": fakeFile(0755, "#!/bin/bash -e\necho prepare\n"),
+		"/bin/bash":        fakeFile(0755, "\x7fELF"),
+	},
+		"/usr/bin/prepare exists: passed",
+		"/usr/bin/prepare is a regular file: passed",
+		"/usr/bin/prepare is executable: passed (mode 0755)",
+		"/usr/bin/prepare has an interpreter: passed (/bin/bash)")
+}
+
+func (s *ScriptSuite) TestBinary(c *C) {
+	s.assertChecks(c, fakeImage{"/usr/bin/prepare": fakeFile(0700, "\x7fELF\x02\x01")},
+		"/usr/bin/prepare exists: passed",
+		"/usr/bin/prepare is a regular file: passed",
+		"/usr/bin/prepare is executable: passed (mode 0700)",
+		"/usr/bin/prepare has an interpreter: passed (binary)")
+}
+
+func (s *ScriptSuite) TestMissing(c *C) {
+	s.assertChecks(c, fakeImage{}, "/usr/bin/prepare exists: failed")
+}
+
+func (s *ScriptSuite) TestDirectory(c *C) {
+	dir := &imageFile{header: &tar.Header{Typeflag: tar.TypeDir, Mode: 0755}}
+	s.assertChecks(c, fakeImage{"/usr/bin/prepare": dir},
+		"/usr/bin/prepare exists: passed",
+		"/usr/bin/prepare is a regular file: failed (directory)")
+}
+
+func (s *ScriptSuite) TestNotExecutable(c *C) {
+	s.assertChecks(c, fakeImage{
+		"/usr/bin/prepare": fakeFile(0644, "#!/bin/sh\n"),
+		"/bin/sh":          fakeFile(0755, "\x7fELF"),
+	},
+		"/usr/bin/prepare exists: passed",
+		"/usr/bin/prepare is a regular file: passed",
+		"/usr/bin/prepare is executable: failed (mode 0644)",
+		"/usr/bin/prepare has an interpreter: passed (/bin/sh)")
+
+	checks, err := checkScript("/usr/bin/prepare", fakeImage{"/usr/bin/prepare": fakeFile(0644, "\x7fELF")}.lookup, defaultPath)
+	c.Assert(err, IsNil)
+	c.Assert(checks[2].ID, Equals, CheckScriptExecutable)
+	c.Assert(checks[2].Remediation, Equals, "Make the script executable, such as with chmod +x /usr/bin/prepare")
+}
+
+func (s *ScriptSuite) TestMissingInterpreter(c *C) {
+	checks, err := checkScript("/usr/bin/prepare", fakeImage{
+		"/usr/bin/prepare": fakeFile(0755, "#!/usr/bin/ruby\n"),
+	}.lookup, defaultPath)
+	c.Assert(err, IsNil)
+	c.Assert(checks[3].String(), Equals, "/usr/bin/prepare has an interpreter: failed (/usr/bin/ruby not found)")
+	c.Assert(checks[3].ID, Equals, CheckScriptInterpreter)
+	c.Assert(checks[3].Severity, Equals, SeverityError)
+	c.Assert(checks[3].Remediation, Equals, "Install /usr/bin/ruby in the image, or change the #! line of the script")
+}
+
+func (s *ScriptSuite) TestNoShebang(c *C) {
+	checks, err := checkScript("/usr/bin/prepare", fakeImage{
+		"/usr/bin/prepare": fakeFile(0755, "echo prepare\n"),
+	}.lookup, defaultPath)
+	c.Assert(err, IsNil)
+	c.Assert(checks[3].String(), Equals, "/usr/bin/prepare has an interpreter: failed (no #! line)")
+}
+
+// Test interpreters run through env being looked up on the search path
+func (s *ScriptSuite) TestEnvInterpreter(c *C) {
+	image := fakeImage{
+		"/usr/bin/prepare":    fakeFile(0755, "#!/usr/bin/env ruby\n"),
+		"/usr/bin/env":        fakeFile(0755, "\x7fELF"),
+		"/opt/ruby/bin/ruby":  fakeFile(0755, "\x7fELF"),
+		"/usr/local/bin/ruby": fakeFile(0644, ""),
+	}
+
+	checks, err := checkScript("/usr/bin/prepare", image.lookup, defaultPath)
+	c.Assert(err, IsNil)
+	c.Assert(checks[3].String(), Equals, "/usr/bin/prepare has an interpreter: failed (/usr/bin/env ruby not found)")
+	c.Assert(checks[3].Remediation, Equals, "Install ruby in the image, or change the #! line of the script")
+
+	checks, err = checkScript("/usr/bin/prepare", image.lookup, "/usr/local/bin:/opt/ruby/bin")
+	c.Assert(err, IsNil)
+	c.Assert(checks[3].String(), Equals, "/usr/bin/prepare has an interpreter: passed (/usr/bin/env ruby)")
+}
+
+// Test symlinks being followed to scripts and interpreters
+func (s *ScriptSuite) TestSymlinks(c *C) {
+	s.assertChecks(c, fakeImage{
+		"/usr/bin/prepare":     fakeLink("../libexec/prepare"),
+		"/usr/libexec/prepare": fakeFile(0755, "#!/bin/sh\n"),
+		"/bin/sh":              fakeLink("bash"),
+		"/bin/bash":            fakeFile(0755, "\x7fELF"),
+	},
+		"/usr/bin/prepare exists: passed",
+		"/usr/bin/prepare is a regular file: passed",
+		"/usr/bin/prepare is executable: passed (mode 0755)",
+		"/usr/bin/prepare has an interpreter: passed (/bin/sh)")
+
+	s.assertChecks(c, fakeImage{"/usr/bin/prepare": fakeLink("prepare")}, "/usr/bin/prepare exists: failed")
+}
+
+func (s *ScriptSuite) TestParseShebang(c *C) {
+	interpreter, args, ok := parseShebang([]byte("#! /usr/bin/env -S python3 -u\nprint()\n"))
+	c.Assert(ok, Equals, true)
+	c.Assert(interpreter, Equals, "/usr/bin/env")
+	c.Assert(args, DeepEquals, []string{"python3", "-u"})
+
+	_, _, ok = parseShebang([]byte("#!\n"))
+	c.Assert(ok, Equals, false)
+}
+
+// An entry of a tarball: a file with its content, or a link with its target.
+type tarEntry struct {
+	name     string
+	typeflag byte
+	mode     int64
+	content  string
+}
+
+// Returns a tarball of entries.
+func tarball(c *C, entries ...tarEntry) []byte {
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	for _, entry := range entries {
+		header := &tar.Header{Name: entry.name, Typeflag: entry.typeflag, Mode: entry.mode}
+		if entry.typeflag == tar.TypeReg {
+			header.Size = int64(len(entry.content))
+		} else {
+			header.Linkname = entry.content
+		}
+		c.Assert(tw.WriteHeader(header), IsNil)
+		_, err := tw.Write([]byte(entry.content[:header.Size]))
+		c.Assert(err, IsNil)
+	}
+	c.Assert(tw.Close(), IsNil)
+
+	return archive.Bytes()
+}
+
+func regular(name string, mode int64, content string) tarEntry {
+	return tarEntry{name, tar.TypeReg, mode, content}
+}
+
+// Returns the archive of an image of two layers, as written by docker save: the base
+// layer with a shell and scripts, and a layer removing and changing some of them.
+func imageArchive(c *C, manifest bool) []byte {
+	base := tarball(c,
+		tarEntry{"bin/", tar.TypeDir, 0755, ""},
+		regular("bin/sh", 0755, "\x7fELF"),
+		regular("usr/bin/prepare", 0755, "#!/bin/sh\n"+strings.Repeat("echo padding\n", fileHeadSize)),
+		regular("usr/bin/save-artifacts", 0755, "#!/bin/sh\n"),
+		regular("usr/lib/app/a", 0644, "a"),
+		regular("usr/lib/app/nested/b", 0644, "b"),
+		regular("usr/lib/other", 0644, "other"),
+	)
+	top := tarball(c,
+		regular("usr/bin/.wh.save-artifacts", 0644, ""),
+		regular("usr/bin/prepare", 0644, "#!/usr/bin/env ruby\n"),
+		tarEntry{"usr/bin/run", tar.TypeLink, 0, "usr/bin/prepare"},
+		tarEntry{"usr/bin/usage", tar.TypeSymlink, 0777, "run"},
+		regular("usr/lib/app/.wh..wh..opq", 0644, ""),
+		regular("usr/lib/app/c", 0644, "c"),
+	)
+
+	if manifest {
+		return tarball(c,
+			regular("blobs/sha256/aaaa", 0644, string(top)),
+			regular("blobs/sha256/bbbb", 0644, string(base)),
+			regular("blobs/sha256/cccc", 0644, `{"config":{"Env":["PATH=/usr/bin:/bin"]}}`),
+			regular("manifest.json", 0644, `[{"Config":"blobs/sha256/cccc","Layers":["blobs/sha256/bbbb","blobs/sha256/aaaa"]}]`),
+		)
+	}
+
+	return tarball(c,
+		tarEntry{"1111/", tar.TypeDir, 0755, ""},
+		regular("1111/json", 0644, `{"id":"1111","parent":"2222"}`),
+		regular("1111/layer.tar", 0644, string(top)),
+		tarEntry{"2222/", tar.TypeDir, 0755, ""},
+		regular("2222/json", 0644, `{"id":"2222"}`),
+		regular("2222/layer.tar", 0644, string(base)),
+		regular("repositories", 0644, `{"builder":{"latest":"1111"}}`),
+	)
+}
+
+// Test reading the files of an image from its archive, applying its layers in order
+func (s *ScriptSuite) TestReadImageArchive(c *C) {
+	for _, manifest := range []bool{false, true} {
+		files, err := readImageArchive(bytes.NewReader(imageArchive(c, manifest)))
+		c.Assert(err, IsNil)
+
+		file, err := files("/usr/bin/prepare")
+		c.Assert(err, IsNil)
+		c.Assert(file.header.Mode, Equals, int64(0644))
+		c.Assert(string(file.head), Equals, "#!/usr/bin/env ruby\n")
+
+		file, err = files("/bin/sh")
+		c.Assert(err, IsNil)
+		c.Assert(string(file.head), Equals, "\x7fELF")
+
+		file, err = files("/usr/bin/run")
+		c.Assert(err, IsNil)
+		c.Assert(file.header.Typeflag, Equals, byte(tar.TypeReg))
+		c.Assert(string(file.head), Equals, "#!/usr/bin/env ruby\n")
+
+		file, err = resolveFile("/usr/bin/usage", files)
+		c.Assert(err, IsNil)
+		c.Assert(file.header.Name, Equals, "usr/bin/prepare")
+
+		for _, present := range []string{"/bin", "/usr/lib/app/c", "/usr/lib/other"} {
+			file, err = files(present)
+			c.Assert(err, IsNil)
+			c.Assert(file, NotNil, Commentf(present))
+		}
+		for _, removed := range []string{"/usr/bin/save-artifacts", "/usr/lib/app/a", "/usr/lib/app/nested", "/usr/lib/app/nested/b", "/usr/bin/.wh.save-artifacts"} {
+			file, err = files(removed)
+			c.Assert(err, IsNil)
+			c.Assert(file, IsNil, Commentf(removed))
+		}
+	}
+}
+
+// Test that only the beginning of large files is kept
+func (s *ScriptSuite) TestReadImageArchiveHead(c *C) {
+	content := "#!/bin/sh\n" + strings.Repeat("echo padding\n", fileHeadSize)
+	files, err := readImageArchive(bytes.NewReader(tarball(c,
+		regular("1111/json", 0644, `{"id":"1111"}`),
+		regular("1111/layer.tar", 0644, string(tarball(c, regular("usr/bin/prepare", 0755, content)))),
+	)))
+	c.Assert(err, IsNil)
+
+	file, err := files("/usr/bin/prepare")
+	c.Assert(err, IsNil)
+	c.Assert(string(file.head), Equals, content[:fileHeadSize])
+
+	checks, err := checkScript("/usr/bin/prepare", files, defaultPath)
+	c.Assert(err, IsNil)
+	c.Assert(checkSummary(checks)[3], Equals, "/usr/bin/prepare has an interpreter: failed (/bin/sh not found)")
+}
+
+// Test the archives that hold no single image with all of its layers
+func (s *ScriptSuite) TestReadImageArchiveInvalid(c *C) {
+	layer := string(tarball(c, regular("bin/sh", 0755, "\x7fELF")))
+	for _, archive := range [][]byte{
+		[]byte("not an archive"),
+		tarball(c, regular("repositories", 0644, "{}")),
+		tarball(c,
+			regular("1111/json", 0644, `{"id":"1111","parent":"2222"}`),
+			regular("1111/layer.tar", 0644, layer)),
+		tarball(c,
+			regular("1111/json", 0644, `{"id":"1111"}`),
+			regular("1111/layer.tar", 0644, layer),
+			regular("2222/json", 0644, `{"id":"2222"}`),
+			regular("2222/layer.tar", 0644, layer)),
+		tarball(c,
+			regular("blobs/sha256/aaaa", 0644, layer),
+			regular("manifest.json", 0644, `[{"Layers":["blobs/sha256/aaaa","blobs/sha256/bbbb"]}]`)),
+	} {
+		_, err := readImageArchive(bytes.NewReader(archive))
+		c.Assert(err, NotNil)
+	}
+}
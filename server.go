@@ -0,0 +1,480 @@
+package sti
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// States of a build submitted to a Server.
+const (
+	BuildPending   = "pending"
+	BuildRunning   = "running"
+	BuildSucceeded = "succeeded"
+	BuildFailed    = "failed"
+)
+
+// BuildStatus reports the progress of a build submitted to a Server.
+type BuildStatus struct {
+	ID     string
+	Tag    string
+	Status string
+	// Phase of a running build
+	Phase string `json:",omitempty"`
+	// Position of a pending build in the queue, counting from 1 for the next to start
+	QueuePosition int `json:",omitempty"`
+	Submitted     time.Time
+	Started       time.Time
+	Finished      time.Time
+	Result        *BuildResult
+	Error         string `json:",omitempty"`
+}
+
+// Returned by the build submission endpoint.
+type BuildSubmission struct {
+	ID string
+}
+
+// Body of error responses.
+type ServerError struct {
+	Error string
+}
+
+// Number of finished builds a Server created by NewServer remembers.
+const DefaultRetention = 100
+
+// buildLog collects the output of a build and lets any number of readers follow it.
+type buildLog struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	data   []byte
+	closed bool
+}
+
+func newBuildLog() *buildLog {
+	l := &buildLog{}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+func (l *buildLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.data = append(l.data, p...)
+	l.cond.Broadcast()
+	return len(p), nil
+}
+
+// Marks the log complete, releasing readers waiting for more output.
+func (l *buildLog) Close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	l.cond.Broadcast()
+}
+
+// Wakes the readers waiting for more output, so that they notice they are stopped.
+func (l *buildLog) wake() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.cond.Broadcast()
+}
+
+// Returns the output after offset, waiting for more if there is none and the log is
+// not complete, unless stop is closed.  The returned flag is false once the log is
+// complete and all of its output has been read, or once stop is closed while waiting;
+// whoever closes stop must then wake the log.
+func (l *buildLog) next(offset int, stop <-chan struct{}) ([]byte, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for offset >= len(l.data) && !l.closed {
+		select {
+		case <-stop:
+			return nil, false
+		default:
+		}
+		l.cond.Wait()
+	}
+
+	if offset >= len(l.data) {
+		return nil, false
+	}
+
+	return l.data[offset:], true
+}
+
+// serverBuild tracks a build submitted to a Server.
+type serverBuild struct {
+	id         string
+	submitted  time.Time
+	queued     *QueuedBuild
+	log        *buildLog
+	cancel     chan struct{}
+	cancelOnce sync.Once
+
+	mu    sync.Mutex
+	phase string
+}
+
+// Records the phase of the build reported by its events.
+func (b *serverBuild) event(event BuildEvent) {
+	if event.Kind != EventPhaseStarted {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.phase = event.Phase
+}
+
+// Server serves builds and validations over HTTP:
+//
+//	POST   /builds           submit a BuildRequest, returning a BuildSubmission; the
+//	                         priority query parameter sets its priority in the queue
+//	GET    /builds/ID        return the BuildStatus of a build
+//	GET    /builds/ID/logs   stream the output of a build until it finishes
+//	DELETE /builds/ID        cancel a build
+//	POST   /validate         validate a ValidateRequest, returning a ValidateResult
+//	POST   /hooks/github     receive a GitHub push webhook, returning a WebhookResult
+//	POST   /hooks/gitlab     receive a GitLab push webhook, returning a WebhookResult
+//	GET    /metrics          return the server's Metrics in the Prometheus text format
+//
+// The docker socket, timeout, working directory, debug setting, logger and tracer of
+// the server's Request apply to every request it serves.  Builds are performed by the
+// server's Queue; a build submitted while an equivalent build is queued is given the
+// ID of that build.  Pushes received by webhook are built as described by the
+// server's Webhooks, if set.
+//
+// If Token is set, every request other than a webhook must carry it as a bearer token
+// in its Authorization header; webhooks are verified with the secret of the Webhooks.
+// Submitted builds must have a remote git URL as their source, unless
+// AllowLocalSources is set.
+// The server remembers the status and output of the last Retention finished builds;
+// older builds are no longer found.
+type Server struct {
+	Request   Request
+	Queue     *Queue
+	Webhooks  *WebhookConfig
+	Metrics   *Metrics
+	Token     string
+	Retention int
+	// Build submitted sources that are local paths, not only git URLs
+	AllowLocalSources bool
+
+	// performs builds; Build unless replaced for testing
+	build func(BuildRequest) (*BuildResult, error)
+
+	mu       sync.Mutex
+	builds   map[string]*serverBuild
+	byQueued map[*QueuedBuild]*serverBuild
+	finished []*serverBuild
+}
+
+// NewServer returns a Server serving requests with the settings of req, performing at
+// most concurrency builds at once.
+func NewServer(req Request, concurrency int) *Server {
+	s := &Server{
+		Request:   req,
+		Metrics:   NewMetrics(),
+		Retention: DefaultRetention,
+		build:     Build,
+		builds:    make(map[string]*serverBuild),
+		byQueued:  make(map[*QueuedBuild]*serverBuild),
+	}
+	s.Queue = newQueue(concurrency, func(req BuildRequest) (*BuildResult, error) {
+		return s.build(req)
+	})
+
+	return s
+}
+
+// Applies the server's settings to a request received by it.
+func (s *Server) configure(req *Request) {
+	req.DockerSocket = s.Request.DockerSocket
+	req.DockerTimeout = s.Request.DockerTimeout
+	req.WorkingDir = s.Request.WorkingDir
+	req.Debug = s.Request.Debug
+	req.Logger = s.Request.logger()
+	req.Metrics = s.Metrics
+	req.Tracer = s.Request.Tracer
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(r.URL.Path, "/")
+	parts := strings.Split(path, "/")
+
+	if parts[0] != "hooks" && !s.authorized(r) {
+		writeError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	switch {
+	case path == "builds" && r.Method == "POST":
+		s.submitBuild(w, r)
+	case path == "validate" && r.Method == "POST":
+		s.validate(w, r)
+	case path == "metrics" && r.Method == "GET":
+		s.writeMetrics(w)
+	case len(parts) == 2 && parts[0] == "hooks" && (parts[1] == "github" || parts[1] == "gitlab") && r.Method == "POST":
+		s.receiveWebhook(w, r, parts[1])
+	case len(parts) == 2 && parts[0] == "builds" && r.Method == "GET":
+		s.buildStatus(w, parts[1])
+	case len(parts) == 2 && parts[0] == "builds" && r.Method == "DELETE":
+		s.cancelBuild(w, parts[1])
+	case len(parts) == 3 && parts[0] == "builds" && parts[2] == "logs" && r.Method == "GET":
+		s.buildLogs(w, parts[1])
+	default:
+		writeError(w, http.StatusNotFound, "Not found")
+	}
+}
+
+// Verifies that a request carries the server's token, if it has one.
+func (s *Server) authorized(r *http.Request) bool {
+	if s.Token == "" {
+		return true
+	}
+
+	return hmac.Equal([]byte(r.Header.Get("Authorization")), []byte("Bearer "+s.Token))
+}
+
+func (s *Server) submitBuild(w http.ResponseWriter, r *http.Request) {
+	var req BuildRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !s.AllowLocalSources && !isGitURL(req.Source) {
+		writeError(w, http.StatusBadRequest, ErrLocalSource.Error())
+		return
+	}
+	s.configure(&req.Request)
+
+	priority := 0
+	if value := r.URL.Query().Get("priority"); value != "" {
+		priority, err = strconv.Atoi(value)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid priority: "+value)
+			return
+		}
+	}
+
+	id, err := s.submit(req, priority)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, BuildSubmission{id})
+}
+
+// Queues a build and returns its ID, or the ID of the equivalent build it was
+// coalesced with.
+func (s *Server) submit(req BuildRequest, priority int) (string, error) {
+	id, err := newID()
+	if err != nil {
+		return "", err
+	}
+
+	build := &serverBuild{
+		id:        id,
+		submitted: time.Now(),
+		log:       newBuildLog(),
+		cancel:    make(chan struct{}),
+	}
+	req.Writer = build.log
+	req.Cancel = build.cancel
+	req.Events = build.event
+	req.Logger = req.logger().With("build", id)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	queued := s.Queue.Submit(req, priority)
+	if existing, ok := s.byQueued[queued]; ok {
+		return existing.id, nil
+	}
+
+	build.queued = queued
+	s.builds[id] = build
+	s.byQueued[queued] = build
+
+	go s.awaitBuild(build)
+
+	return id, nil
+}
+
+// Waits for a build to finish, completes its log, and forgets the oldest finished
+// builds beyond the server's retention.
+func (s *Server) awaitBuild(build *serverBuild) {
+	build.queued.Wait()
+	build.log.Close()
+
+	s.Request.logger().Info("Build finished", "build", build.id, "status", s.status(build).Status)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.byQueued, build.queued)
+	s.finished = append(s.finished, build)
+	for len(s.finished) > 0 && len(s.finished) > s.Retention {
+		delete(s.builds, s.finished[0].id)
+		s.finished[0] = nil
+		s.finished = s.finished[1:]
+	}
+}
+
+// Returns the current status of a build.
+func (s *Server) status(build *serverBuild) BuildStatus {
+	status := BuildStatus{
+		ID:        build.id,
+		Tag:       build.queued.Request.Tag,
+		Submitted: build.submitted,
+		Started:   s.Queue.Started(build.queued),
+		Finished:  s.Queue.Finished(build.queued),
+	}
+
+	select {
+	case <-build.queued.Done():
+		result, err := build.queued.Wait()
+		status.Result = result
+		if err != nil {
+			status.Status = BuildFailed
+			status.Error = err.Error()
+		} else if result == nil || !result.Success {
+			status.Status = BuildFailed
+		} else {
+			status.Status = BuildSucceeded
+		}
+	default:
+		status.QueuePosition = s.Queue.Position(build.queued)
+		if status.QueuePosition > 0 {
+			status.Status = BuildPending
+		} else {
+			status.Status = BuildRunning
+			build.mu.Lock()
+			status.Phase = build.phase
+			build.mu.Unlock()
+		}
+	}
+
+	return status
+}
+
+// Returns the build with the given ID, or nil.
+func (s *Server) getBuild(id string) *serverBuild {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.builds[id]
+}
+
+func (s *Server) buildStatus(w http.ResponseWriter, id string) {
+	build := s.getBuild(id)
+	if build == nil {
+		writeError(w, http.StatusNotFound, "No such build")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, s.status(build))
+}
+
+func (s *Server) cancelBuild(w http.ResponseWriter, id string) {
+	build := s.getBuild(id)
+	if build == nil {
+		writeError(w, http.StatusNotFound, "No such build")
+		return
+	}
+
+	if !s.Queue.Remove(build.queued) {
+		build.cancelOnce.Do(func() { close(build.cancel) })
+	}
+
+	writeJSON(w, http.StatusOK, s.status(build))
+}
+
+func (s *Server) buildLogs(w http.ResponseWriter, id string) {
+	build := s.getBuild(id)
+	if build == nil {
+		writeError(w, http.StatusNotFound, "No such build")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+
+	// stop following the log once the client goes away
+	var gone <-chan bool
+	if notifier, ok := w.(http.CloseNotifier); ok {
+		gone = notifier.CloseNotify()
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-gone:
+			close(stop)
+			build.log.wake()
+		case <-done:
+		}
+	}()
+
+	flusher, _ := w.(http.Flusher)
+	offset := 0
+	for {
+		data, ok := build.log.next(offset, stop)
+		if !ok {
+			return
+		}
+
+		_, err := w.Write(data)
+		if err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		offset += len(data)
+	}
+}
+
+func (s *Server) validate(w http.ResponseWriter, r *http.Request) {
+	var req ValidateRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	s.configure(&req.Request)
+
+	result, err := Validate(req)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (s *Server) writeMetrics(w http.ResponseWriter) {
+	s.Metrics.set("sti_queue_depth", float64(s.Queue.Len()))
+	s.Metrics.set("sti_builds_active", float64(s.Queue.Active()))
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.WriteHeader(http.StatusOK)
+	s.Metrics.WriteTo(w)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, message string) {
+	writeJSON(w, code, ServerError{message})
+}
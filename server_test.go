@@ -0,0 +1,249 @@
+package sti
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "launchpad.net/gocheck"
+)
+
+type ServerSuite struct {
+	server   *Server
+	listener *httptest.Server
+	requests chan BuildRequest
+	release  chan bool
+}
+
+var _ = Suite(&ServerSuite{})
+
+func (s *ServerSuite) SetUpTest(c *C) {
+	s.requests = make(chan BuildRequest, 1)
+	s.release = make(chan bool)
+
+	s.server = NewServer(Request{DockerSocket: "unix:///server.sock"}, 1)
+	s.server.build = func(req BuildRequest) (*BuildResult, error) {
+		req.Events(BuildEvent{Kind: EventPhaseStarted, Phase: PhaseBuildImage})
+		s.requests <- req
+		req.Writer.Write([]byte("building\n"))
+		if <-s.release {
+			return &BuildResult{Success: true}, nil
+		}
+		return nil, ErrBuildFailed
+	}
+	s.listener = httptest.NewServer(s.server)
+}
+
+func (s *ServerSuite) TearDownTest(c *C) {
+	s.listener.Close()
+}
+
+// Source of the builds submitted by the tests.
+const appSource = "git://example.com/app.git"
+
+func (s *ServerSuite) submit(c *C, req BuildRequest) string {
+	body, err := json.Marshal(req)
+	c.Assert(err, IsNil)
+
+	resp, err := http.Post(s.listener.URL+"/builds", "application/json", bytes.NewReader(body))
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusAccepted)
+
+	var submission BuildSubmission
+	c.Assert(json.NewDecoder(resp.Body).Decode(&submission), IsNil)
+	return submission.ID
+}
+
+func (s *ServerSuite) status(c *C, id string) BuildStatus {
+	resp, err := http.Get(s.listener.URL + "/builds/" + id)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+
+	var status BuildStatus
+	c.Assert(json.NewDecoder(resp.Body).Decode(&status), IsNil)
+	return status
+}
+
+// Test a build submitted, followed and completed through the API
+func (s *ServerSuite) TestBuild(c *C) {
+	id := s.submit(c, BuildRequest{Request: Request{DockerSocket: "tcp://elsewhere:4243"}, Source: appSource, Tag: "test/app"})
+
+	req := <-s.requests
+	c.Assert(req.Tag, Equals, "test/app")
+	c.Assert(req.DockerSocket, Equals, "unix:///server.sock")
+	status := s.status(c, id)
+	c.Assert(status.Status, Equals, BuildRunning)
+	c.Assert(status.Phase, Equals, PhaseBuildImage)
+
+	s.release <- true
+
+	resp, err := http.Get(s.listener.URL + "/builds/" + id + "/logs")
+	c.Assert(err, IsNil)
+	logs, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	c.Assert(err, IsNil)
+	c.Assert(string(logs), Equals, "building\n")
+
+	status = s.status(c, id)
+	c.Assert(status.Status, Equals, BuildSucceeded)
+	c.Assert(status.Result.Success, Equals, true)
+}
+
+// Test that a build error is reported in the status
+func (s *ServerSuite) TestBuildError(c *C) {
+	id := s.submit(c, BuildRequest{Source: appSource, Tag: "test/app"})
+	<-s.requests
+	s.release <- false
+
+	resp, err := http.Get(s.listener.URL + "/builds/" + id + "/logs")
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+
+	status := s.status(c, id)
+	c.Assert(status.Status, Equals, BuildFailed)
+	c.Assert(status.Error, Equals, ErrBuildFailed.Error())
+}
+
+// Test that unknown builds are not found
+func (s *ServerSuite) TestUnknownBuild(c *C) {
+	resp, err := http.Get(s.listener.URL + "/builds/unknown")
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusNotFound)
+}
+
+// Test metrics being served with the depth of the queue
+func (s *ServerSuite) TestMetrics(c *C) {
+	s.submit(c, BuildRequest{Source: appSource, Tag: "test/app"})
+	<-s.requests
+	s.submit(c, BuildRequest{Source: appSource, Tag: "test/other"})
+
+	resp, err := http.Get(s.listener.URL + "/metrics")
+	c.Assert(err, IsNil)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	c.Assert(err, IsNil)
+	c.Assert(resp.Header.Get("Content-Type"), Equals, "text/plain; version=0.0.4")
+	assertLines(c, string(body), "sti_queue_depth 1", "sti_builds_active 1")
+
+	s.release <- true
+	<-s.requests
+	s.release <- true
+}
+
+// Test that a server with a token refuses requests without it, except webhooks
+func (s *ServerSuite) TestToken(c *C) {
+	s.server.Token = "secret"
+
+	for _, header := range []string{"", "Bearer other", "secret"} {
+		req, err := http.NewRequest("GET", s.listener.URL+"/metrics", nil)
+		c.Assert(err, IsNil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		resp.Body.Close()
+		c.Assert(resp.StatusCode, Equals, http.StatusUnauthorized, Commentf(header))
+	}
+
+	req, err := http.NewRequest("GET", s.listener.URL+"/metrics", nil)
+	c.Assert(err, IsNil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+
+	// webhooks are verified with their own secret
+	resp, err = http.Post(s.listener.URL+"/hooks/github", "application/json", bytes.NewReader([]byte("{}")))
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Not(Equals), http.StatusUnauthorized)
+}
+
+// Test that the oldest finished builds are forgotten beyond the server's retention
+func (s *ServerSuite) TestRetention(c *C) {
+	s.server.Retention = 2
+
+	var ids []string
+	for _, tag := range []string{"test/first", "test/second", "test/third"} {
+		id := s.submit(c, BuildRequest{Source: appSource, Tag: tag})
+		<-s.requests
+		s.release <- true
+
+		resp, err := http.Get(s.listener.URL + "/builds/" + id + "/logs")
+		c.Assert(err, IsNil)
+		resp.Body.Close()
+		ids = append(ids, id)
+	}
+
+	// builds are forgotten once their log is complete
+	for i := 0; i < 100 && s.server.getBuild(ids[0]) != nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	resp, err := http.Get(s.listener.URL + "/builds/" + ids[0])
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusNotFound)
+	c.Assert(s.status(c, ids[1]).Status, Equals, BuildSucceeded)
+	c.Assert(s.status(c, ids[2]).Status, Equals, BuildSucceeded)
+}
+
+// Test that local sources are refused unless the server allows them
+func (s *ServerSuite) TestLocalSource(c *C) {
+	for _, source := range []string{"/etc", "file:///etc", "", "--upload-pack=touch /tmp/pwned"} {
+		body, err := json.Marshal(BuildRequest{Source: source, Tag: "test/app"})
+		c.Assert(err, IsNil)
+		resp, err := http.Post(s.listener.URL+"/builds", "application/json", bytes.NewReader(body))
+		c.Assert(err, IsNil)
+		resp.Body.Close()
+		c.Assert(resp.StatusCode, Equals, http.StatusBadRequest, Commentf(source))
+	}
+	c.Assert(s.requests, HasLen, 0)
+
+	s.server.AllowLocalSources = true
+	s.submit(c, BuildRequest{Source: "/etc", Tag: "test/app"})
+	c.Assert((<-s.requests).Source, Equals, "/etc")
+	s.release <- true
+}
+
+// Test that following the log of a build stops when the client goes away
+func (s *ServerSuite) TestLogsClientGone(c *C) {
+	returned := make(chan bool, 1)
+	listener := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.server.ServeHTTP(w, r)
+		returned <- true
+	}))
+	defer listener.Close()
+
+	id := s.submit(c, BuildRequest{Source: appSource, Tag: "test/app"})
+	<-s.requests
+
+	conn, err := net.Dial("tcp", listener.Listener.Addr().String())
+	c.Assert(err, IsNil)
+	_, err = conn.Write([]byte("GET /builds/" + id + "/logs HTTP/1.1\r\nHost: sti\r\n\r\n"))
+	c.Assert(err, IsNil)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	c.Assert(err, IsNil)
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	c.Assert(err, IsNil)
+	c.Assert(line, Equals, "building\n")
+
+	conn.Close()
+	select {
+	case <-returned:
+	case <-time.After(5 * time.Second):
+		s.release <- true
+		c.Fatal("the log was still followed after the client went away")
+	}
+	s.release <- true
+}
@@ -3,11 +3,17 @@ package main
 import (
 	_ "net/http/pprof"
 
+	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/pmorie/go-sti"
 	"github.com/smarterclayton/cobra"
@@ -18,7 +24,7 @@ func parseEnvs(envStr string) (map[string]string, error) {
 		return nil, nil
 	}
 
-	var envs map[string]string
+	envs := make(map[string]string)
 	pairs := strings.Split(envStr, ",")
 
 	for _, pair := range pairs {
@@ -37,12 +43,87 @@ func parseEnvs(envStr string) (map[string]string, error) {
 	return envs, nil
 }
 
+// Returns a channel that is closed when the process is interrupted or terminated, so
+// that sti can release the resources of a request before exiting.
+func cancelOnSignal() <-chan struct{} {
+	cancel := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		<-signals
+		fmt.Println("Cancelling...")
+		close(cancel)
+	}()
+
+	return cancel
+}
+
+// Formats an environment as NAME=VALUE,NAME2=VALUE2,..., sorted by name.
+func formatEnvs(envs map[string]string) string {
+	pairs := make([]string, 0, len(envs))
+	for key, value := range envs {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, ",")
+}
+
+// Splits a comma separated list, returning nil for an empty string.
+func parseList(listStr string) []string {
+	if listStr == "" {
+		return nil
+	}
+
+	return strings.Split(listStr, ",")
+}
+
+// Returns req with a logger writing to standard error in the given format, text or
+// json, and a tracer exporting to the given OTLP endpoint, if any.
+func configureRequest(req sti.Request, logFormat, otlpEndpoint string) sti.Request {
+	level := sti.LevelInfo
+	if req.Debug {
+		level = sti.LevelDebug
+	}
+
+	if logFormat == "json" {
+		req.Logger = sti.NewJSONLogger(os.Stderr, level)
+	} else {
+		req.Logger = sti.NewTextLogger(os.Stderr, level)
+	}
+
+	if otlpEndpoint != "" {
+		req.Tracer = sti.NewTracer("sti", sti.NewOTLPExporter(otlpEndpoint))
+	}
+
+	return req
+}
+
 func Execute() {
 	var (
-		req         sti.Request
-		envString   string
-		buildReq    sti.BuildRequest
-		validateReq sti.ValidateRequest
+		req          sti.Request
+		logFormat    string
+		otlpEndpoint string
+		envString    string
+		sparseString string
+		buildReq     sti.BuildRequest
+		rebuildReq   sti.RebuildRequest
+		validateReq  sti.ValidateRequest
+		gcReq        sti.GCRequest
+		pruneReq     sti.PruneRequest
+		testerReq    sti.TestBuilderRequest
+		listenAddr   string
+		serverToken  string
+		retention    int
+		allowLocal   bool
+		hooksConfig  string
+		insecure     bool
+		metricsFile  string
+		outputFormat string
+		methodsStr   string
+		verbose      bool
+		concurrency  int
 	)
 
 	stiCmd := &cobra.Command{
@@ -56,32 +137,40 @@ func Execute() {
 	}
 	stiCmd.PersistentFlags().StringVarP(&(req.DockerSocket), "url", "U", "unix:///var/run/docker.sock", "Set the url of the docker socket to use")
 	stiCmd.PersistentFlags().BoolVar(&(req.Debug), "debug", false, "Enable debugging output")
+	stiCmd.PersistentFlags().StringVar(&logFormat, "log-format", "text", "Set the format of log messages: text or json")
+	stiCmd.PersistentFlags().StringVar(&otlpEndpoint, "otlp-endpoint", os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"), "Export traces of builds to this OpenTelemetry collector URL")
 
 	buildCmd := &cobra.Command{
 		Use:   "build SOURCE BUILD_IMAGE APP_IMAGE_TAG",
 		Short: "Build an image",
 		Long:  "Build an image",
 		Run: func(cmd *cobra.Command, args []string) {
-			buildReq.Request = req
+			buildReq.Request = configureRequest(req, logFormat, otlpEndpoint)
 			buildReq.Source = args[0]
 			buildReq.BaseImage = args[1]
 			buildReq.Tag = args[2]
 			buildReq.Writer = os.Stdout
 
-			envs, _ := parseEnvs(envString)
+			envs, err := parseEnvs(envString)
+			if err != nil {
+				fmt.Printf("An error occured: %s\n", err.Error())
+				os.Exit(1)
+			}
 			buildReq.Environment = envs
+			buildReq.SparsePaths = parseList(sparseString)
 
-			if buildReq.WorkingDir == "tempdir" {
-				var err error
-				buildReq.WorkingDir, err = ioutil.TempDir("", "sti")
-				if err != nil {
-					fmt.Println(err.Error())
-					return
-				}
-				defer os.Remove(buildReq.WorkingDir)
+			buildReq.Cancel = cancelOnSignal()
+			if metricsFile != "" {
+				buildReq.Metrics = sti.NewMetrics()
 			}
 
 			res, err := sti.Build(buildReq)
+			if metricsFile != "" {
+				metricsErr := buildReq.Metrics.WriteFile(metricsFile)
+				if metricsErr != nil {
+					fmt.Printf("Unable to write metrics: %s\n", metricsErr.Error())
+				}
+			}
 			if err != nil {
 				fmt.Printf("An error occured: %s\n", err.Error())
 				return
@@ -93,19 +182,58 @@ func Execute() {
 		},
 	}
 	buildCmd.Flags().BoolVar(&(buildReq.Clean), "clean", false, "Perform a clean build")
-	buildCmd.Flags().StringVar(&(req.WorkingDir), "dir", "tempdir", "Directory where generated Dockerfiles and other support scripts are created")
+	buildCmd.Flags().StringVar(&(req.WorkingDir), "dir", "", "Directory where generated Dockerfiles and other support scripts are created; defaults to the system temporary directory")
 	buildCmd.Flags().StringVarP(&(req.RuntimeImage), "runtime", "R", "", "Set the runtime image to use")
 	buildCmd.Flags().StringVarP(&envString, "env", "e", "", "Specify an environment var NAME=VALUE,NAME2=VALUE2,...")
-	buildCmd.Flags().StringVarP(&(buildReq.Method), "method", "m", "build", "Specify a method to build with. build -> 'docker build', run -> 'docker run'")
+	buildCmd.Flags().StringVarP(&(buildReq.Method), "method", "m", "", "Specify a method to build with. build -> 'docker build', run -> 'docker run'; defaults to the first one the image supports")
+	buildCmd.Flags().StringVar(&(buildReq.CopyMode), "copy-mode", "copy", "Specify how a local source is copied: copy, link (hard links) or reflink (copy-on-write clones)")
+	buildCmd.Flags().BoolVar(&(buildReq.WorkingTree), "working-tree", false, "Build a local git repository from its working tree, including uncommitted changes")
+	buildCmd.Flags().BoolVar(&(buildReq.ExcludeUntracked), "exclude-untracked", false, "Leave files not tracked by git out of a working tree build")
+	buildCmd.Flags().IntVar(&(buildReq.CloneDepth), "depth", 0, "Truncate the history of a cloned git source to this many commits")
+	buildCmd.Flags().BoolVar(&(buildReq.Submodules), "submodules", false, "Check out the submodules of a git source, recursively")
+	buildCmd.Flags().StringVar(&sparseString, "sparse", "", "Check out only these paths of a git source PATH,PATH2,...")
+	buildCmd.Flags().StringVar(&(buildReq.Ref), "ref", "", "Branch, tag or commit of a git source to build")
+	buildCmd.Flags().StringVar(&(buildReq.ContextDir), "context-dir", "", "Specify a directory within the source to use as the application source")
+	buildCmd.Flags().StringVar(&(buildReq.TagLockPolicy), "tag-lock", "wait", "Specify what to do while another build of the tag is in progress: wait or fail")
+	buildCmd.Flags().StringVar(&metricsFile, "metrics-file", "", "Write metrics of the build to this file in the Prometheus text format")
 	stiCmd.AddCommand(buildCmd)
 
+	rebuildCmd := &cobra.Command{
+		Use:   "rebuild APP_IMAGE_TAG",
+		Short: "Rebuild an image",
+		Long:  "Build an image again with the source, images, environment and options recorded when it was built",
+		Run: func(cmd *cobra.Command, args []string) {
+			rebuildReq.Request = configureRequest(req, logFormat, otlpEndpoint)
+			rebuildReq.Tag = args[0]
+			rebuildReq.Writer = os.Stdout
+			rebuildReq.Cancel = cancelOnSignal()
+
+			res, err := sti.Rebuild(rebuildReq)
+			if err != nil {
+				fmt.Printf("An error occured: %s\n", err.Error())
+				return
+			}
+
+			for _, message := range res.Messages {
+				fmt.Println(message)
+			}
+		},
+	}
+	rebuildCmd.Flags().StringVarP(&(req.BaseImage), "builder", "B", "", "Set the build image to use instead of the recorded one")
+	rebuildCmd.Flags().StringVarP(&(req.RuntimeImage), "runtime", "R", "", "Set the runtime image to use instead of the recorded one")
+	rebuildCmd.Flags().StringVar(&(rebuildReq.Ref), "ref", "", "Branch, tag or commit of a git source to build instead of the recorded one")
+	rebuildCmd.Flags().BoolVar(&(rebuildReq.Clean), "clean", false, "Perform a clean build")
+	rebuildCmd.Flags().StringVar(&(req.WorkingDir), "dir", "", "Directory where generated Dockerfiles and other support scripts are created; defaults to the system temporary directory")
+	stiCmd.AddCommand(rebuildCmd)
+
 	validateCmd := &cobra.Command{
 		Use:   "validate BUILD_IMAGE",
 		Short: "Validate an image",
 		Long:  "Validate an image and optional runtime image",
 		Run: func(cmd *cobra.Command, args []string) {
-			validateReq.Request = req
+			validateReq.Request = configureRequest(req, logFormat, otlpEndpoint)
 			validateReq.BaseImage = args[0]
+			validateReq.Cancel = cancelOnSignal()
 			res, err := sti.Validate(validateReq)
 
 			if err != nil {
@@ -113,15 +241,246 @@ func Execute() {
 				return
 			}
 
-			for _, message := range res.Messages {
-				fmt.Println(message)
+			if outputFormat == "json" {
+				encoded, _ := json.MarshalIndent(res, "", "  ")
+				fmt.Println(string(encoded))
+			} else {
+				res.WriteText(os.Stdout)
 			}
 		},
 	}
 	validateCmd.Flags().StringVarP(&(req.RuntimeImage), "runtime", "R", "", "Set the runtime image to use")
 	validateCmd.Flags().BoolVarP(&(validateReq.Incremental), "incremental", "I", false, "Validate for an incremental build")
+	validateCmd.Flags().StringVarP(&outputFormat, "format", "f", "text", "Set the format of the result: text or json")
 	stiCmd.AddCommand(validateCmd)
 
+	usageCmd := &cobra.Command{
+		Use:   "usage BUILD_IMAGE",
+		Short: "Print the usage of an image",
+		Long:  "Print the usage of a build image, as reported by its /usr/bin/usage script",
+		Run: func(cmd *cobra.Command, args []string) {
+			usageReq := sti.UsageRequest{Request: configureRequest(req, logFormat, otlpEndpoint)}
+			usageReq.BaseImage = args[0]
+			usageReq.Cancel = cancelOnSignal()
+
+			res, err := sti.Usage(usageReq)
+			if err != nil {
+				fmt.Printf("An error occured: %s\n", err.Error())
+				return
+			}
+
+			fmt.Print(res.Output)
+		},
+	}
+	stiCmd.AddCommand(usageCmd)
+
+	testBuilderCmd := &cobra.Command{
+		Use:   "test-builder BUILD_IMAGE",
+		Short: "Test a builder image",
+		Long:  "Validate a builder image, build a sample application with it with each build method, cleanly and incrementally, and run the images built",
+		Run: func(cmd *cobra.Command, args []string) {
+			testerReq.Request = configureRequest(req, logFormat, otlpEndpoint)
+			testerReq.BaseImage = args[0]
+			testerReq.Methods = parseList(methodsStr)
+			testerReq.Cancel = cancelOnSignal()
+
+			envs, err := parseEnvs(envString)
+			if err != nil {
+				fmt.Printf("An error occured: %s\n", err.Error())
+				os.Exit(1)
+			}
+			testerReq.Environment = envs
+			if verbose {
+				testerReq.Writer = os.Stdout
+			}
+
+			res, err := sti.TestBuilder(testerReq)
+			if err != nil {
+				fmt.Printf("An error occured: %s\n", err.Error())
+				os.Exit(1)
+			}
+
+			if outputFormat == "json" {
+				encoded, _ := json.MarshalIndent(res, "", "  ")
+				fmt.Println(string(encoded))
+			} else {
+				res.WriteText(os.Stdout)
+			}
+			if !res.Success {
+				os.Exit(1)
+			}
+		},
+	}
+	testBuilderCmd.Flags().StringVarP(&(testerReq.App), "app", "a", "", "Set the source of the sample application to build")
+	testBuilderCmd.Flags().StringVar(&(req.WorkingDir), "dir", "", "Directory where the builds create their working directories; defaults to the system temporary directory")
+	testBuilderCmd.Flags().StringVarP(&(req.RuntimeImage), "runtime", "R", "", "Set the runtime image to use")
+	testBuilderCmd.Flags().StringVarP(&envString, "env", "e", "", "Specify an environment var NAME=VALUE,NAME2=VALUE2,...")
+	testBuilderCmd.Flags().StringVarP(&methodsStr, "methods", "m", "", "Specify the build methods to test METHOD,METHOD2,...; defaults to those the image supports")
+	testBuilderCmd.Flags().IntVarP(&(testerReq.Port), "port", "p", 0, "Check that the application responds over HTTP on this port, rather than that it exits successfully")
+	testBuilderCmd.Flags().StringVar(&(testerReq.Path), "path", "/", "Set the path requested from the application when checking its port")
+	testBuilderCmd.Flags().DurationVar(&(testerReq.Timeout), "timeout", time.Minute, "Set how long the application has to respond or exit")
+	testBuilderCmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "Show the output of the builds")
+	testBuilderCmd.Flags().StringVarP(&outputFormat, "format", "f", "text", "Set the format of the result: text or json")
+	stiCmd.AddCommand(testBuilderCmd)
+
+	scaffoldReq := sti.ScaffoldRequest{}
+	initCmd := &cobra.Command{
+		Use:   "init IMAGE_NAME",
+		Short: "Generate the skeleton of a builder image",
+		Long:  "Generate a Dockerfile, script stubs, a sample application and a Makefile for a new builder image",
+		Run: func(cmd *cobra.Command, args []string) {
+			scaffoldReq.Name = args[0]
+
+			res, err := sti.Scaffold(scaffoldReq)
+			if err != nil {
+				fmt.Printf("An error occured: %s\n", err.Error())
+				return
+			}
+
+			for _, file := range res.Files {
+				fmt.Printf("Created %s\n", filepath.Join(res.Dir, file))
+			}
+		},
+	}
+	initCmd.Flags().StringVarP(&(scaffoldReq.Dir), "dir", "d", "", "Set the directory to generate the skeleton in; defaults to the image name")
+	initCmd.Flags().StringVar(&(scaffoldReq.From), "from", "centos", "Set the image the builder image is built from")
+	initCmd.Flags().BoolVar(&(scaffoldReq.Extended), "extended", false, "Generate a build image and a runtime image for extended builds")
+	stiCmd.AddCommand(initCmd)
+
+	inspectCmd := &cobra.Command{
+		Use:   "inspect APP_IMAGE_TAG",
+		Short: "Show build metadata of an image",
+		Long:  "Show the metadata recorded by sti when an image was built",
+		Run: func(cmd *cobra.Command, args []string) {
+			inspectReq := sti.InspectRequest{Request: configureRequest(req, logFormat, otlpEndpoint), Tag: args[0]}
+			metadata, err := sti.Inspect(inspectReq)
+			if err != nil {
+				fmt.Printf("An error occured: %s\n", err.Error())
+				return
+			}
+
+			fmt.Printf("Tag:           %s\n", metadata.Tag)
+			fmt.Printf("Source:        %s\n", metadata.Source)
+			fmt.Printf("Commit:        %s\n", metadata.Commit)
+			fmt.Printf("Dirty:         %t\n", metadata.Dirty)
+			fmt.Printf("Context dir:   %s\n", metadata.ContextDir)
+			fmt.Printf("Ref:           %s\n", metadata.Ref)
+			fmt.Printf("Builder:       %s\n", metadata.BuilderName)
+			fmt.Printf("Builder image: %s\n", metadata.BuilderImage)
+			fmt.Printf("Runtime:       %s\n", metadata.RuntimeName)
+			fmt.Printf("Runtime image: %s\n", metadata.RuntimeImage)
+			fmt.Printf("Method:        %s\n", metadata.Method)
+			fmt.Printf("Environment:   %s\n", formatEnvs(metadata.Environment))
+			fmt.Printf("Incremental:   %t\n", metadata.Incremental)
+			fmt.Printf("sti version:   %s\n", metadata.Version)
+		},
+	}
+	stiCmd.AddCommand(inspectCmd)
+
+	gcCmd := &cobra.Command{
+		Use:   "gc",
+		Short: "Remove leftovers of interrupted builds",
+		Long:  "Remove the containers, working directories and temporary files left behind by sti runs that did not finish",
+		Run: func(cmd *cobra.Command, args []string) {
+			gcReq.Request = configureRequest(req, logFormat, otlpEndpoint)
+
+			res, err := sti.GC(gcReq)
+			if err != nil {
+				fmt.Printf("An error occured: %s\n", err.Error())
+				return
+			}
+
+			verb := "Removed"
+			if gcReq.DryRun {
+				verb = "Would remove"
+			}
+
+			for _, id := range res.Containers {
+				fmt.Printf("%s container %s\n", verb, id)
+			}
+			for _, path := range res.Paths {
+				fmt.Printf("%s %s\n", verb, path)
+			}
+		},
+	}
+	gcCmd.Flags().StringVar(&(req.WorkingDir), "dir", "", "Directory containing the working directories of builds; defaults to the system temporary directory")
+	gcCmd.Flags().DurationVar(&(gcReq.OlderThan), "older-than", time.Hour, "Only remove containers and files older than this")
+	gcCmd.Flags().BoolVar(&(gcReq.DryRun), "dry-run", false, "Show what would be removed without removing it")
+	stiCmd.AddCommand(gcCmd)
+
+	pruneCmd := &cobra.Command{
+		Use:   "prune",
+		Short: "Remove images of previous builds",
+		Long:  "Remove the images of previous builds of each tag, keeping the most recent ones, and the stopped containers created by sti",
+		Run: func(cmd *cobra.Command, args []string) {
+			pruneReq.Request = configureRequest(req, logFormat, otlpEndpoint)
+
+			res, err := sti.Prune(pruneReq)
+			if err != nil {
+				fmt.Printf("An error occured: %s\n", err.Error())
+				return
+			}
+
+			verb := "Removed"
+			if pruneReq.DryRun {
+				verb = "Would remove"
+			}
+
+			for _, id := range res.Containers {
+				fmt.Printf("%s container %s\n", verb, id)
+			}
+			for _, id := range res.Images {
+				fmt.Printf("%s image %s\n", verb, id)
+			}
+		},
+	}
+	pruneCmd.Flags().IntVarP(&(pruneReq.Keep), "keep", "k", 1, "Set the number of images to keep for each tag")
+	pruneCmd.Flags().DurationVar(&(pruneReq.OlderThan), "older-than", time.Hour, "Only remove images and containers older than this")
+	pruneCmd.Flags().BoolVar(&(pruneReq.DryRun), "dry-run", false, "Show what would be removed without removing it")
+	stiCmd.AddCommand(pruneCmd)
+
+	serveCmd := &cobra.Command{
+		Use:   "serve",
+		Short: "Serve builds over HTTP",
+		Long:  "Serve a REST API for submitting builds and validations",
+		Run: func(cmd *cobra.Command, args []string) {
+			serverReq := configureRequest(req, logFormat, otlpEndpoint)
+
+			server := sti.NewServer(serverReq, concurrency)
+			server.Token = serverToken
+			server.Retention = retention
+			server.AllowLocalSources = allowLocal
+			if hooksConfig != "" {
+				webhooks, err := sti.LoadWebhookConfig(hooksConfig)
+				if err != nil {
+					fmt.Printf("An error occured: %s\n", err.Error())
+					return
+				}
+				if webhooks.Secret == "" && !(webhooks.Insecure || insecure) {
+					fmt.Printf("An error occured: %s has no Secret to verify webhooks with; set one, or accept unverified webhooks with --insecure\n", hooksConfig)
+					return
+				}
+				webhooks.Insecure = webhooks.Insecure || insecure
+				server.Webhooks = webhooks
+			}
+
+			fmt.Printf("Listening on %s\n", listenAddr)
+			err := http.ListenAndServe(listenAddr, server)
+			if err != nil {
+				fmt.Printf("An error occured: %s\n", err.Error())
+			}
+		},
+	}
+	serveCmd.Flags().StringVarP(&listenAddr, "listen", "l", "127.0.0.1:8080", "Set the address to listen on")
+	serveCmd.Flags().IntVarP(&concurrency, "concurrency", "c", 2, "Set the number of builds to perform at once")
+	serveCmd.Flags().StringVar(&serverToken, "token", os.Getenv("STI_SERVER_TOKEN"), "Require this bearer token on every request other than webhooks")
+	serveCmd.Flags().IntVar(&retention, "retention", sti.DefaultRetention, "Set the number of finished builds to remember")
+	serveCmd.Flags().BoolVar(&allowLocal, "allow-local-sources", false, "Build submitted sources that are local paths, not only git URLs")
+	serveCmd.Flags().StringVar(&(req.WorkingDir), "dir", "", "Directory where builds create their working directories; defaults to the system temporary directory")
+	serveCmd.Flags().StringVar(&hooksConfig, "hooks", "", "Build pushes received by webhook as configured in this JSON file")
+	serveCmd.Flags().BoolVar(&insecure, "insecure", false, "Accept webhooks without verifying them if the webhook configuration has no secret")
+	stiCmd.AddCommand(serveCmd)
+
 	stiCmd.Execute()
 }
 
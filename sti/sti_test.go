@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	. "launchpad.net/gocheck"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type CLISuite struct{}
+
+var _ = Suite(&CLISuite{})
+
+// Runs sti with the JSON encoded arguments of STI_TEST_ARGS, when the test binary is
+// run by runSti rather than to run the tests.
+func TestSti(t *testing.T) {
+	encoded := os.Getenv("STI_TEST_ARGS")
+	if encoded == "" {
+		return
+	}
+
+	var args []string
+	if err := json.Unmarshal([]byte(encoded), &args); err != nil {
+		t.Fatal(err)
+	}
+	os.Args = append([]string{"sti"}, args...)
+	main()
+	os.Exit(0)
+}
+
+// Runs sti with the arguments in a separate process, returning its output and whether
+// it exited successfully.
+func runSti(c *C, args ...string) (string, bool) {
+	encoded, err := json.Marshal(args)
+	c.Assert(err, IsNil)
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestSti$")
+	cmd.Env = append(os.Environ(), "STI_TEST_ARGS="+string(encoded))
+	out, err := cmd.CombinedOutput()
+	if _, exited := err.(*exec.ExitError); err != nil && !exited {
+		c.Fatal(err)
+	}
+
+	return string(out), err == nil
+}
+
+// An address no docker daemon listens on, so that requests fail promptly.
+const noDocker = "tcp://127.0.0.1:1"
+
+// Test that a malformed environment fails test-builder before anything is run
+func (s *CLISuite) TestTestBuilderMalformedEnv(c *C) {
+	out, ok := runSti(c, "test-builder", "test/builder", "--app", c.MkDir(), "-U", noDocker, "-e", "A=1,BROKEN")
+	c.Assert(ok, Equals, false)
+	c.Assert(out, Matches, "(?s)An error occured: Malformed env string: BROKEN\n.*")
+}
+
+// Test that test-builder accepts an environment, going on to test the image
+func (s *CLISuite) TestTestBuilderEnv(c *C) {
+	out, _ := runSti(c, "test-builder", "test/builder", "--app", c.MkDir(), "-U", noDocker, "-e", "A=1,B=2")
+	c.Assert(strings.Contains(out, "panic"), Equals, false, Commentf(out))
+	c.Assert(strings.Contains(out, "Malformed"), Equals, false, Commentf(out))
+}
+
+// Test that a malformed environment fails a build before anything is run
+func (s *CLISuite) TestBuildMalformedEnv(c *C) {
+	out, ok := runSti(c, "build", c.MkDir(), "test/builder", "test/app", "-U", noDocker, "-e", "BROKEN")
+	c.Assert(ok, Equals, false)
+	c.Assert(out, Matches, "(?s)An error occured: Malformed env string: BROKEN\n.*")
+}
+
+// Test parsing environments given as NAME=VALUE,NAME2=VALUE2
+func (s *CLISuite) TestParseEnvs(c *C) {
+	envs, err := parseEnvs("A=1,B=2")
+	c.Assert(err, IsNil)
+	c.Assert(envs, DeepEquals, map[string]string{"A": "1", "B": "2"})
+
+	envs, err = parseEnvs("")
+	c.Assert(err, IsNil)
+	c.Assert(envs, HasLen, 0)
+
+	_, err = parseEnvs("A=1,B")
+	c.Assert(err, ErrorMatches, "Malformed env string: B")
+}
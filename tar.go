@@ -0,0 +1,172 @@
+package sti
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Identifies a file on the host, so that hard links to it can be detected.
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+// tarBuilder writes the entries of a source tree to a tarball.
+type tarBuilder struct {
+	tw      *tar.Writer
+	modTime time.Time
+	// names of regular files with more than one link, by file
+	links map[fileID]string
+}
+
+// Returns the modification time recorded for every entry of a build context tarball:
+// the time given by SOURCE_DATE_EPOCH, in seconds since the unix epoch, or the unix
+// epoch itself if SOURCE_DATE_EPOCH is not set.
+func sourceDateEpoch() (time.Time, error) {
+	epoch := os.Getenv("SOURCE_DATE_EPOCH")
+	if epoch == "" {
+		return time.Unix(0, 0), nil
+	}
+
+	seconds, err := strconv.ParseInt(epoch, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return time.Unix(seconds, 0), nil
+}
+
+// Writes the entry for the file at path, named name within the tarball.  Entries are
+// normalized so that identical trees produce identical tarballs: timestamps are set
+// to the builder's modTime and ownership to root.  Symlinks are written as links rather
+// than followed, and further links to a regular file already in the tarball are written
+// as hard links to it.
+func (b *tarBuilder) writeTar(path string, name string, fi os.FileInfo) error {
+	var link string
+	if fi.Mode()&os.ModeSymlink != 0 {
+		var err error
+		link, err = os.Readlink(path)
+		if err != nil {
+			return err
+		}
+	}
+
+	h, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		return err
+	}
+
+	h.Name = name
+	if fi.IsDir() {
+		h.Name += "/"
+	}
+	h.ModTime = b.modTime
+	h.AccessTime = time.Time{}
+	h.ChangeTime = time.Time{}
+	h.Uid, h.Gid = 0, 0
+	h.Uname, h.Gname = "", ""
+
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		if fi.Mode()&os.ModeDevice != 0 {
+			h.Devmajor, h.Devminor = deviceNumbers(uint64(st.Rdev))
+		}
+
+		if fi.Mode().IsRegular() && st.Nlink > 1 {
+			id := fileID{uint64(st.Dev), uint64(st.Ino)}
+			if target, ok := b.links[id]; ok {
+				h.Typeflag = tar.TypeLink
+				h.Linkname = target
+				h.Size = 0
+			} else {
+				b.links[id] = name
+			}
+		}
+	}
+
+	err = b.tw.WriteHeader(h)
+	if err != nil {
+		return err
+	}
+
+	if h.Typeflag != tar.TypeReg {
+		return nil
+	}
+
+	fr, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fr.Close()
+
+	_, err = io.Copy(b.tw, fr)
+	return err
+}
+
+// Splits a linux device number into its major and minor numbers.
+func deviceNumbers(rdev uint64) (int64, int64) {
+	major := (rdev>>8)&0xfff | (rdev>>32)&^0xfff
+	minor := rdev&0xff | (rdev>>12)&^0xff
+	return int64(major), int64(minor)
+}
+
+// Writes a tarball of the contents of dir to w.  Entries are written in the lexical
+// order of filepath.Walk, so the same tree always produces the same tarball.
+// Directories, symlinks, hard links, devices and named pipes are preserved; sockets
+// are skipped, since tar cannot represent them.
+func writeTarball(w io.Writer, dir string) error {
+	modTime, err := sourceDateEpoch()
+	if err != nil {
+		return err
+	}
+
+	b := &tarBuilder{tw: tar.NewWriter(w), modTime: modTime, links: make(map[fileID]string)}
+
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if path == dir {
+			return nil
+		}
+
+		if info.Mode()&os.ModeSocket != 0 {
+			return nil
+		}
+
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		return b.writeTar(path, filepath.ToSlash(name), info)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return b.tw.Close()
+}
+
+// Writes a tarball of dir to the file at path, which must not exist.
+func tarDirectory(dir string, path string) (*os.File, error) {
+	fw, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer fw.Close()
+
+	err = writeTarball(fw, dir)
+	if err != nil {
+		os.Remove(fw.Name())
+		return nil, err
+	}
+
+	return fw, nil
+}
@@ -0,0 +1,170 @@
+package sti
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	. "launchpad.net/gocheck"
+)
+
+type TarSuite struct{}
+
+var _ = Suite(&TarSuite{})
+
+// Creates a small source tree under dir.
+func makeSourceTree(c *C, dir string) {
+	c.Assert(os.MkdirAll(filepath.Join(dir, "lib", "empty"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "index.html"), []byte("hello"), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "lib", "app.rb"), []byte("puts 1"), 0755), IsNil)
+	c.Assert(os.Symlink("lib/app.rb", filepath.Join(dir, "app")), IsNil)
+}
+
+func (s *TarSuite) tarball(c *C, dir string) []byte {
+	var buf bytes.Buffer
+	c.Assert(writeTarball(&buf, dir), IsNil)
+	return buf.Bytes()
+}
+
+// Test that identical trees with different timestamps produce identical tarballs
+func (s *TarSuite) TestTarballIsDeterministic(c *C) {
+	first, second := c.MkDir(), c.MkDir()
+	makeSourceTree(c, first)
+	makeSourceTree(c, second)
+
+	later := time.Now().Add(time.Hour)
+	c.Assert(os.Chtimes(filepath.Join(second, "index.html"), later, later), IsNil)
+
+	c.Assert(s.tarball(c, first), DeepEquals, s.tarball(c, second))
+}
+
+// Test that SOURCE_DATE_EPOCH sets the timestamp of every entry
+func (s *TarSuite) TestSourceDateEpoch(c *C) {
+	defer os.Setenv("SOURCE_DATE_EPOCH", os.Getenv("SOURCE_DATE_EPOCH"))
+	os.Setenv("SOURCE_DATE_EPOCH", "1400000000")
+
+	modTime, err := sourceDateEpoch()
+	c.Assert(err, IsNil)
+	c.Assert(modTime.Unix(), Equals, int64(1400000000))
+
+	os.Setenv("SOURCE_DATE_EPOCH", "yesterday")
+	_, err = sourceDateEpoch()
+	c.Assert(err, NotNil)
+}
+
+// Reads back the headers and contents of a tarball, by entry name.
+func (s *TarSuite) readTarball(c *C, data []byte) (map[string]*tar.Header, map[string]string) {
+	headers := make(map[string]*tar.Header)
+	contents := make(map[string]string)
+
+	tr := tar.NewReader(bytes.NewReader(data))
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, IsNil)
+
+		content, err := ioutil.ReadAll(tr)
+		c.Assert(err, IsNil)
+
+		headers[h.Name] = h
+		contents[h.Name] = string(content)
+	}
+
+	return headers, contents
+}
+
+// Test that directories, including empty ones, keep their permissions
+func (s *TarSuite) TestDirectories(c *C) {
+	dir := c.MkDir()
+	c.Assert(os.MkdirAll(filepath.Join(dir, "private", "empty"), 0755), IsNil)
+	c.Assert(os.Chmod(filepath.Join(dir, "private"), 0700), IsNil)
+
+	headers, _ := s.readTarball(c, s.tarball(c, dir))
+
+	c.Assert(headers["private/"], NotNil)
+	c.Assert(headers["private/"].Typeflag, Equals, byte(tar.TypeDir))
+	c.Assert(headers["private/"].Mode&0777, Equals, int64(0700))
+	c.Assert(headers["private/empty/"], NotNil)
+	c.Assert(headers["private/empty/"].Typeflag, Equals, byte(tar.TypeDir))
+}
+
+// Test that symlinks are stored as links, not followed, even when dangling or
+// pointing at directories
+func (s *TarSuite) TestSymlinks(c *C) {
+	dir := c.MkDir()
+	c.Assert(os.Mkdir(filepath.Join(dir, "lib"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "lib", "app.rb"), []byte("puts 1"), 0644), IsNil)
+	c.Assert(os.Symlink("lib", filepath.Join(dir, "vendor")), IsNil)
+	c.Assert(os.Symlink("/nonexistent/target", filepath.Join(dir, "dangling")), IsNil)
+
+	headers, _ := s.readTarball(c, s.tarball(c, dir))
+
+	c.Assert(headers["vendor"], NotNil)
+	c.Assert(headers["vendor"].Typeflag, Equals, byte(tar.TypeSymlink))
+	c.Assert(headers["vendor"].Linkname, Equals, "lib")
+	c.Assert(headers["vendor/app.rb"], IsNil)
+	c.Assert(headers["dangling"], NotNil)
+	c.Assert(headers["dangling"].Typeflag, Equals, byte(tar.TypeSymlink))
+	c.Assert(headers["dangling"].Linkname, Equals, "/nonexistent/target")
+}
+
+// Test that further links to a file are stored as hard links to its first entry
+func (s *TarSuite) TestHardLinks(c *C) {
+	dir := c.MkDir()
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "a"), []byte("shared"), 0644), IsNil)
+	c.Assert(os.Link(filepath.Join(dir, "a"), filepath.Join(dir, "b")), IsNil)
+
+	headers, contents := s.readTarball(c, s.tarball(c, dir))
+
+	c.Assert(headers["a"].Typeflag, Equals, byte(tar.TypeReg))
+	c.Assert(contents["a"], Equals, "shared")
+	c.Assert(headers["b"].Typeflag, Equals, byte(tar.TypeLink))
+	c.Assert(headers["b"].Linkname, Equals, "a")
+}
+
+// Test that named pipes are preserved
+func (s *TarSuite) TestNamedPipes(c *C) {
+	dir := c.MkDir()
+	c.Assert(syscall.Mkfifo(filepath.Join(dir, "pipe"), 0600), IsNil)
+
+	headers, _ := s.readTarball(c, s.tarball(c, dir))
+
+	c.Assert(headers["pipe"], NotNil)
+	c.Assert(headers["pipe"].Typeflag, Equals, byte(tar.TypeFifo))
+}
+
+// Test that entry names are relative to the tarred directory, even when a nested
+// directory repeats its path
+func (s *TarSuite) TestNestedDuplicateNames(c *C) {
+	dir := filepath.Join(c.MkDir(), "src")
+	nested := filepath.Join(dir, "src", "src")
+	c.Assert(os.MkdirAll(nested, 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(nested, "file"), []byte("deep"), 0644), IsNil)
+
+	headers, contents := s.readTarball(c, s.tarball(c, dir))
+
+	c.Assert(headers["src/src/file"], NotNil)
+	c.Assert(contents["src/src/file"], Equals, "deep")
+}
+
+// Test that paths too long for the basic tar header survive
+func (s *TarSuite) TestLongPaths(c *C) {
+	dir := c.MkDir()
+	long := filepath.Join(strings.Repeat("directory/", 20), strings.Repeat("f", 120))
+	c.Assert(os.MkdirAll(filepath.Join(dir, filepath.Dir(long)), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, long), []byte("long"), 0644), IsNil)
+	c.Assert(os.Symlink(long, filepath.Join(dir, "link")), IsNil)
+
+	headers, contents := s.readTarball(c, s.tarball(c, dir))
+
+	c.Assert(contents[long], Equals, "long")
+	c.Assert(headers["link"].Linkname, Equals, long)
+}
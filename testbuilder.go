@@ -0,0 +1,406 @@
+package sti
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// Describes a request to test a builder image end to end: validating it, building a
+// sample application with it with each build method, cleanly and incrementally, and
+// checking that each image built runs.
+type TestBuilderRequest struct {
+	Request
+	// Source of the sample application, as for BuildRequest
+	App         string
+	Environment map[string]string
+	// Build methods to test; defaults to those the image declares
+	Methods []string
+
+	// Port the sample application serves HTTP on.  If set, a built image passes when
+	// the application responds on the port; otherwise it passes when it exits
+	// successfully.
+	Port int
+	// Path requested from the application when probing Port; defaults to /
+	Path string
+	// How long a built image has to respond or exit; defaults to a minute
+	Timeout time.Duration
+
+	// Receives the output of the builds, if set.
+	Writer io.Writer `json:"-"`
+}
+
+// Kinds of builds of a builder test.
+const (
+	BuildClean       = "clean"
+	BuildIncremental = "incremental"
+)
+
+// Status of a step of a builder test that was not performed, because an earlier step
+// failed or the image does not support it.
+const CheckSkipped = "skipped"
+
+// Prefix of the tags of images built by builder tests.
+const testBuilderTagPrefix = "sti-test-builder-"
+
+// Interval between attempts to reach a built application over HTTP.
+const probeInterval = time.Second
+
+// The outcome of building the sample application with one method and kind of build,
+// and of running the image built.  Detail explains the first step that did not pass.
+type BuilderTestCase struct {
+	Method string
+	Kind   string
+	Build  string
+	Run    string
+	Detail string
+}
+
+// The outcome of a builder test: the validation of the image and a case for each
+// build method and kind of build.  A builder test succeeds when the image is valid and
+// no case failed.
+type TestBuilderResult struct {
+	Success    bool
+	Validation *ValidateResult
+	Cases      []BuilderTestCase
+}
+
+func newBuilderTestCase(method string, kind string) BuilderTestCase {
+	return BuilderTestCase{Method: method, Kind: kind, Build: CheckSkipped, Run: CheckSkipped}
+}
+
+func (c BuilderTestCase) failed() bool {
+	return c.Build == CheckFailed || c.Run == CheckFailed
+}
+
+// Writes the result as text: the validation of the image, if it failed, and a matrix
+// of the cases.
+func (r *TestBuilderResult) WriteText(w io.Writer) error {
+	if !r.Validation.Success {
+		err := r.Validation.WriteText(w)
+		if err != nil {
+			return err
+		}
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "METHOD\tKIND\tBUILD\tRUN\tDETAIL")
+	for _, c := range r.Cases {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", c.Method, c.Kind, c.Build, c.Run, c.Detail)
+	}
+	err := tw.Flush()
+	if err != nil {
+		return err
+	}
+
+	if r.Success {
+		_, err = fmt.Fprintln(w, "Builder test passed")
+	} else {
+		_, err = fmt.Fprintln(w, "Builder test failed")
+	}
+	return err
+}
+
+// TestBuilder tests a builder image, and its runtime image if the request has one, by
+// validating it and building the sample application with it.  For each build method,
+// it performs a clean build, then an incremental build on top of it if the image
+// supports incremental builds, and runs each image built.  Cases that cannot be
+// performed, because the image is invalid or a previous build failed, are skipped.
+// The images built are removed.
+//
+// An error represents a failure performing the test rather than a failure of the
+// builder; callers should check the Success field of the result.
+func TestBuilder(req TestBuilderRequest) (*TestBuilderResult, error) {
+	for _, method := range req.Methods {
+		if !stringInSlice(method, defaultBuildMethods) {
+			return nil, ErrInvalidBuildMethod
+		}
+	}
+	if req.Path == "" {
+		req.Path = "/"
+	}
+	if req.Timeout == 0 {
+		req.Timeout = time.Minute
+	}
+
+	h, err := newHandler(req.Request)
+	if err != nil {
+		return nil, err
+	}
+	defer h.release()
+
+	done := make(chan struct{})
+	defer close(done)
+	go h.watchCancel(req.Cancel, done)
+
+	image, err := h.checkAndPull(req.BaseImage)
+	if err != nil {
+		return nil, err
+	}
+	// invalid capabilities are reported by validation
+	caps, _ := capabilitiesFromLabels(imageLabels(image))
+
+	validation, err := Validate(ValidateRequest{Request: req.Request, Incremental: caps.Incremental})
+	if err != nil {
+		return nil, err
+	}
+
+	methods := req.Methods
+	if len(methods) == 0 {
+		methods = caps.BuildMethods
+	}
+
+	result := &TestBuilderResult{Success: validation.Success, Validation: validation}
+	for _, method := range methods {
+		clean := newBuilderTestCase(method, BuildClean)
+		incremental := newBuilderTestCase(method, BuildIncremental)
+		if !validation.Success {
+			clean.Detail = "the image is not valid"
+			incremental.Detail = clean.Detail
+		} else {
+			err = h.testMethod(req, caps, &clean, &incremental)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		result.Cases = append(result.Cases, clean, incremental)
+		if clean.failed() || incremental.failed() {
+			result.Success = false
+		}
+	}
+
+	return result, nil
+}
+
+// Performs the clean and incremental cases of a builder test for one method, removing
+// the images built.
+func (h requestHandler) testMethod(req TestBuilderRequest, caps *Capabilities, clean *BuilderTestCase, incremental *BuilderTestCase) error {
+	id, err := newID()
+	if err != nil {
+		return err
+	}
+	tag := testBuilderTagPrefix + id + "-" + clean.Method
+
+	var images []string
+	defer func() {
+		h.removeTestImages(images)
+	}()
+
+	passed, err := h.testBuild(req, caps, clean, tag)
+	images = append(images, h.testImages(req, tag)...)
+	if err != nil || !passed {
+		incremental.Detail = "the clean case failed"
+		return err
+	}
+
+	if caps.declares(LabelIncremental) && !caps.Incremental {
+		incremental.Detail = "the image does not support incremental builds"
+		return nil
+	}
+
+	_, err = h.testBuild(req, caps, incremental, tag)
+	images = append(images, h.testImages(req, tag)...)
+	return err
+}
+
+// Performs a case of a builder test: builds the sample application with tag, and runs
+// the image built if the build passed.  An error is only returned when the test is
+// cancelled.
+func (h requestHandler) testBuild(req TestBuilderRequest, caps *Capabilities, c *BuilderTestCase, tag string) (bool, error) {
+	res, err := Build(BuildRequest{
+		Request:     req.Request,
+		Source:      req.App,
+		Tag:         tag,
+		Clean:       c.Kind == BuildClean,
+		Environment: req.Environment,
+		Method:      c.Method,
+		Writer:      req.Writer,
+	})
+	if h.resources.isCancelled() {
+		return false, ErrBuildCancelled
+	}
+
+	switch {
+	case err != nil:
+		c.Build = CheckFailed
+		c.Detail = err.Error()
+		return false, nil
+	case !res.Success:
+		c.Build = CheckFailed
+		c.Detail = strings.Join(res.Messages, "; ")
+		return false, nil
+	case c.Kind == BuildIncremental && !res.Metadata.Incremental:
+		// images that do not declare support for incremental builds are only built
+		// incrementally if they have a save-artifacts script
+		if !caps.Incremental {
+			c.Build = CheckSkipped
+			c.Detail = "the image does not support incremental builds"
+			return false, nil
+		}
+		c.Build = CheckFailed
+		c.Detail = "the build was not incremental"
+		return false, nil
+	}
+	c.Build = CheckPassed
+
+	err = h.testRun(req, tag)
+	if h.resources.isCancelled() {
+		return false, ErrBuildCancelled
+	}
+	if err != nil {
+		c.Run = CheckFailed
+		c.Detail = err.Error()
+		return false, nil
+	}
+	c.Run = CheckPassed
+
+	return true, nil
+}
+
+// Returns the IDs of the images a builder test build tagged.
+func (h requestHandler) testImages(req TestBuilderRequest, tag string) []string {
+	tags := []string{tag}
+	if req.RuntimeImage != "" {
+		tags = append(tags, tag+"-build")
+	}
+
+	var images []string
+	for _, tag := range tags {
+		id := h.imageID(tag)
+		if id != "" && !stringInSlice(id, images) {
+			images = append(images, id)
+		}
+	}
+
+	return images
+}
+
+// Removes the images built by a builder test, newest first so that images are removed
+// before those they were built on.
+func (h requestHandler) removeTestImages(images []string) {
+	for i := len(images) - 1; i >= 0; i-- {
+		if stringInSlice(images[i], images[i+1:]) {
+			continue
+		}
+
+		err := h.dockerClient.RemoveImage(images[i])
+		if err != nil {
+			h.log.Warn("Unable to remove test image", "image", images[i], "error", err)
+		}
+	}
+}
+
+// Runs an image built by a builder test with its default command, and checks that it
+// responds over HTTP on the port of the request or, without a port, that it exits
+// successfully, within the timeout of the request.
+func (h requestHandler) testRun(req TestBuilderRequest, tag string) error {
+	container, err := h.createContainer(docker.Config{Image: tag})
+	if err != nil {
+		return err
+	}
+	defer h.removeContainer(container.ID)
+
+	err = h.dockerClient.StartContainer(container.ID, &docker.HostConfig{})
+	if err != nil {
+		return err
+	}
+
+	if req.Port == 0 {
+		return h.waitForExit(container.ID, req.Timeout)
+	}
+
+	defer h.dockerClient.StopContainer(container.ID, 0)
+	return h.probeContainer(container.ID, req.Port, req.Path, req.Timeout)
+}
+
+// Waits for a container to exit successfully within timeout, stopping it if it does
+// not.
+func (h requestHandler) waitForExit(id string, timeout time.Duration) error {
+	exitCodes := make(chan int, 1)
+	errs := make(chan error, 1)
+	go func() {
+		exitCode, err := h.dockerClient.WaitContainer(id)
+		if err != nil {
+			errs <- err
+			return
+		}
+		exitCodes <- exitCode
+	}()
+
+	select {
+	case exitCode := <-exitCodes:
+		if exitCode != 0 {
+			return fmt.Errorf("exited with code %d", exitCode)
+		}
+		return nil
+	case err := <-errs:
+		return err
+	case <-time.After(timeout):
+		h.dockerClient.StopContainer(id, 0)
+		return fmt.Errorf("did not exit within %s", timeout)
+	}
+}
+
+// Probes the application running in a container over HTTP until it responds, it
+// exits, or timeout passes.
+func (h requestHandler) probeContainer(id string, port int, path string, timeout time.Duration) error {
+	running := func() (bool, error) {
+		container, err := h.dockerClient.InspectContainer(id)
+		if err != nil {
+			return false, err
+		}
+		return container.State.Running, nil
+	}
+
+	container, err := h.dockerClient.InspectContainer(id)
+	if err != nil {
+		return err
+	}
+	if container.NetworkSettings == nil || container.NetworkSettings.IPAddress == "" {
+		if !container.State.Running {
+			return errors.New("exited before responding")
+		}
+		return errors.New("has no IP address to probe")
+	}
+
+	url := fmt.Sprintf("http://%s:%d%s", container.NetworkSettings.IPAddress, port, path)
+	return probeHTTP(url, timeout, running)
+}
+
+// Requests url until it responds with a status below 500 or timeout passes, giving up
+// early once running reports that the application has exited.
+func probeHTTP(url string, timeout time.Duration, running func() (bool, error)) error {
+	client := &http.Client{Timeout: probeInterval}
+	deadline := time.Now().Add(timeout)
+
+	for {
+		resp, err := client.Get(url)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode < 500 {
+				return nil
+			}
+			err = fmt.Errorf("responded with %s", resp.Status)
+		}
+
+		up, runningErr := running()
+		if runningErr != nil {
+			return runningErr
+		}
+		if !up {
+			return fmt.Errorf("exited before responding on %s", url)
+		}
+
+		if time.Now().Add(probeInterval).After(deadline) {
+			return fmt.Errorf("did not respond on %s within %s: %s", url, timeout, err)
+		}
+		time.Sleep(probeInterval)
+	}
+}
@@ -0,0 +1,79 @@
+package sti
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	. "launchpad.net/gocheck"
+)
+
+type TestBuilderSuite struct{}
+
+var _ = Suite(&TestBuilderSuite{})
+
+func alwaysRunning() (bool, error) {
+	return true, nil
+}
+
+func (s *TestBuilderSuite) TestWriteText(c *C) {
+	result := &TestBuilderResult{
+		Validation: &ValidateResult{Success: true},
+		Cases: []BuilderTestCase{
+			{Method: "build", Kind: BuildClean, Build: CheckPassed, Run: CheckPassed},
+			{Method: "build", Kind: BuildIncremental, Build: CheckPassed, Run: CheckFailed, Detail: "exited with code 1"},
+			{Method: "run", Kind: BuildClean, Build: CheckFailed, Run: CheckSkipped, Detail: "Error building image"},
+			{Method: "run", Kind: BuildIncremental, Build: CheckSkipped, Run: CheckSkipped, Detail: "the clean case failed"},
+		},
+	}
+
+	var out bytes.Buffer
+	c.Assert(result.WriteText(&out), IsNil)
+	c.Assert(out.String(), Equals, strings.Join([]string{
+		"METHOD  KIND         BUILD    RUN      DETAIL",
+		"build   clean        passed   passed   ",
+		"build   incremental  passed   failed   exited with code 1",
+		"run     clean        failed   skipped  Error building image",
+		"run     incremental  skipped  skipped  the clean case failed",
+		"Builder test failed",
+		""}, "\n"))
+}
+
+func (s *TestBuilderSuite) TestFailed(c *C) {
+	c.Assert(BuilderTestCase{Build: CheckPassed, Run: CheckPassed}.failed(), Equals, false)
+	c.Assert(BuilderTestCase{Build: CheckSkipped, Run: CheckSkipped}.failed(), Equals, false)
+	c.Assert(BuilderTestCase{Build: CheckPassed, Run: CheckFailed}.failed(), Equals, true)
+	c.Assert(BuilderTestCase{Build: CheckFailed, Run: CheckSkipped}.failed(), Equals, true)
+}
+
+func (s *TestBuilderSuite) TestProbeResponds(c *C) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	c.Assert(probeHTTP(server.URL+"/", time.Second, alwaysRunning), IsNil)
+}
+
+func (s *TestBuilderSuite) TestProbeServerError(c *C) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "broken", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	err := probeHTTP(server.URL+"/", time.Millisecond, alwaysRunning)
+	c.Assert(err, ErrorMatches, "did not respond on .* within 1ms: responded with 500 Internal Server Error")
+}
+
+func (s *TestBuilderSuite) TestProbeExited(c *C) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+
+	err := probeHTTP(server.URL+"/", time.Minute, func() (bool, error) { return false, nil })
+	c.Assert(err, ErrorMatches, "exited before responding on .*")
+
+	inspectErr := errors.New("no such container")
+	err = probeHTTP(server.URL+"/", time.Minute, func() (bool, error) { return false, inspectErr })
+	c.Assert(err, Equals, inspectErr)
+}
@@ -0,0 +1,293 @@
+package sti
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Span is a timed operation of a build, such as a phase or a docker call.
+type Span struct {
+	TraceID  string
+	SpanID   string
+	ParentID string
+	Name     string
+	Start    time.Time
+	End      time.Time
+	// Attributes of the operation, such as the image or container it concerns
+	Attributes map[string]string
+	// Error the operation failed with, if any
+	Error string
+
+	trace *buildTrace
+}
+
+// SpanExporter sends the spans of finished builds to a tracing backend.
+type SpanExporter interface {
+	ExportSpans(serviceName string, spans []*Span) error
+}
+
+// Tracer records the spans of the builds of the requests that refer to it, and
+// exports the spans of each build when it finishes.
+type Tracer struct {
+	ServiceName string
+	Exporter    SpanExporter
+}
+
+// NewTracer returns a Tracer exporting spans with the given exporter.
+func NewTracer(serviceName string, exporter SpanExporter) *Tracer {
+	return &Tracer{ServiceName: serviceName, Exporter: exporter}
+}
+
+// buildTrace collects the spans of one build.  Spans are started and ended by the
+// goroutine performing the build, each started span being the parent of the spans
+// started before it ends.
+type buildTrace struct {
+	tracer  *Tracer
+	traceID string
+
+	mu    sync.Mutex
+	stack []*Span
+	spans []*Span
+}
+
+// Returns a trace for a build, or nil if the tracer is nil.
+func (t *Tracer) newTrace() *buildTrace {
+	if t == nil {
+		return nil
+	}
+
+	high, err := newID()
+	if err != nil {
+		return nil
+	}
+	low, err := newID()
+	if err != nil {
+		return nil
+	}
+
+	return &buildTrace{tracer: t, traceID: high + low}
+}
+
+// Starts a span, a child of the innermost span in progress; attributes alternate keys
+// and values.
+func (t *buildTrace) start(name string, attributes ...string) *Span {
+	if t == nil {
+		return nil
+	}
+
+	id, err := newID()
+	if err != nil {
+		return nil
+	}
+
+	span := &Span{
+		TraceID:    t.traceID,
+		SpanID:     id,
+		Name:       name,
+		Start:      time.Now(),
+		Attributes: make(map[string]string),
+		trace:      t,
+	}
+	for i := 0; i+1 < len(attributes); i += 2 {
+		span.Attributes[attributes[i]] = attributes[i+1]
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.stack) > 0 {
+		span.ParentID = t.stack[len(t.stack)-1].SpanID
+	}
+	t.stack = append(t.stack, span)
+	t.spans = append(t.spans, span)
+
+	return span
+}
+
+// Sets an attribute of the span.
+func (s *Span) set(key, value string) {
+	if s == nil {
+		return
+	}
+
+	s.trace.mu.Lock()
+	defer s.trace.mu.Unlock()
+	s.Attributes[key] = value
+}
+
+// Ends the span, recording the error the operation failed with, if any.
+func (s *Span) end(err error) {
+	if s == nil {
+		return
+	}
+
+	t := s.trace
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s.End = time.Now()
+	if err != nil {
+		s.Error = err.Error()
+	}
+	for i := len(t.stack) - 1; i >= 0; i-- {
+		if t.stack[i] == s {
+			t.stack = t.stack[:i]
+			break
+		}
+	}
+}
+
+// Exports the spans of the trace.
+func (t *buildTrace) export() error {
+	if t == nil || t.tracer.Exporter == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	spans := t.spans
+	t.mu.Unlock()
+
+	return t.tracer.Exporter.ExportSpans(t.tracer.ServiceName, spans)
+}
+
+// OTLPExporter exports spans to an OpenTelemetry collector with the OTLP/HTTP protocol,
+// JSON encoded.
+type OTLPExporter struct {
+	// URL of the collector, such as http://localhost:4318; /v1/traces is appended
+	// unless it is already the path of the URL
+	Endpoint string
+	Client   *http.Client
+}
+
+// NewOTLPExporter returns an exporter sending spans to the collector at endpoint.
+func NewOTLPExporter(endpoint string) *OTLPExporter {
+	return &OTLPExporter{Endpoint: endpoint, Client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Types of the JSON encoding of OTLP trace export requests.
+type (
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	}
+	otlpSpan struct {
+		TraceID           string          `json:"traceId"`
+		SpanID            string          `json:"spanId"`
+		ParentSpanID      string          `json:"parentSpanId,omitempty"`
+		Name              string          `json:"name"`
+		Kind              int             `json:"kind"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+		Attributes        []otlpAttribute `json:"attributes,omitempty"`
+		Status            otlpStatus      `json:"status"`
+	}
+	otlpAttribute struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpValue struct {
+		StringValue string `json:"stringValue"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	}
+)
+
+// OTLP span kind and status codes.
+const (
+	otlpKindInternal = 1
+	otlpStatusOK     = 1
+	otlpStatusError  = 2
+)
+
+func otlpAttributes(attributes map[string]string) []otlpAttribute {
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var result []otlpAttribute
+	for _, key := range keys {
+		result = append(result, otlpAttribute{key, otlpValue{attributes[key]}})
+	}
+
+	return result
+}
+
+// ExportSpans sends spans to the collector.
+func (e *OTLPExporter) ExportSpans(serviceName string, spans []*Span) error {
+	scope := otlpScopeSpans{Scope: otlpScope{"github.com/pmorie/go-sti", Version}}
+	for _, span := range spans {
+		status := otlpStatus{Code: otlpStatusOK}
+		if span.Error != "" {
+			status = otlpStatus{otlpStatusError, span.Error}
+		}
+
+		scope.Spans = append(scope.Spans, otlpSpan{
+			TraceID:           span.TraceID,
+			SpanID:            span.SpanID,
+			ParentSpanID:      span.ParentID,
+			Name:              span.Name,
+			Kind:              otlpKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+			Attributes:        otlpAttributes(span.Attributes),
+			Status:            status,
+		})
+	}
+
+	body, err := json.Marshal(otlpRequest{[]otlpResourceSpans{{
+		Resource:   otlpResource{otlpAttributes(map[string]string{"service.name": serviceName})},
+		ScopeSpans: []otlpScopeSpans{scope},
+	}}})
+	if err != nil {
+		return err
+	}
+
+	url := strings.TrimRight(e.Endpoint, "/")
+	if !strings.HasSuffix(url, "/v1/traces") {
+		url += "/v1/traces"
+	}
+
+	client := e.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("exporting spans to %s: %s", url, resp.Status)
+	}
+
+	return nil
+}
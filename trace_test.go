@@ -0,0 +1,124 @@
+package sti
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+
+	. "launchpad.net/gocheck"
+)
+
+type TraceSuite struct{}
+
+var _ = Suite(&TraceSuite{})
+
+// spanRecorder is a SpanExporter keeping the spans it is given.
+type spanRecorder struct {
+	spans []*Span
+}
+
+func (r *spanRecorder) ExportSpans(serviceName string, spans []*Span) error {
+	r.spans = append(r.spans, spans...)
+	return nil
+}
+
+// Test spans nesting within the spans in progress, phases included
+func (s *TraceSuite) TestNesting(c *C) {
+	recorder := &spanRecorder{}
+	trace := NewTracer("sti", recorder).newTrace()
+	h := requestHandler{log: NewTextLogger(ioutil.Discard, LevelError), trace: trace}
+
+	root := trace.start("build", "sti.tag", "test/app")
+	failure := errors.New("no such image")
+	h.phase(PhaseBuildImage, func() error {
+		inner := trace.start("create container", "sti.image", "builder")
+		inner.set("sti.container_id", "abc")
+		inner.end(nil)
+		return failure
+	})
+	sibling := trace.start("commit container")
+	sibling.end(nil)
+	root.end(nil)
+	c.Assert(trace.export(), IsNil)
+
+	spans := recorder.spans
+	c.Assert(spans, HasLen, 4)
+	c.Assert(spans[0].Name, Equals, "build")
+	c.Assert(spans[0].ParentID, Equals, "")
+	c.Assert(spans[0].TraceID, HasLen, 32)
+	c.Assert(spans[0].Attributes["sti.tag"], Equals, "test/app")
+
+	c.Assert(spans[1].Name, Equals, PhaseBuildImage)
+	c.Assert(spans[1].ParentID, Equals, spans[0].SpanID)
+	c.Assert(spans[1].Error, Equals, "no such image")
+
+	c.Assert(spans[2].Name, Equals, "create container")
+	c.Assert(spans[2].ParentID, Equals, spans[1].SpanID)
+	c.Assert(spans[2].Attributes["sti.container_id"], Equals, "abc")
+
+	c.Assert(spans[3].ParentID, Equals, spans[0].SpanID)
+	for _, span := range spans {
+		c.Assert(span.TraceID, Equals, spans[0].TraceID)
+		c.Assert(span.End.Before(span.Start), Equals, false)
+	}
+}
+
+// Test builds without a tracer recording nothing
+func (s *TraceSuite) TestNoTracer(c *C) {
+	var tracer *Tracer
+	trace := tracer.newTrace()
+	span := trace.start("build")
+	span.set("sti.tag", "test/app")
+	span.end(nil)
+	c.Assert(trace.export(), IsNil)
+}
+
+// Test spans being exported to a collector as OTLP/HTTP JSON
+func (s *TraceSuite) TestOTLPExport(c *C) {
+	var request otlpRequest
+	var path, contentType string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		contentType = r.Header.Get("Content-Type")
+		json.NewDecoder(r.Body).Decode(&request)
+	}))
+	defer collector.Close()
+
+	trace := NewTracer("sti-test", NewOTLPExporter(collector.URL)).newTrace()
+	root := trace.start("build", "sti.tag", "test/app")
+	child := trace.start("pull image", "sti.image", "builder")
+	child.end(errors.New("pull failed"))
+	root.end(nil)
+	c.Assert(trace.export(), IsNil)
+
+	c.Assert(path, Equals, "/v1/traces")
+	c.Assert(contentType, Equals, "application/json")
+	c.Assert(request.ResourceSpans, HasLen, 1)
+	resource := request.ResourceSpans[0]
+	c.Assert(resource.Resource.Attributes, DeepEquals, []otlpAttribute{{"service.name", otlpValue{"sti-test"}}})
+	c.Assert(resource.ScopeSpans[0].Scope.Version, Equals, Version)
+
+	spans := resource.ScopeSpans[0].Spans
+	c.Assert(spans, HasLen, 2)
+	c.Assert(spans[0].Name, Equals, "build")
+	c.Assert(spans[0].Kind, Equals, otlpKindInternal)
+	c.Assert(spans[0].Status.Code, Equals, otlpStatusOK)
+	c.Assert(spans[0].Attributes, DeepEquals, []otlpAttribute{{"sti.tag", otlpValue{"test/app"}}})
+	c.Assert(spans[1].ParentSpanID, Equals, spans[0].SpanID)
+	c.Assert(spans[1].TraceID, Equals, spans[0].TraceID)
+	c.Assert(spans[1].Status, Equals, otlpStatus{otlpStatusError, "pull failed"})
+	c.Assert(spans[1].StartTimeUnixNano, Not(Equals), "")
+}
+
+// Test collector errors being reported
+func (s *TraceSuite) TestOTLPExportError(c *C) {
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer collector.Close()
+
+	err := NewOTLPExporter(collector.URL+"/v1/traces").ExportSpans("sti", nil)
+	c.Assert(err, ErrorMatches, ".*503 Service Unavailable")
+}
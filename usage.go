@@ -0,0 +1,158 @@
+package sti
+
+import (
+	"bytes"
+	"encoding/json"
+	"path"
+	"reflect"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// Location of the optional script of a builder image that explains how to use it, for
+// images that do not declare the directory of their scripts.
+const usageScript = defaultScriptsDir + "/usage"
+
+// Entrypoint of images built by sti from images with their scripts in the default
+// directory.
+var usageEntrypoint = usageEntrypointFor(defaultScriptsDir)
+
+// Returns the entrypoint of images built by sti from images with their scripts in
+// scriptsDir and a usage script.  Run with a help argument, an image prints its usage
+// if it has a usage script; otherwise it runs its command as it would without an
+// entrypoint.
+func usageEntrypointFor(scriptsDir string) []string {
+	usage := path.Join(scriptsDir, "usage")
+	return []string{
+		"/bin/sh", "-c",
+		`case "$1" in -h|--help|help) if [ -x ` + usage + ` ]; then exec ` + usage + `; fi;; esac; exec "$@"`,
+		"sti",
+	}
+}
+
+// UsageRequest asks for the usage of the builder image given as its BaseImage.
+type UsageRequest struct {
+	Request
+}
+
+// UsageResult holds the output of the usage script of a builder image.
+type UsageResult struct {
+	Output string
+}
+
+// Usage runs the usage script of a builder image in a throwaway container and
+// returns its output.  It returns ErrNoUsageScript if the image has no usage script.
+func Usage(req UsageRequest) (*UsageResult, error) {
+	h, err := newHandler(req.Request)
+	if err != nil {
+		return nil, err
+	}
+	defer h.release()
+
+	done := make(chan struct{})
+	defer close(done)
+	go h.watchCancel(req.Cancel, done)
+
+	image, err := h.checkAndPull(req.BaseImage)
+	if err != nil {
+		return nil, err
+	}
+	caps, err := h.imageCapabilities(image)
+	if err != nil {
+		return nil, err
+	}
+	script := caps.script("usage")
+
+	present, err := h.hasUsageScript(req.BaseImage, script)
+	if err != nil {
+		return nil, err
+	}
+	if !present {
+		return nil, ErrNoUsageScript
+	}
+
+	config := docker.Config{Image: req.BaseImage, Cmd: []string{script}}
+	container, err := h.createContainer(config)
+	if err != nil {
+		return nil, err
+	}
+	defer h.removeContainer(container.ID)
+
+	err = h.dockerClient.StartContainer(container.ID, &docker.HostConfig{})
+	if err != nil {
+		return nil, err
+	}
+
+	exitCode, err := h.dockerClient.WaitContainer(container.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	var output bytes.Buffer
+	err = h.dockerClient.AttachToContainer(docker.AttachToContainerOptions{
+		Container:    container.ID,
+		OutputStream: &output,
+		ErrorStream:  &output,
+		Logs:         true,
+		Stdout:       true,
+		Stderr:       true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if exitCode != 0 {
+		h.log.Error("Usage script failed", "image", req.BaseImage, "exitCode", exitCode, "output", output.String())
+		return nil, ErrUsageFailed
+	}
+
+	return &UsageResult{Output: output.String()}, nil
+}
+
+// Determines whether an image has an executable usage script at the path.
+func (h requestHandler) hasUsageScript(imageName string, script string) (bool, error) {
+	files, err := h.imageFiles(imageName)
+	if err != nil {
+		return false, err
+	}
+
+	return checkExecutable(script, files)
+}
+
+// Determines whether images built from an image are given the usage entrypoint: only
+// if the image has an executable usage script, and a shell to run the entrypoint.
+// Images without them keep the entrypoint of the image they are built from.
+func (h requestHandler) takesUsageEntrypoint(imageName string, caps *Capabilities) (bool, error) {
+	files, err := h.imageFiles(imageName)
+	if err != nil {
+		return false, err
+	}
+
+	for _, program := range []string{"/bin/sh", caps.script("usage")} {
+		found, err := checkExecutable(program, files)
+		if err != nil || !found {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// Returns the entrypoint of images built by sti from images with their scripts in
+// scriptsDir, JSON encoded for a Dockerfile.
+func usageEntrypointJSON(scriptsDir string) string {
+	encoded, _ := json.Marshal(usageEntrypointFor(scriptsDir))
+	return string(encoded)
+}
+
+// Determines whether an entrypoint is one sti gives the images it builds, for any
+// directory of scripts.
+func isUsageEntrypoint(entrypoint []string) bool {
+	if len(entrypoint) != 4 {
+		return false
+	}
+
+	usage := strings.SplitN(strings.TrimPrefix(entrypoint[2], `case "$1" in -h|--help|help) if [ -x `), " ", 2)[0]
+	return reflect.DeepEqual(entrypoint, usageEntrypointFor(path.Dir(usage)))
+}
@@ -0,0 +1,106 @@
+package sti
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	. "launchpad.net/gocheck"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+type UsageSuite struct{}
+
+var _ = Suite(&UsageSuite{})
+
+// Runs the entrypoint of built images with args, with the usage script at usagePath.
+func runEntrypoint(c *C, usagePath string, args ...string) string {
+	script := strings.Replace(usageEntrypoint[2], usageScript, usagePath, -1)
+	cmdArgs := append([]string{"-c", script, usageEntrypoint[3]}, args...)
+	out, err := exec.Command(usageEntrypoint[0], cmdArgs...).CombinedOutput()
+	c.Assert(err, IsNil, Commentf("output: %s", out))
+	return string(out)
+}
+
+// Test the entrypoint of built images printing usage for help arguments only
+func (s *UsageSuite) TestEntrypoint(c *C) {
+	usage := filepath.Join(c.MkDir(), "usage")
+	c.Assert(ioutil.WriteFile(usage, []byte("#!/bin/sh\necho 'Usage: run me'\n"), 0755), IsNil)
+
+	for _, arg := range []string{"--help", "-h", "help"} {
+		c.Assert(runEntrypoint(c, usage, arg), Equals, "Usage: run me\n")
+	}
+	c.Assert(runEntrypoint(c, usage, "echo", "running", "--help"), Equals, "running --help\n")
+}
+
+// Test the entrypoint running help arguments as commands without a usage script
+func (s *UsageSuite) TestEntrypointWithoutUsage(c *C) {
+	missing := filepath.Join(c.MkDir(), "usage")
+	c.Assert(runEntrypoint(c, missing, "echo", "hi"), Equals, "hi\n")
+
+	script := strings.Replace(usageEntrypoint[2], usageScript, missing, -1)
+	err := exec.Command(usageEntrypoint[0], "-c", script, "sti", "--help").Run()
+	c.Assert(err, NotNil)
+}
+
+// Test the entrypoint given to built images not being taken for a foreign entrypoint
+func (s *UsageSuite) TestImageHasEntryPoint(c *C) {
+	image := &docker.Image{Config: &docker.Config{}}
+	c.Assert(imageHasEntryPoint(image), Equals, false)
+
+	image.Config.Entrypoint = usageEntrypoint
+	image.ContainerConfig.Entrypoint = usageEntrypoint
+	c.Assert(imageHasEntryPoint(image), Equals, false)
+
+	image.Config.Entrypoint = usageEntrypointFor("/opt/app/sti")
+	image.ContainerConfig.Entrypoint = usageEntrypointFor("/opt/app/sti")
+	c.Assert(imageHasEntryPoint(image), Equals, false)
+
+	image.Config.Entrypoint = []string{"/usr/bin/app"}
+	c.Assert(imageHasEntryPoint(image), Equals, true)
+
+	image.Config.Entrypoint = []string{"/bin/sh", "-c", "exec /usr/bin/app", "sti"}
+	c.Assert(imageHasEntryPoint(image), Equals, true)
+}
+
+// Test the Dockerfile of built images setting the entrypoint
+func (s *UsageSuite) TestDockerfileEntrypoint(c *C) {
+	var buf bytes.Buffer
+	caps := defaultCapabilities()
+	err := dockerFileTemplate.Execute(&buf, dockerFileData{
+		BaseImage:  "builder",
+		SourceDir:  caps.SourceDir,
+		Prepare:    caps.script("prepare"),
+		Run:        caps.script("run"),
+		Entrypoint: usageEntrypointJSON(caps.ScriptsDir),
+	})
+	c.Assert(err, IsNil)
+
+	var entrypoint []string
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if strings.HasPrefix(line, "ENTRYPOINT ") {
+			c.Assert(json.Unmarshal([]byte(strings.TrimPrefix(line, "ENTRYPOINT ")), &entrypoint), IsNil)
+		}
+	}
+	c.Assert(entrypoint, DeepEquals, usageEntrypoint)
+	c.Assert(strings.HasSuffix(buf.String(), "CMD /usr/bin/run\n"), Equals, true)
+}
+
+// Test the Dockerfile of images built without the usage entrypoint leaving it out
+func (s *UsageSuite) TestDockerfileWithoutEntrypoint(c *C) {
+	var buf bytes.Buffer
+	caps := defaultCapabilities()
+	err := dockerFileTemplate.Execute(&buf, dockerFileData{
+		BaseImage: "builder",
+		SourceDir: caps.SourceDir,
+		Prepare:   caps.script("prepare"),
+		Run:       caps.script("run"),
+	})
+	c.Assert(err, IsNil)
+	c.Assert(strings.Contains(buf.String(), "ENTRYPOINT"), Equals, false)
+	c.Assert(strings.HasSuffix(buf.String(), "RUN /usr/bin/prepare\nCMD /usr/bin/run\n"), Equals, true)
+}
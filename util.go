@@ -1,14 +1,8 @@
 package sti
 
 import (
-	"archive/tar"
 	"bytes"
-	"io"
-	"io/ioutil"
 	"os"
-	"os/exec"
-	"path/filepath"
-	"strings"
 	"syscall"
 
 	"github.com/fsouza/go-dockerclient"
@@ -35,87 +29,15 @@ func stringInSlice(s string, slice []string) bool {
 	return false
 }
 
-func writeTar(tw *tar.Writer, path string, relative string, fi os.FileInfo) error {
-	fr, err := os.Open(path)
-	if err != nil {
-		return err
-	}
-	defer fr.Close()
-
-	h := new(tar.Header)
-	h.Name = strings.Replace(path, relative, ".", 1)
-	h.Size = fi.Size()
-	h.Mode = int64(fi.Mode())
-	h.ModTime = fi.ModTime()
-
-	err = tw.WriteHeader(h)
-	if err != nil {
-		return err
-	}
-
-	_, err = io.Copy(tw, fr)
-	return err
-}
-
-func tarDirectory(dir string) (*os.File, error) {
-	fw, err := ioutil.TempFile("", "sti-tar")
-	if err != nil {
-		return nil, err
-	}
-	defer fw.Close()
-
-	tw := tar.NewWriter(fw)
-	defer tw.Close()
-
-	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
-		if !info.IsDir() {
-			err = writeTar(tw, path, dir, info)
-			if err != nil {
-				return err
-			}
-		}
-
-		return nil
-	})
-
-	if err != nil {
-		return nil, err
-	}
-
-	return fw, nil
-}
-
-func copy(sourcePath string, targetPath string) error {
-	info, err := os.Stat(sourcePath)
-	if err != nil {
-		return err
-	}
-
-	if !info.IsDir() {
-		err = os.Mkdir(targetPath, 0700)
-		if err != nil {
-			return err
-		}
-
-		targetPath = filepath.Join(targetPath, filepath.Base(sourcePath))
-	}
-
-	cmd := exec.Command("cp", "-ad", sourcePath, targetPath)
-	return cmd.Run()
-}
-
-func gitClone(source string, targetPath string) error {
-	cmd := exec.Command("git", "clone", "--quiet", source, targetPath)
-	err := cmd.Run()
-
-	return err
-}
-
+// Determines whether an image has an entrypoint other than the one sti gives the images
+// it builds, which runs commands as they would be without it.
 func imageHasEntryPoint(image *docker.Image) bool {
-	found := (image.ContainerConfig.Entrypoint != nil)
+	entrypoint := image.ContainerConfig.Entrypoint
+	found := entrypoint != nil && !isUsageEntrypoint(entrypoint)
 
 	if !found && image.Config != nil {
-		found = image.Config.Entrypoint != nil
+		entrypoint = image.Config.Entrypoint
+		found = entrypoint != nil && !isUsageEntrypoint(entrypoint)
 	}
 
 	return found
@@ -137,3 +59,45 @@ func openFileExclusive(path string, mode os.FileMode) (*os.File, error) {
 
 	return file, nil
 }
+
+// Opens the file at path, creating it if necessary, and takes an exclusive lock on it.
+// If another process holds the lock, waits for it to be released if wait is set and
+// fails with ErrLockHeld otherwise.  Closing the file releases the lock.  Lock files
+// are removed by their holder, so a lock taken on a file that is no longer at path is
+// dropped, and the file now at path locked instead.
+func lockFile(path string, wait bool) (*os.File, error) {
+	how := syscall.LOCK_EX
+	if !wait {
+		how |= syscall.LOCK_NB
+	}
+
+	for {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0666)
+		if err != nil {
+			return nil, err
+		}
+
+		if err = syscall.Flock(int(file.Fd()), how); err != nil {
+			file.Close()
+			if err == syscall.EWOULDBLOCK {
+				return nil, ErrLockHeld
+			}
+
+			return nil, err
+		}
+
+		locked, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		current, err := os.Stat(path)
+		if err == nil && os.SameFile(locked, current) {
+			return file, nil
+		}
+		file.Close()
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+}
@@ -2,9 +2,8 @@ package sti
 
 import (
 	"fmt"
-	"log"
-
-	"github.com/fsouza/go-dockerclient"
+	"io"
+	"strings"
 )
 
 // Describes a request to validate an images for use in an sti build.
@@ -13,16 +12,162 @@ type ValidateRequest struct {
 	Incremental bool
 }
 
-type ValidateResult STIResult
+// Roles of the images of a validation.
+const (
+	RoleBase    = "base"
+	RoleRuntime = "runtime"
+)
 
-// Records the result of a validation on a ValidationResult.
-func (res *ValidateResult) recordValidation(what string, image string, valid bool) {
-	if !valid {
-		res.Success = false
-		res.Messages = append(res.Messages, fmt.Sprintf("%s %s failed validation", what, image))
+// Statuses of validation checks.
+const (
+	CheckPassed = "passed"
+	CheckFailed = "failed"
+)
+
+// Severities of validation checks.  An image whose checks of error severity all pass
+// is valid; failed checks of warning severity are reported but do not invalidate it.
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// IDs of validation checks.
+const (
+	CheckEntrypoint        = "entrypoint"
+	CheckCapabilities      = "capabilities"
+	CheckIncremental       = "incremental"
+	CheckScriptExists      = "script-exists"
+	CheckScriptRegularFile = "script-regular-file"
+	CheckScriptExecutable  = "script-executable"
+	CheckScriptInterpreter = "script-interpreter"
+	CheckUsageScript       = "usage-script"
+)
+
+// What each check verifies, completing a sentence about the image or script.
+var checkDescriptions = map[string]string{
+	CheckEntrypoint:        "has no entrypoint",
+	CheckCapabilities:      "declares valid capabilities",
+	CheckIncremental:       "supports incremental builds",
+	CheckScriptExists:      "exists",
+	CheckScriptRegularFile: "is a regular file",
+	CheckScriptExecutable:  "is executable",
+	CheckScriptInterpreter: "has an interpreter",
+	CheckUsageScript:       "is present",
+}
+
+// ValidationCheck is the result of one check of an image.
+type ValidationCheck struct {
+	ID string
+	// Script the check concerns, if any
+	Script   string `json:",omitempty"`
+	Status   string
+	Severity string
+	// Why the check failed, or what it found
+	Detail string `json:",omitempty"`
+	// How to make a failed check pass
+	Remediation string `json:",omitempty"`
+}
+
+// Determines whether the check failed and invalidates its image.
+func (c ValidationCheck) isError() bool {
+	return c.Status == CheckFailed && c.Severity == SeverityError
+}
+
+func (c ValidationCheck) String() string {
+	subject := checkDescriptions[c.ID]
+	if c.Script != "" {
+		subject = c.Script + " " + subject
+	}
+
+	status := c.Status
+	if c.Status == CheckFailed && c.Severity == SeverityWarning {
+		status = SeverityWarning
+	}
+	if c.Detail != "" {
+		status += " (" + c.Detail + ")"
+	}
+
+	return subject + ": " + status
+}
+
+// ImageValidation reports the checks of one image.
+type ImageValidation struct {
+	Role   string
+	Image  string
+	Valid  bool
+	Checks []ValidationCheck
+}
+
+// Describes the image, such as "Base image centos-ruby".
+func (v ImageValidation) name() string {
+	if v.Role == RoleRuntime {
+		return "Runtime image " + v.Image
+	}
+
+	return "Base image " + v.Image
+}
+
+// Returns a line for each check of the image, and a line with the outcome of its
+// validation.
+func (v ImageValidation) messages() []string {
+	var messages []string
+	for _, check := range v.Checks {
+		messages = append(messages, fmt.Sprintf("%s: %s", v.name(), check))
+	}
+
+	if v.Valid {
+		messages = append(messages, fmt.Sprintf("%s passes validation", v.name()))
 	} else {
-		res.Messages = append(res.Messages, fmt.Sprintf("%s %s passes validation", what, image))
+		messages = append(messages, fmt.Sprintf("%s failed validation", v.name()))
 	}
+
+	return messages
+}
+
+// ValidateResult reports the validation of the images of a request.  Success is set
+// if all the images are valid.  Messages summarize the checks, one per line.
+type ValidateResult struct {
+	Success  bool
+	Messages []string
+	Images   []ImageValidation
+}
+
+// Adds the validation of an image to the result.
+func (res *ValidateResult) add(validation ImageValidation) {
+	res.Images = append(res.Images, validation)
+	res.Messages = append(res.Messages, validation.messages()...)
+	if !validation.Valid {
+		res.Success = false
+	}
+}
+
+// WriteText writes the result to w as text: a line for each check, followed for
+// failed checks by how to remedy them, and a line with the outcome of the validation
+// of each image.
+func (res *ValidateResult) WriteText(w io.Writer) error {
+	for _, validation := range res.Images {
+		for _, check := range validation.Checks {
+			_, err := fmt.Fprintf(w, "%s: %s\n", validation.name(), check)
+			if err != nil {
+				return err
+			}
+
+			if check.Status == CheckFailed && check.Remediation != "" {
+				_, err = fmt.Fprintf(w, "    %s\n", check.Remediation)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		messages := validation.messages()
+		_, err := fmt.Fprintln(w, messages[len(messages)-1])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 // Service the supplied ValidateRequest and return a ValidateResult.
@@ -31,77 +176,143 @@ func Validate(req ValidateRequest) (*ValidateResult, error) {
 	if err != nil {
 		return nil, err
 	}
+	defer c.release()
+
+	done := make(chan struct{})
+	defer close(done)
+	go c.watchCancel(req.Cancel, done)
 
 	result := &ValidateResult{Success: true}
 
 	if req.RuntimeImage != "" {
-		valid, err := c.validateImage(req.BaseImage, false)
+		validation, err := c.validateImage(req.BaseImage, RoleBase, false)
 		if err != nil {
 			return nil, err
 		}
-		result.recordValidation("Base image", req.BaseImage, valid)
+		result.add(validation)
 
-		valid, err = c.validateImage(req.RuntimeImage, true)
+		validation, err = c.validateImage(req.RuntimeImage, RoleRuntime, true)
 		if err != nil {
 			return nil, err
 		}
-		result.recordValidation("Runtime image", req.RuntimeImage, valid)
+		result.add(validation)
 	} else {
-		valid, err := c.validateImage(req.BaseImage, req.Incremental)
+		validation, err := c.validateImage(req.BaseImage, RoleBase, req.Incremental)
 		if err != nil {
 			return nil, err
 		}
-		result.recordValidation("Base image", req.BaseImage, valid)
+		result.add(validation)
 	}
 
 	return result, nil
 }
 
-func (h requestHandler) validateImage(imageName string, incremental bool) (bool, error) {
-	log.Printf("Validating image %s, incremental: %t\n", imageName, incremental)
+// Validates an image for use in the given role, checking that it has no entrypoint,
+// the capabilities it declares, the scripts it must provide, and whether a base image
+// provides usage.  Scripts are looked for in the directory the image declares, and
+// save-artifacts is checked for incremental builds and for images that declare they
+// support them.
+func (h requestHandler) validateImage(imageName string, role string, incremental bool) (ImageValidation, error) {
+	validation := ImageValidation{Role: role, Image: imageName}
+
+	h.log.Info("Validating image", "image", imageName, "role", role, "incremental", incremental)
 	image, err := h.checkAndPull(imageName)
 	if err != nil {
-		return false, err
+		return validation, err
 	}
 
-	if h.debug {
-		log.Printf("Pulled image %s: {%+v}", imageName, image)
-	}
+	h.log.Debug("Pulled image", "image", imageName, "id", image.ID)
 
+	entrypoint := ValidationCheck{ID: CheckEntrypoint, Status: CheckPassed, Severity: SeverityError}
 	if imageHasEntryPoint(image) {
-		log.Printf("ERROR: Image %s has a configured entrypoint and is incompatible with sti\n", imageName)
-		return false, nil
+		entrypoint.Status = CheckFailed
+		entrypoint.Remediation = "Remove the ENTRYPOINT of the image; sti runs its scripts as commands"
 	}
+	validation.Checks = append(validation.Checks, entrypoint)
 
-	files := []string{"/usr/bin/prepare", "/usr/bin/run"}
+	caps, problems := capabilitiesFromLabels(imageLabels(image))
+	check := ValidationCheck{ID: CheckCapabilities, Status: CheckPassed, Severity: SeverityError}
+	if len(caps.declared) == 0 {
+		check.Detail = "none declared"
+	}
+	if len(problems) > 0 {
+		check.Status = CheckFailed
+		check.Detail = strings.Join(problems, "; ")
+		check.Remediation = "Correct the STI_* capability labels of the image, or remove them to use the defaults"
+	}
+	validation.Checks = append(validation.Checks, check)
 
-	if incremental {
-		files = append(files, "/usr/bin/save-artifacts")
+	scripts := []string{caps.script("prepare"), caps.script("run")}
+
+	if incremental && caps.declares(LabelIncremental) && !caps.Incremental {
+		validation.Checks = append(validation.Checks, ValidationCheck{
+			ID:          CheckIncremental,
+			Status:      CheckFailed,
+			Severity:    SeverityError,
+			Detail:      LabelIncremental + "=false",
+			Remediation: "Build with the image without incremental builds, or add a save-artifacts script and declare " + LabelIncremental + "=true",
+		})
+	} else if incremental || caps.Incremental {
+		scripts = append(scripts, caps.script("save-artifacts"))
+	}
+
+	usage := ""
+	if role == RoleBase {
+		usage = caps.script("usage")
 	}
 
-	valid, err := h.validateRequiredFiles(imageName, files)
+	checks, err := h.validateScripts(imageName, imageSearchPath(image), scripts, usage)
 	if err != nil {
-		return false, err
+		return validation, err
+	}
+	validation.Checks = append(validation.Checks, checks...)
+
+	validation.Valid = true
+	for _, check := range validation.Checks {
+		switch {
+		case check.isError():
+			validation.Valid = false
+			h.log.Error("Validation check failed", "image", imageName, "check", check.ID, "script", check.Script, "detail", check.Detail)
+		case check.Status == CheckFailed:
+			h.log.Warn("Validation check failed", "image", imageName, "check", check.ID, "script", check.Script, "detail", check.Detail)
+		default:
+			h.log.Debug("Validation check passed", "image", imageName, "check", check.ID, "script", check.Script, "detail", check.Detail)
+		}
 	}
 
-	return valid, nil
+	return validation, nil
 }
 
-func (h requestHandler) validateRequiredFiles(imageName string, files []string) (bool, error) {
-	container, err := h.containerFromImage(imageName)
+// Checks the scripts of an image and, if a usage script is given, whether the image
+// provides it.
+func (h requestHandler) validateScripts(imageName string, searchPath string, scripts []string, usage string) ([]ValidationCheck, error) {
+	files, err := h.imageFiles(imageName)
 	if err != nil {
-		return false, ErrCreateContainerFailed
+		return nil, err
+	}
+
+	var checks []ValidationCheck
+	for _, script := range scripts {
+		scriptChecks, err := checkScript(script, files, searchPath)
+		if err != nil {
+			return nil, err
+		}
+		checks = append(checks, scriptChecks...)
 	}
-	defer h.dockerClient.RemoveContainer(docker.RemoveContainerOptions{container.ID, true})
 
-	for _, file := range files {
-		if !FileExistsInContainer(h.dockerClient, container.ID, file) {
-			log.Printf("ERROR: Image %s is missing %s\n", imageName, file)
-			return false, nil
-		} else if h.debug {
-			log.Printf("OK: Image %s contains file %s\n", imageName, file)
+	if usage != "" {
+		present, err := checkExecutable(usage, files)
+		if err != nil {
+			return nil, err
+		}
+
+		check := ValidationCheck{ID: CheckUsageScript, Script: usage, Status: CheckPassed, Severity: SeverityWarning}
+		if !present {
+			check.Status = CheckFailed
+			check.Remediation = "Add an executable " + usage + " script printing how to use the image"
 		}
+		checks = append(checks, check)
 	}
 
-	return true, nil
+	return checks, nil
 }
@@ -0,0 +1,87 @@
+package sti
+
+import (
+	"bytes"
+	"encoding/json"
+
+	. "launchpad.net/gocheck"
+)
+
+type ValidateSuite struct{}
+
+var _ = Suite(&ValidateSuite{})
+
+func validationResult() *ValidateResult {
+	result := &ValidateResult{Success: true}
+	result.add(ImageValidation{
+		Role:  RoleBase,
+		Image: "builder",
+		Valid: true,
+		Checks: []ValidationCheck{
+			{ID: CheckEntrypoint, Status: CheckPassed, Severity: SeverityError},
+			{ID: CheckScriptExecutable, Script: "/usr/bin/run", Status: CheckPassed, Severity: SeverityError, Detail: "mode 0755"},
+			{ID: CheckUsageScript, Script: "/usr/bin/usage", Status: CheckFailed, Severity: SeverityWarning, Remediation: "Add a usage script"},
+		},
+	})
+	result.add(ImageValidation{
+		Role:  RoleRuntime,
+		Image: "runtime",
+		Checks: []ValidationCheck{
+			{ID: CheckScriptExists, Script: "/usr/bin/save-artifacts", Status: CheckFailed, Severity: SeverityError, Remediation: "Add it"},
+		},
+	})
+
+	return result
+}
+
+// Test the result summarizing the checks of each image
+func (s *ValidateSuite) TestMessages(c *C) {
+	result := validationResult()
+
+	c.Assert(result.Success, Equals, false)
+	c.Assert(result.Messages, DeepEquals, []string{
+		"Base image builder: has no entrypoint: passed",
+		"Base image builder: /usr/bin/run is executable: passed (mode 0755)",
+		"Base image builder: /usr/bin/usage is present: warning",
+		"Base image builder passes validation",
+		"Runtime image runtime: /usr/bin/save-artifacts exists: failed",
+		"Runtime image runtime failed validation",
+	})
+}
+
+// Test the text rendering giving the remediation of failed checks
+func (s *ValidateSuite) TestWriteText(c *C) {
+	var buf bytes.Buffer
+	c.Assert(validationResult().WriteText(&buf), IsNil)
+	c.Assert(buf.String(), Equals, ""+
+		"Base image builder: has no entrypoint: passed\n"+
+		"Base image builder: /usr/bin/run is executable: passed (mode 0755)\n"+
+		"Base image builder: /usr/bin/usage is present: warning\n"+
+		"    Add a usage script\n"+
+		"Base image builder passes validation\n"+
+		"Runtime image runtime: /usr/bin/save-artifacts exists: failed\n"+
+		"    Add it\n"+
+		"Runtime image runtime failed validation\n")
+}
+
+// Test the JSON encoding of the result, as returned by the server
+func (s *ValidateSuite) TestJSON(c *C) {
+	encoded, err := json.Marshal(validationResult())
+	c.Assert(err, IsNil)
+
+	var decoded ValidateResult
+	c.Assert(json.Unmarshal(encoded, &decoded), IsNil)
+	c.Assert(&decoded, DeepEquals, validationResult())
+
+	var raw map[string]interface{}
+	c.Assert(json.Unmarshal(encoded, &raw), IsNil)
+	check := raw["Images"].([]interface{})[0].(map[string]interface{})["Checks"].([]interface{})[0].(map[string]interface{})
+	c.Assert(check, DeepEquals, map[string]interface{}{"ID": "entrypoint", "Status": "passed", "Severity": "error"})
+}
+
+// Test only failed checks of error severity invalidating an image
+func (s *ValidateSuite) TestIsError(c *C) {
+	c.Assert(ValidationCheck{Status: CheckFailed, Severity: SeverityError}.isError(), Equals, true)
+	c.Assert(ValidationCheck{Status: CheckFailed, Severity: SeverityWarning}.isError(), Equals, false)
+	c.Assert(ValidationCheck{Status: CheckPassed, Severity: SeverityError}.isError(), Equals, false)
+}
@@ -0,0 +1,4 @@
+package sti
+
+// Version is the version of sti, recorded in the metadata of images it builds.
+const Version = "0.1"
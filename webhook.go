@@ -0,0 +1,430 @@
+package sti
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// WebhookConfig maps the pushes reported by repository webhooks to builds.
+type WebhookConfig struct {
+	// Secret shared with the repository hosts: the key of GitHub payload signatures
+	// and the value of the GitLab token.
+	Secret string
+	// Accept payloads without verifying them if there is no Secret.  Without a
+	// Secret, payloads are otherwise refused.
+	Insecure bool
+	Builds   []WebhookBuild
+}
+
+// WebhookBuild describes the build performed for pushes to a repository and branch.
+type WebhookBuild struct {
+	// Full name of the repository, such as owner/name, or its clone URL
+	Repository string
+	// Branch whose pushes are built; pushes to any branch are built if empty
+	Branch string
+	// Git URL to clone instead of the clone URL given by the payload, if any.  Unless
+	// the build is matched by clone URL, the clone URL of the payload is only cloned
+	// if it is a remote git URL on the host and at the path of the repository's web
+	// URL, which ends with the full name of the repository.
+	Source string
+
+	BaseImage    string
+	RuntimeImage string
+	// Tag of the built image, as a text/template executed with the PushEvent
+	Tag         string
+	Method      string
+	Environment map[string]string
+	ContextDir  string
+	Clean       bool
+	// Priority of the build in the server's queue
+	Priority int
+}
+
+// PushEvent describes a push reported by a webhook.
+type PushEvent struct {
+	// Full name of the repository, such as owner/name
+	Repository string
+	// Name of the repository without its owner
+	Name string
+	// Web page of the repository
+	URL         string
+	CloneURL    string
+	Branch      string
+	Commit      string
+	ShortCommit string
+}
+
+// Returned by the webhook endpoints: the IDs of the builds that were queued.
+type WebhookResult struct {
+	Builds []string
+}
+
+// Webhook payloads larger than this are rejected.
+const maxWebhookPayload = 10 << 20
+
+// LoadWebhookConfig reads a WebhookConfig from the JSON file at path.
+func LoadWebhookConfig(path string) (*WebhookConfig, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var config WebhookConfig
+	err = json.NewDecoder(file).Decode(&config)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, build := range config.Builds {
+		if build.Repository == "" || build.BaseImage == "" || build.Tag == "" {
+			return nil, fmt.Errorf("%s: builds require a Repository, BaseImage and Tag", path)
+		}
+		_, err = template.New("tag").Parse(build.Tag)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid tag template for %s: %v", path, build.Repository, err)
+		}
+	}
+
+	return &config, nil
+}
+
+// Determines whether the build is configured for the push.
+func (b *WebhookBuild) matches(event *PushEvent) bool {
+	if b.Repository != event.Repository && b.Repository != event.CloneURL {
+		return false
+	}
+
+	return b.Branch == "" || b.Branch == event.Branch
+}
+
+// Returns the request building the pushed commit.
+func (b *WebhookBuild) request(event *PushEvent) (BuildRequest, error) {
+	var tag bytes.Buffer
+	tmpl, err := template.New("tag").Parse(b.Tag)
+	if err != nil {
+		return BuildRequest{}, err
+	}
+	err = tmpl.Execute(&tag, event)
+	if err != nil {
+		return BuildRequest{}, err
+	}
+
+	source := b.Source
+	if source == "" {
+		if b.Repository != event.CloneURL && !isCloneURLOf(event.CloneURL, event.Repository, event.URL) {
+			return BuildRequest{}, ErrInvalidCloneURL
+		}
+		source = event.CloneURL
+	}
+
+	req := BuildRequest{
+		Source:      source,
+		Ref:         event.Commit,
+		Tag:         tag.String(),
+		Clean:       b.Clean,
+		Environment: b.Environment,
+		Method:      b.Method,
+		ContextDir:  b.ContextDir,
+	}
+	req.BaseImage = b.BaseImage
+	req.RuntimeImage = b.RuntimeImage
+
+	return req, nil
+}
+
+// Determines whether cloneURL is a remote git URL of the repository with the given
+// full name and web URL: on the host of the web URL, at its path, which ends with the
+// full name.  Local paths and the URLs of other repositories are not.
+func isCloneURLOf(cloneURL string, repository string, webURL string) bool {
+	host, path, ok := splitGitURL(cloneURL)
+	if !ok || repository == "" {
+		return false
+	}
+	webHost, webPath, ok := splitGitURL(webURL)
+	if !ok {
+		return false
+	}
+
+	return host == webHost && path == webPath && (path == repository || strings.HasSuffix(path, "/"+repository))
+}
+
+// Returns the host of a remote git URL, without its port, and the path of the
+// repository on the host, without its leading slash and .git suffix.
+func splitGitURL(gitURL string) (string, string, bool) {
+	if !isGitURL(gitURL) {
+		return "", "", false
+	}
+
+	var host, path string
+	if strings.Contains(gitURL, "://") {
+		u, err := url.Parse(gitURL)
+		if err != nil || u.RawQuery != "" || u.Fragment != "" {
+			return "", "", false
+		}
+		host, path = u.Host, u.Path
+	} else {
+		// scp-style user@host:path
+		at := strings.Index(gitURL, "@")
+		colon := at + strings.Index(gitURL[at:], ":")
+		host, path = gitURL[at+1:colon], gitURL[colon+1:]
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	path = strings.TrimSuffix(strings.Trim(path, "/"), ".git")
+	return strings.ToLower(host), path, host != "" && path != ""
+}
+
+// Payload of GitHub push events.
+type githubPush struct {
+	Ref        string
+	After      string
+	Deleted    bool
+	Repository struct {
+		Name     string
+		FullName string `json:"full_name"`
+		Owner    struct {
+			Name  string
+			Login string
+		}
+		HTMLURL  string `json:"html_url"`
+		CloneURL string `json:"clone_url"`
+		GitURL   string `json:"git_url"`
+	}
+}
+
+// Payload of GitLab push events.
+type gitlabPush struct {
+	Ref     string
+	After   string
+	Project struct {
+		Name              string
+		PathWithNamespace string `json:"path_with_namespace"`
+		WebURL            string `json:"web_url"`
+		GitHTTPURL        string `json:"git_http_url"`
+	}
+	Repository struct {
+		Name       string
+		Homepage   string
+		GitHTTPURL string `json:"git_http_url"`
+	}
+}
+
+// Matches the full IDs of git commits.
+var commitPattern = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// Parses a GitHub push payload.
+func parseGithubPush(body []byte) (*PushEvent, error) {
+	var push githubPush
+	err := json.Unmarshal(body, &push)
+	if err != nil {
+		return nil, err
+	}
+	if push.Deleted {
+		return nil, nil
+	}
+
+	repo := push.Repository
+	event := &PushEvent{Repository: repo.FullName, Name: repo.Name, URL: repo.HTMLURL, CloneURL: repo.CloneURL}
+	if event.Repository == "" {
+		owner := repo.Owner.Login
+		if owner == "" {
+			owner = repo.Owner.Name
+		}
+		event.Repository = owner + "/" + repo.Name
+	}
+	if event.CloneURL == "" {
+		event.CloneURL = repo.GitURL
+	}
+
+	return pushEvent(event, push.Ref, push.After)
+}
+
+// Parses a GitLab push payload.
+func parseGitlabPush(body []byte) (*PushEvent, error) {
+	var push gitlabPush
+	err := json.Unmarshal(body, &push)
+	if err != nil {
+		return nil, err
+	}
+
+	event := &PushEvent{
+		Repository: push.Project.PathWithNamespace,
+		Name:       push.Project.Name,
+		URL:        push.Project.WebURL,
+		CloneURL:   push.Project.GitHTTPURL,
+	}
+	if event.Name == "" {
+		event.Name = push.Repository.Name
+	}
+	if event.URL == "" {
+		event.URL = push.Repository.Homepage
+	}
+	if event.CloneURL == "" {
+		event.CloneURL = push.Repository.GitHTTPURL
+	}
+
+	return pushEvent(event, push.Ref, push.After)
+}
+
+// Completes event with the branch and commit of a push, returning nil for pushes that
+// do not leave a commit to build on a branch, such as tag pushes and branch deletions.
+// The commit must be a full commit ID, since it is passed to git.
+func pushEvent(event *PushEvent, ref, commit string) (*PushEvent, error) {
+	if !strings.HasPrefix(ref, "refs/heads/") || commit == "" || strings.Trim(commit, "0") == "" {
+		return nil, nil
+	}
+	if !commitPattern.MatchString(commit) {
+		return nil, ErrInvalidCommit
+	}
+
+	event.Branch = strings.TrimPrefix(ref, "refs/heads/")
+	event.Commit = commit
+	event.ShortCommit = commit[:7]
+
+	return event, nil
+}
+
+// Verifies the signature of a GitHub payload, given as the hex HMAC of the body in
+// the X-Hub-Signature-256 header, or the older X-Hub-Signature header.
+func verifyGithubSignature(r *http.Request, body []byte, secret string) bool {
+	var mac hash.Hash
+	signature := r.Header.Get("X-Hub-Signature-256")
+	if signature != "" {
+		if !strings.HasPrefix(signature, "sha256=") {
+			return false
+		}
+		mac = hmac.New(sha256.New, []byte(secret))
+	} else {
+		signature = r.Header.Get("X-Hub-Signature")
+		if !strings.HasPrefix(signature, "sha1=") {
+			return false
+		}
+		mac = hmac.New(sha1.New, []byte(secret))
+	}
+
+	expected, err := hex.DecodeString(signature[strings.Index(signature, "=")+1:])
+	if err != nil {
+		return false
+	}
+	mac.Write(body)
+
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+// Verifies the token sent with a GitLab payload.
+func verifyGitlabToken(r *http.Request, secret string) bool {
+	return hmac.Equal([]byte(r.Header.Get("X-Gitlab-Token")), []byte(secret))
+}
+
+// Receives a push webhook from the given host, github or gitlab, and queues the builds
+// configured for it.  Either every build is queued, or none is.
+func (s *Server) receiveWebhook(w http.ResponseWriter, r *http.Request, host string) {
+	if s.Webhooks == nil {
+		writeError(w, http.StatusNotFound, "Not found")
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxWebhookPayload+1))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(body) > maxWebhookPayload {
+		writeError(w, http.StatusRequestEntityTooLarge, "Payload too large")
+		return
+	}
+
+	if s.Webhooks.Secret == "" && !s.Webhooks.Insecure {
+		writeError(w, http.StatusForbidden, "No webhook secret is configured")
+		return
+	}
+
+	var event *PushEvent
+	switch host {
+	case "github":
+		if s.Webhooks.Secret != "" && !verifyGithubSignature(r, body, s.Webhooks.Secret) {
+			writeError(w, http.StatusUnauthorized, "Invalid signature")
+			return
+		}
+		if r.Header.Get("X-GitHub-Event") != "push" {
+			writeJSON(w, http.StatusOK, WebhookResult{})
+			return
+		}
+		event, err = parseGithubPush(body)
+	case "gitlab":
+		if s.Webhooks.Secret != "" && !verifyGitlabToken(r, s.Webhooks.Secret) {
+			writeError(w, http.StatusUnauthorized, "Invalid token")
+			return
+		}
+		if r.Header.Get("X-Gitlab-Event") != "Push Hook" {
+			writeJSON(w, http.StatusOK, WebhookResult{})
+			return
+		}
+		event, err = parseGitlabPush(body)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	result := WebhookResult{Builds: []string{}}
+	if event == nil {
+		writeJSON(w, http.StatusOK, result)
+		return
+	}
+
+	var reqs []BuildRequest
+	var priorities []int
+	for i := range s.Webhooks.Builds {
+		build := &s.Webhooks.Builds[i]
+		if !build.matches(event) {
+			continue
+		}
+
+		req, err := build.request(event)
+		if err == ErrInvalidCloneURL {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		s.configure(&req.Request)
+		reqs = append(reqs, req)
+		priorities = append(priorities, build.Priority)
+	}
+
+	for i, req := range reqs {
+		id, err := s.submit(req, priorities[i])
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		result.Builds = append(result.Builds, id)
+	}
+
+	if len(result.Builds) == 0 {
+		writeJSON(w, http.StatusOK, result)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, result)
+}
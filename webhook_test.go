@@ -0,0 +1,310 @@
+package sti
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "launchpad.net/gocheck"
+)
+
+type WebhookSuite struct {
+	server   *Server
+	listener *httptest.Server
+	requests chan BuildRequest
+}
+
+var _ = Suite(&WebhookSuite{})
+
+const webhookSecret = "s3cret"
+
+func (s *WebhookSuite) SetUpTest(c *C) {
+	requests := make(chan BuildRequest, 10)
+	s.requests = requests
+
+	s.server = NewServer(Request{DockerSocket: "unix:///server.sock"}, 1)
+	s.server.build = func(req BuildRequest) (*BuildResult, error) {
+		requests <- req
+		return &BuildResult{Success: true}, nil
+	}
+	s.server.Webhooks = &WebhookConfig{
+		Secret: webhookSecret,
+		Builds: []WebhookBuild{
+			{
+				Repository:   "pmorie/simple-ruby",
+				Branch:       "master",
+				BaseImage:    "pmorie/centos-ruby2",
+				RuntimeImage: "pmorie/centos-ruby2-runtime",
+				Tag:          "test/{{.Name}}:{{.Branch}}-{{.ShortCommit}}",
+				Environment:  map[string]string{"RACK_ENV": "production"},
+			},
+			{
+				Repository: "http://example.com/mike/diaspora.git",
+				BaseImage:  "pmorie/centos-ruby2",
+				Tag:        "test/diaspora:{{.Branch}}",
+				ContextDir: "app",
+			},
+		},
+	}
+	s.listener = httptest.NewServer(s.server)
+}
+
+func (s *WebhookSuite) TearDownTest(c *C) {
+	s.listener.Close()
+}
+
+func readPayload(c *C, name string) []byte {
+	body, err := ioutil.ReadFile("testdata/" + name)
+	c.Assert(err, IsNil)
+	return body
+}
+
+func githubSignature(body []byte, secret string) string {
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write(body)
+	return "sha1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *WebhookSuite) post(c *C, path string, body []byte, headers map[string]string) (int, WebhookResult) {
+	httpReq, err := http.NewRequest("POST", s.listener.URL+path, bytes.NewReader(body))
+	c.Assert(err, IsNil)
+	for key, value := range headers {
+		httpReq.Header.Set(key, value)
+	}
+
+	resp, err := http.DefaultClient.Do(httpReq)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+
+	var result WebhookResult
+	json.NewDecoder(resp.Body).Decode(&result)
+	return resp.StatusCode, result
+}
+
+// Test a signed GitHub push queueing the configured build of the pushed commit
+func (s *WebhookSuite) TestGithubPush(c *C) {
+	body := readPayload(c, "github-push.json")
+	code, result := s.post(c, "/hooks/github", body, map[string]string{
+		"X-GitHub-Event":  "push",
+		"X-Hub-Signature": githubSignature(body, webhookSecret),
+	})
+	c.Assert(code, Equals, http.StatusAccepted)
+	c.Assert(result.Builds, HasLen, 1)
+
+	req := <-s.requests
+	c.Assert(req.Source, Equals, "https://github.com/pmorie/simple-ruby.git")
+	c.Assert(req.Ref, Equals, "0d1a26e67d8f5eaf1f6ba5c57fc3c7d91ac0fd1c")
+	c.Assert(req.Tag, Equals, "test/simple-ruby:master-0d1a26e")
+	c.Assert(req.BaseImage, Equals, "pmorie/centos-ruby2")
+	c.Assert(req.RuntimeImage, Equals, "pmorie/centos-ruby2-runtime")
+	c.Assert(req.Environment["RACK_ENV"], Equals, "production")
+	c.Assert(req.DockerSocket, Equals, "unix:///server.sock")
+}
+
+// Test a GitHub push with a bad or missing signature being rejected
+func (s *WebhookSuite) TestGithubBadSignature(c *C) {
+	body := readPayload(c, "github-push.json")
+
+	code, _ := s.post(c, "/hooks/github", body, map[string]string{
+		"X-GitHub-Event":  "push",
+		"X-Hub-Signature": githubSignature(body, "wrong"),
+	})
+	c.Assert(code, Equals, http.StatusUnauthorized)
+
+	code, _ = s.post(c, "/hooks/github", body, map[string]string{"X-GitHub-Event": "push"})
+	c.Assert(code, Equals, http.StatusUnauthorized)
+
+	tampered := bytes.Replace(body, []byte("refs/heads/master"), []byte("refs/heads/other"), 1)
+	code, _ = s.post(c, "/hooks/github", tampered, map[string]string{
+		"X-GitHub-Event":  "push",
+		"X-Hub-Signature": githubSignature(body, webhookSecret),
+	})
+	c.Assert(code, Equals, http.StatusUnauthorized)
+	c.Assert(s.requests, HasLen, 0)
+}
+
+// Test pushes to unconfigured branches, branch deletions and other events queueing nothing
+func (s *WebhookSuite) TestGithubIgnoredPushes(c *C) {
+	body := readPayload(c, "github-push.json")
+
+	for _, payload := range [][]byte{
+		bytes.Replace(body, []byte("refs/heads/master"), []byte("refs/heads/feature"), 1),
+		bytes.Replace(body, []byte("refs/heads/master"), []byte("refs/tags/v1.0"), 1),
+		bytes.Replace(body, []byte(`"deleted": false`), []byte(`"deleted": true`), 1),
+	} {
+		code, result := s.post(c, "/hooks/github", payload, map[string]string{
+			"X-GitHub-Event":  "push",
+			"X-Hub-Signature": githubSignature(payload, webhookSecret),
+		})
+		c.Assert(code, Equals, http.StatusOK)
+		c.Assert(result.Builds, HasLen, 0)
+	}
+
+	ping := []byte(`{"zen": "Keep it logically awesome."}`)
+	code, _ := s.post(c, "/hooks/github", ping, map[string]string{
+		"X-GitHub-Event":  "ping",
+		"X-Hub-Signature": githubSignature(ping, webhookSecret),
+	})
+	c.Assert(code, Equals, http.StatusOK)
+	c.Assert(s.requests, HasLen, 0)
+}
+
+// Test a GitLab push with a valid token queueing the build configured by clone URL
+func (s *WebhookSuite) TestGitlabPush(c *C) {
+	body := readPayload(c, "gitlab-push.json")
+	code, result := s.post(c, "/hooks/gitlab", body, map[string]string{
+		"X-Gitlab-Event": "Push Hook",
+		"X-Gitlab-Token": webhookSecret,
+	})
+	c.Assert(code, Equals, http.StatusAccepted)
+	c.Assert(result.Builds, HasLen, 1)
+
+	req := <-s.requests
+	c.Assert(req.Source, Equals, "http://example.com/mike/diaspora.git")
+	c.Assert(req.Ref, Equals, "da1560886d4f094c3e6c9ef40349f7d38b5d27d7")
+	c.Assert(req.Tag, Equals, "test/diaspora:develop")
+	c.Assert(req.ContextDir, Equals, "app")
+
+	code, _ = s.post(c, "/hooks/gitlab", body, map[string]string{
+		"X-Gitlab-Event": "Push Hook",
+		"X-Gitlab-Token": "wrong",
+	})
+	c.Assert(code, Equals, http.StatusUnauthorized)
+}
+
+// Test pushes of anything but a full commit ID being rejected
+func (s *WebhookSuite) TestInvalidCommit(c *C) {
+	body := readPayload(c, "github-push.json")
+
+	for _, commit := range []string{"--upload-pack=touch /tmp/pwned", "0d1a26e", "0D1A26E67D8F5EAF1F6BA5C57FC3C7D91AC0FD1C"} {
+		payload := bytes.Replace(body, []byte("0d1a26e67d8f5eaf1f6ba5c57fc3c7d91ac0fd1c"), []byte(commit), -1)
+		code, _ := s.post(c, "/hooks/github", payload, map[string]string{
+			"X-GitHub-Event":  "push",
+			"X-Hub-Signature": githubSignature(payload, webhookSecret),
+		})
+		c.Assert(code, Equals, http.StatusBadRequest, Commentf(commit))
+	}
+	c.Assert(s.requests, HasLen, 0)
+}
+
+// Test that clone URLs not belonging to the repository are not cloned
+func (s *WebhookSuite) TestInvalidCloneURL(c *C) {
+	body := readPayload(c, "github-push.json")
+
+	for _, url := range []string{"/srv/secrets", "file:///srv/secrets", "https://github.com/pmorie/other.git",
+		"https://github.com/pmorie/simple-ruby/../other/pmorie/simple-ruby.git", "https://evil.example.com/pmorie/simple-ruby.git"} {
+		payload := bytes.Replace(body, []byte(`"https://github.com/pmorie/simple-ruby.git"`), []byte(`"`+url+`"`), -1)
+		code, _ := s.post(c, "/hooks/github", payload, map[string]string{
+			"X-GitHub-Event":  "push",
+			"X-Hub-Signature": githubSignature(payload, webhookSecret),
+		})
+		c.Assert(code, Equals, http.StatusBadRequest, Commentf(url))
+	}
+	c.Assert(s.requests, HasLen, 0)
+
+	s.server.Webhooks.Builds[0].Source = "git@github.com:pmorie/simple-ruby.git"
+	payload := bytes.Replace(body, []byte(`"https://github.com/pmorie/simple-ruby.git"`), []byte(`"/srv/secrets"`), -1)
+	code, _ := s.post(c, "/hooks/github", payload, map[string]string{
+		"X-GitHub-Event":  "push",
+		"X-Hub-Signature": githubSignature(payload, webhookSecret),
+	})
+	c.Assert(code, Equals, http.StatusAccepted)
+	c.Assert((<-s.requests).Source, Equals, "git@github.com:pmorie/simple-ruby.git")
+}
+
+// Test recognizing the clone URLs of a repository, on its host and at its path
+func (s *WebhookSuite) TestIsCloneURLOf(c *C) {
+	const webURL = "https://github.com/pmorie/simple-ruby"
+	for _, url := range []string{"https://github.com/pmorie/simple-ruby.git", "git://github.com/pmorie/simple-ruby",
+		"git@github.com:pmorie/simple-ruby.git", "ssh://git@GitHub.com:22/pmorie/simple-ruby.git"} {
+		c.Assert(isCloneURLOf(url, "pmorie/simple-ruby", webURL), Equals, true, Commentf(url))
+	}
+	for _, url := range []string{"/pmorie/simple-ruby", "file:///pmorie/simple-ruby", "https://github.com/xpmorie/simple-ruby.git",
+		"https://github.com/pmorie/simple-ruby.git/other", "https://github.com/other/pmorie/simple-ruby.git",
+		"https://evil.example.com/pmorie/simple-ruby.git", "git@github.com.evil.example.com:pmorie/simple-ruby.git",
+		"https://github.com/pmorie/simple-ruby.git?upload-pack=x"} {
+		c.Assert(isCloneURLOf(url, "pmorie/simple-ruby", webURL), Equals, false, Commentf(url))
+	}
+
+	c.Assert(isCloneURLOf("https://github.com/pmorie/simple-ruby.git", "pmorie/simple-ruby", ""), Equals, false)
+	c.Assert(isCloneURLOf("https://github.com/pmorie/simple-ruby.git", "other/simple-ruby", webURL), Equals, false)
+	c.Assert(isCloneURLOf("https://example.com/gitlab/mike/diaspora.git", "mike/diaspora", "https://example.com/gitlab/mike/diaspora"), Equals, true)
+}
+
+// Test that a push queues every build configured for it, or none if one of them is
+// invalid
+func (s *WebhookSuite) TestAllBuildsQueued(c *C) {
+	s.server.Webhooks.Builds = append([]WebhookBuild{{
+		Repository: "pmorie/simple-ruby",
+		Source:     "git@github.com:pmorie/simple-ruby.git",
+		BaseImage:  "pmorie/centos-ruby2",
+		Tag:        "test/simple-ruby-ssh:{{.Branch}}",
+	}}, s.server.Webhooks.Builds...)
+	body := readPayload(c, "github-push.json")
+
+	payload := bytes.Replace(body, []byte(`"https://github.com/pmorie/simple-ruby.git"`), []byte(`"/srv/secrets"`), -1)
+	code, _ := s.post(c, "/hooks/github", payload, map[string]string{
+		"X-GitHub-Event":  "push",
+		"X-Hub-Signature": githubSignature(payload, webhookSecret),
+	})
+	c.Assert(code, Equals, http.StatusBadRequest)
+	c.Assert(s.requests, HasLen, 0)
+
+	code, result := s.post(c, "/hooks/github", body, map[string]string{
+		"X-GitHub-Event":  "push",
+		"X-Hub-Signature": githubSignature(body, webhookSecret),
+	})
+	c.Assert(code, Equals, http.StatusAccepted)
+	c.Assert(result.Builds, HasLen, 2)
+	c.Assert(result.Builds[0], Not(Equals), result.Builds[1])
+
+	tags := map[string]bool{(<-s.requests).Tag: true, (<-s.requests).Tag: true}
+	c.Assert(tags, DeepEquals, map[string]bool{"test/simple-ruby-ssh:master": true, "test/simple-ruby:master-0d1a26e": true})
+}
+
+// Test that webhooks are refused without a secret, unless explicitly accepted
+func (s *WebhookSuite) TestNoSecret(c *C) {
+	s.server.Webhooks.Secret = ""
+	body := readPayload(c, "gitlab-push.json")
+	headers := map[string]string{"X-Gitlab-Event": "Push Hook"}
+
+	code, _ := s.post(c, "/hooks/gitlab", body, headers)
+	c.Assert(code, Equals, http.StatusForbidden)
+	c.Assert(s.requests, HasLen, 0)
+
+	s.server.Webhooks.Insecure = true
+	code, _ = s.post(c, "/hooks/gitlab", body, headers)
+	c.Assert(code, Equals, http.StatusAccepted)
+	<-s.requests
+}
+
+// Test the webhook endpoints being disabled without a configuration
+func (s *WebhookSuite) TestNoWebhooks(c *C) {
+	s.server.Webhooks = nil
+	code, _ := s.post(c, "/hooks/github", readPayload(c, "github-push.json"), nil)
+	c.Assert(code, Equals, http.StatusNotFound)
+}
+
+// Test loading a configuration, rejecting invalid tag templates
+func (s *WebhookSuite) TestLoadWebhookConfig(c *C) {
+	dir := c.MkDir()
+	path := dir + "/hooks.json"
+
+	config := `{"Secret": "abc", "Builds": [{"Repository": "a/b", "BaseImage": "builder", "Tag": "a/b:{{.Branch}}"}]}`
+	c.Assert(ioutil.WriteFile(path, []byte(config), 0644), IsNil)
+	loaded, err := LoadWebhookConfig(path)
+	c.Assert(err, IsNil)
+	c.Assert(loaded.Secret, Equals, "abc")
+	c.Assert(loaded.Builds, HasLen, 1)
+
+	config = strings.Replace(config, "{{.Branch}}", "{{.Branch", 1)
+	c.Assert(ioutil.WriteFile(path, []byte(config), 0644), IsNil)
+	_, err = LoadWebhookConfig(path)
+	c.Assert(err, NotNil)
+}